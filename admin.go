@@ -0,0 +1,301 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// errors returned by the admin API
+var (
+	errInvalidUsername   = errors.New("Invalid username")
+	errInvalidPassword   = errors.New("Plain text passwords can not contain colons or newlines")
+	errInvalidPrivileges = errors.New("Privileges must be a combination of r and w")
+	errInvalidUserDir    = errors.New("Dir must be an absolute path without colons or newlines")
+	errUserExists        = errors.New("User already exists")
+	errInvalidCmd        = errors.New("Newlines not allowed in cmd")
+)
+
+// adminUserRequest is the body of a create user request.
+type adminUserRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Privileges string `json:"privileges"`
+	Dir        string `json:"dir"`
+	NoUserDir  bool   `json:"nouserdir"`
+	UpSize     string `json:"upsize"`
+	Recursive  string `json:"recursive"`
+	Permanent  bool   `json:"permanent"`
+	Plaintext  bool   `json:"plaintext"`
+	Cmd        string `json:"cmd"`
+}
+
+// adminUser is a user as returned by the admin API.
+type adminUser struct {
+	Username   string `json:"username"`
+	Password   string `json:"password,omitempty"`
+	Privileges string `json:"privileges"`
+	Dir        string `json:"dir"`
+	UpSize     uint64 `json:"upsize"`
+	Recursive  string `json:"recursive"`
+	Permanent  bool   `json:"permanent"`
+	Cmd        string `json:"cmd,omitempty"`
+}
+
+// newAdminUser converts a UserInfo to an adminUser without the password.
+func newAdminUser(u UserInfo) adminUser {
+	return adminUser{Username: string(u.Username), Privileges: string(u.Privileges),
+		Dir: string(u.UserDir), UpSize: u.UpSize, Recursive: string(u.Recursive), Permanent: u.Permanent,
+		Cmd: string(u.Cmd)}
+}
+
+// userInfo validates a create user request and converts it to a UserInfo.
+// Usernames and passwords that are not set are generated as set by config.
+func (r adminUserRequest) userInfo(config Config) (userInfo UserInfo, err error) {
+	if r.Username == "" {
+		r.Username = string(randUser(config))
+	}
+	if !validUsername(r.Username) {
+		return userInfo, errInvalidUsername
+	}
+
+	if r.Password == "" {
+		r.Password = string(randPass(config))
+	}
+	if r.Plaintext && strings.ContainsAny(r.Password, ":\n") {
+		return userInfo, errInvalidPassword
+	}
+
+	if r.Privileges == "" || strings.Trim(r.Privileges, "rw") != "" || strings.Trim(r.Recursive, "rw") != "" {
+		return userInfo, errInvalidPrivileges
+	}
+
+	if strings.Contains(r.Cmd, "\n") {
+		return userInfo, errInvalidCmd
+	}
+	if _, err = pipelineStages(config, r.Cmd); err != nil {
+		return userInfo, err
+	}
+
+	userInfo.Username = []byte(r.Username)
+	userInfo.Cmd = []byte(r.Cmd)
+	userInfo.Password = []byte(r.Password)
+	userInfo.Permanent = r.Permanent
+	userInfo.Plaintext = r.Plaintext
+
+	if r.Dir == "" && !r.NoUserDir {
+		userInfo.UserDir = []byte(config.UsersDir + r.Username)
+	} else if r.Dir != "" {
+		if !strings.HasPrefix(r.Dir, string(filepath.Separator)) {
+			return userInfo, errInvalidUserDir
+		}
+		userInfo.UserDir = []byte(addSepSuffix(r.Dir))
+	}
+	if strings.ContainsAny(string(userInfo.UserDir), ":\n") {
+		return userInfo, errInvalidUserDir
+	}
+
+	// Privileges are stored in the same order as the user command creates them.
+	if strings.Contains(r.Privileges, "r") {
+		userInfo.Privileges = append(userInfo.Privileges, byte('r'))
+	}
+	if strings.Contains(r.Privileges, "w") {
+		userInfo.Privileges = append(userInfo.Privileges, byte('w'))
+	}
+	if strings.Contains(r.Recursive, "r") {
+		userInfo.Recursive = append(userInfo.Recursive, byte('r'))
+	}
+	if strings.Contains(r.Recursive, "w") {
+		userInfo.Recursive = append(userInfo.Recursive, byte('w'))
+	}
+
+	if r.UpSize != "" && r.UpSize != "0" {
+		if si, err := strconv.ParseUint(r.UpSize, 10, 64); err == nil {
+			userInfo.UpSize = si
+		} else if userInfo.UpSize, err = toBytes(r.UpSize); err != nil {
+			return userInfo, err
+		}
+	}
+
+	return userInfo, nil
+}
+
+// adminAPI serves the admin http API for a server.
+type adminAPI struct {
+	server *Server
+	token  string
+}
+
+// newAdminServer creates an http server for the admin API.
+func newAdminServer(s *Server, token string) *http.Server {
+	api := adminAPI{server: s, token: token}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users", api.handleUsers)
+	mux.HandleFunc("/users/", api.handleUser)
+	mux.HandleFunc("/sessions", api.handleSessions)
+
+	return &http.Server{Handler: api.authenticate(mux)}
+}
+
+// listenAdmin listens on a tcp address or, if prefixed with "unix:", a unix socket.
+func listenAdmin(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+
+	path := strings.TrimPrefix(addr, "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// authenticate only lets requests with the correct bearer token through.
+func (a adminAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			logWarning.Printf("Admin API: rejected request from %s\n", r.RemoteAddr)
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("Invalid token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleUsers lists users on GET and creates a user on POST.
+func (a adminAPI) handleUsers(w http.ResponseWriter, r *http.Request) {
+	config, _ := a.server.currentConfig()
+
+	switch r.Method {
+	case "GET":
+		users, err := listUsers(config.PasswdFile)
+		if err != nil {
+			logError.Printf("Admin API: unable to list users: %s\n", err)
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		out := []adminUser{}
+		for _, u := range users {
+			out = append(out, newAdminUser(u))
+		}
+		writeJSON(w, http.StatusOK, out)
+	case "POST":
+		var req adminUserRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		generatedPass := req.Password == ""
+		userInfo, err := req.userInfo(config)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err = createUser(userInfo, config.PasswdFile); err == errUserExists {
+			writeJSONError(w, http.StatusConflict, err)
+			return
+		} else if err != nil {
+			logError.Printf("Admin API: %s\n", err)
+			writeJSONError(w, http.StatusInternalServerError, err)
+			return
+		}
+		logInfo.Printf("Admin API: user %s added\n", string(userInfo.Username))
+
+		out := newAdminUser(userInfo)
+		if generatedPass {
+			out.Password = string(userInfo.Password)
+		}
+		writeJSON(w, http.StatusCreated, out)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+	}
+}
+
+// handleUser deletes the user named in the path on DELETE.
+func (a adminAPI) handleUser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+
+	config, _ := a.server.currentConfig()
+	username := strings.TrimPrefix(r.URL.Path, "/users/")
+
+	found, err := deleteUser(config.PasswdFile, username)
+	if err != nil {
+		logError.Printf("Admin API: unable to delete user %s: %s\n", username, err)
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("No such user"))
+		return
+	}
+
+	logInfo.Printf("Admin API: user %s deleted\n", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSessions lists the active sessions on GET.
+func (a adminAPI) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed"))
+		return
+	}
+
+	sessions := a.server.activeSessions()
+	if sessions == nil {
+		sessions = []sessionInfo{}
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError writes an error as a JSON response.
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// testAdminRequest sends a request with the given token to an admin API handler.
+func testAdminRequest(h http.Handler, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+
+	return w
+}
+
+func TestAdminUserRequest(t *testing.T) {
+	type testStruct struct {
+		userInfo UserInfo
+		err      error
+	}
+
+	tests := make(map[adminUserRequest]testStruct)
+	tests[adminUserRequest{Username: "testy", Password: "mctest", Privileges: "wr", Recursive: "w", UpSize: "1K", Plaintext: true}] =
+		testStruct{UserInfo{Username: []byte("testy"), Password: []byte("mctest"), Privileges: []byte("rw"),
+			UserDir: []byte("/tmp/users/testy"), Recursive: []byte("w"), UpSize: 1024, Plaintext: true}, nil}
+	tests[adminUserRequest{Username: "testy", Password: "mctest", Privileges: "r", Dir: "/tmp/dir", Permanent: true}] =
+		testStruct{UserInfo{Username: []byte("testy"), Password: []byte("mctest"), Privileges: []byte("r"),
+			UserDir: []byte("/tmp/dir/"), Permanent: true}, nil}
+	tests[adminUserRequest{Username: "testy", Password: "mctest", Privileges: "w", NoUserDir: true}] =
+		testStruct{UserInfo{Username: []byte("testy"), Password: []byte("mctest"), Privileges: []byte("w")}, nil}
+	tests[adminUserRequest{Username: "te:sty", Password: "mctest", Privileges: "w"}] = testStruct{UserInfo{}, errInvalidUsername}
+	tests[adminUserRequest{Username: "..", Password: "mctest", Privileges: "w"}] = testStruct{UserInfo{}, errInvalidUsername}
+	tests[adminUserRequest{Username: "te sty", Password: "mctest", Privileges: "w"}] = testStruct{UserInfo{}, errInvalidUsername}
+	tests[adminUserRequest{Username: "testy", Password: "mc:test", Privileges: "w", Plaintext: true}] = testStruct{UserInfo{}, errInvalidPassword}
+	tests[adminUserRequest{Username: "testy", Password: "mctest", Privileges: "x"}] = testStruct{UserInfo{}, errInvalidPrivileges}
+	tests[adminUserRequest{Username: "testy", Password: "mctest"}] = testStruct{UserInfo{}, errInvalidPrivileges}
+	tests[adminUserRequest{Username: "testy", Password: "mctest", Privileges: "w", Dir: "tmp"}] = testStruct{UserInfo{}, errInvalidUserDir}
+	tests[adminUserRequest{Username: "testy", Password: "mctest", Privileges: "w", Dir: "/x:rw"}] = testStruct{UserInfo{}, errInvalidUserDir}
+	tests[adminUserRequest{Username: "testy", Password: "mctest", Privileges: "w", Dir: "/x\nroot:$0$pw:rw:/:0::p"}] =
+		testStruct{UserInfo{}, errInvalidUserDir}
+	tests[adminUserRequest{Username: "testy", Password: "mc\ntest", Privileges: "w", Plaintext: true}] = testStruct{UserInfo{}, errInvalidPassword}
+
+	i := 0
+	for testIn, expectedOut := range tests {
+		userInfo, err := testIn.userInfo(Config{UsersDir: "/tmp/users/"})
+		if err != expectedOut.err {
+			t.Errorf("Error (%v) does not match expected (%v)\n", err, expectedOut.err)
+		} else if err == nil {
+			verifyUserInfo(i, userInfo, expectedOut.userInfo, t)
+		}
+		i++
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	initLog("-", "none")
+	config, cleanup := testServerConfig(t)
+	defer cleanup()
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create server: %s\n", err)
+	}
+	h := newAdminServer(server, "secret").Handler
+
+	if w := testAdminRequest(h, "GET", "/users", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Request without token returned %d\n", w.Code)
+	}
+	if w := testAdminRequest(h, "GET", "/users", "wrong", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Request with wrong token returned %d\n", w.Code)
+	}
+
+	w := testAdminRequest(h, "POST", "/users", "secret", `{"privileges": "w"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Create user returned %d: %s\n", w.Code, w.Body.String())
+	}
+	var created adminUser
+	if err = json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("Unable to decode response: %s\n", err)
+	}
+	if len(created.Username) != 8 || len(created.Password) != 12 {
+		t.Errorf("Generated credentials (%s/%s) have the wrong length\n", created.Username, created.Password)
+	}
+	if ok, _ := dirExists(config.UsersDir + created.Username); !ok {
+		t.Errorf("User directory not created\n")
+	}
+
+	if w = testAdminRequest(h, "POST", "/users", "secret", `{"username": "testuser", "privileges": "w"}`); w.Code != http.StatusConflict {
+		t.Errorf("Create existing user returned %d\n", w.Code)
+	}
+
+	w = testAdminRequest(h, "GET", "/users", "secret", "")
+	var users []adminUser
+	if err = json.NewDecoder(w.Body).Decode(&users); err != nil {
+		t.Fatalf("Unable to decode response: %s\n", err)
+	}
+	if len(users) != 2 || users[0].Username != "testuser" || users[1].Username != created.Username {
+		t.Errorf("Unexpected users %+v\n", users)
+	}
+
+	if w = testAdminRequest(h, "DELETE", "/users/"+created.Username, "secret", ""); w.Code != http.StatusNoContent {
+		t.Errorf("Delete user returned %d\n", w.Code)
+	}
+	if w = testAdminRequest(h, "DELETE", "/users/"+created.Username, "secret", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Delete missing user returned %d\n", w.Code)
+	}
+	if users, _ := listUsers(config.PasswdFile); len(users) != 1 {
+		t.Errorf("Passwd file has %d users, expected 1\n", len(users))
+	}
+
+	w = testAdminRequest(h, "GET", "/sessions", "secret", "")
+	if w.Code != http.StatusOK || w.Body.String() != "[]\n" {
+		t.Errorf("Sessions returned %d: %q\n", w.Code, w.Body.String())
+	}
+
+	os.Remove(config.UsersDir + created.Username)
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is the largest chunk sent to clamd in one INSTREAM packet.
+const clamdChunkSize = 64 * 1024
+
+// clamdTimeout limits how long a single scan may take.
+const clamdTimeout = 10 * time.Minute
+
+// quarantinedFile is an upload that was moved to quarantine instead of being stored.
+type quarantinedFile struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// dialClamd connects to clamd on a unix socket, given as an absolute path,
+// or on a tcp address.
+func dialClamd(socket string) (net.Conn, error) {
+	if strings.HasPrefix(socket, "/") {
+		return net.DialTimeout("unix", socket, 10*time.Second)
+	}
+
+	return net.DialTimeout("tcp", socket, 10*time.Second)
+}
+
+// clamdWriter writes data as INSTREAM chunks, each prefixed with its length.
+type clamdWriter struct {
+	w io.Writer
+}
+
+// Write sends p as one or more chunks.
+func (c clamdWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		if _, err = c.w.Write(size); err != nil {
+			return n, err
+		}
+		if _, err = c.w.Write(chunk); err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, nil
+}
+
+// clamdScan streams r to clamd with the INSTREAM command. It returns the name
+// of the virus found or an empty string if clamd found nothing.
+func clamdScan(socket string, r io.Reader) (virus string, err error) {
+	conn, err := dialClamd(socket)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(clamdTimeout))
+
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+
+	// clamd stops reading and answers if the stream is too large, so the
+	// answer is read even if sending fails.
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	_, sendErr := io.Copy(clamdWriter{w: w}, r)
+	if sendErr == nil {
+		if _, sendErr = w.Write([]byte{0, 0, 0, 0}); sendErr == nil {
+			sendErr = w.Flush()
+		}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		if sendErr != nil {
+			return "", sendErr
+		}
+		return "", err
+	}
+	reply = strings.TrimSuffix(reply, "\x00")
+	logDebug.Printf("clamd reply: %q\n", reply)
+
+	switch {
+	case strings.HasSuffix(reply, " OK"):
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(strings.TrimPrefix(reply, "stream: "), " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
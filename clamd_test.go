@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFakeClamd serves the INSTREAM command on a unix socket in dir. Streams
+// containing "EICAR" are reported as infected and "BROKEN" as an error.
+func testFakeClamd(dir string, t *testing.T) (socket string, stop func()) {
+	socket = filepath.Join(dir, "clamd.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to listen for fake clamd: %s\n", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, _ := r.ReadString(0); cmd != "zINSTREAM\x00" {
+					conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var data []byte
+				for {
+					size := make([]byte, 4)
+					if _, err := io.ReadFull(r, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(r, chunk); err != nil {
+						return
+					}
+					data = append(data, chunk...)
+				}
+
+				switch {
+				case bytes.Contains(data, []byte("EICAR")):
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				case bytes.Contains(data, []byte("BROKEN")):
+					conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				default:
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+
+	return socket, func() { listener.Close() }
+}
+
+func TestClamdScan(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropClamdTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket, stop := testFakeClamd(dir, t)
+	defer stop()
+
+	type testStruct struct {
+		virus string
+		err   bool
+	}
+
+	tests := make(map[string]testStruct)
+	tests["clean data"] = testStruct{"", false}
+	tests["X5O!P%@AP EICAR test"] = testStruct{"Eicar-Test-Signature", false}
+	tests["BROKEN"] = testStruct{"", true}
+	tests[strings.Repeat("large ", clamdChunkSize)+"EICAR"] = testStruct{"Eicar-Test-Signature", false}
+
+	for data, expected := range tests {
+		virus, err := clamdScan(socket, strings.NewReader(data))
+		if virus != expected.virus || (err != nil) != expected.err {
+			t.Errorf("Scan result (%q, %v) does not match expected (%q, %v)\n", virus, err, expected.virus, expected.err)
+		}
+	}
+
+	if _, err = clamdScan(filepath.Join(dir, "missing.sock"), strings.NewReader("data")); err == nil {
+		t.Errorf("Scan with missing clamd didnt fail as expected\n")
+	}
+}
+
+func TestScpSinkClamd(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropClamdTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket, stop := testFakeClamd(dir, t)
+	defer stop()
+
+	uploadDir := filepath.Join(dir, "upload")
+	quarantineDir := filepath.Join(dir, "quarantine")
+	os.Mkdir(uploadDir, 0750)
+	os.Mkdir(quarantineDir, 0750)
+
+	var reply bytes.Buffer
+	sink := newScpSink(bytes.NewBufferString("C0644 5 clean\nhello\x00C0644 5 virus\nEICAR\x00"), &reply, uploadDir)
+	sink.clamd = socket
+	sink.quarantineDir = quarantineDir
+	if err = sink.receive(".", false); err != nil {
+		t.Fatalf("FATAL - Unable to receive: %s\n", err)
+	}
+
+	if len(sink.files) != 1 || sink.files[0] != "clean" {
+		t.Errorf("Stored files (%v) does not match expected ([clean])\n", sink.files)
+	}
+	if len(sink.quarantined) != 1 || sink.quarantined[0].Name != "virus" {
+		t.Errorf("Quarantined files (%v) does not match expected ([virus])\n", sink.quarantined)
+	}
+	if _, err = os.Stat(filepath.Join(uploadDir, "virus")); !os.IsNotExist(err) {
+		t.Errorf("Infected file was not removed from the upload directory\n")
+	}
+	if names, _ := filepath.Glob(filepath.Join(quarantineDir, "*-virus")); len(names) != 1 {
+		t.Errorf("Files in quarantine (%v) does not match expected (1)\n", names)
+	}
+	if !strings.Contains(reply.String(), "\x01scp: virus: Virus found\n") {
+		t.Errorf("Reply (%q) does not contain the virus warning\n", reply.String())
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression methods for stored uploads.
+const (
+	compressGzip = "gzip"
+	compressZstd = "zstd"
+)
+
+// compressedSuffixes are the suffixes of stored files for each compression method.
+var compressedSuffixes = map[string]string{
+	compressGzip: ".gz",
+	compressZstd: ".zst",
+}
+
+// compressWriter returns a wrapper that compresses everything written to it
+// with method before it is written to f. Closing it closes f.
+func compressWriter(method string) func(f io.WriteCloser) (io.WriteCloser, error) {
+	return func(f io.WriteCloser) (io.WriteCloser, error) {
+		switch method {
+		case compressGzip:
+			return closeBoth{WriteCloser: gzip.NewWriter(f), file: f}, nil
+		case compressZstd:
+			zw, err := zstd.NewWriter(f)
+			if err != nil {
+				return nil, err
+			}
+			return closeBoth{WriteCloser: zw, file: f}, nil
+		default:
+			return nil, fmt.Errorf("Unknown compression %q", method)
+		}
+	}
+}
+
+// compressedMarkerSuffix ends the names of the hidden files that mark an
+// upload as compressed by the server.
+const compressedMarkerSuffix = ".scpdrop"
+
+// compressedMarker returns the name of the marker of the stored file name.
+// The marker holds the size of the original data and of the stored file, so
+// only files the server compressed itself are sent decompressed and the
+// original size is known without decompressing the file first.
+func compressedMarker(name string) string {
+	return filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+compressedMarkerSuffix)
+}
+
+// isCompressedMarker returns true if name is the marker of a compressed upload.
+func isCompressedMarker(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, compressedMarkerSuffix)
+}
+
+// isCompressedSuffix returns true if files stored with suffix are only
+// compressed, and not encrypted as well.
+func isCompressedSuffix(suffix string) bool {
+	for _, s := range compressedSuffixes {
+		if suffix == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markCompressed records that name in root was compressed by the server
+// from size bytes.
+func markCompressed(root *os.Root, name string, size uint64) error {
+	fi, err := root.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	return root.WriteFile(compressedMarker(name), []byte(fmt.Sprintf("%d %d\n", size, fi.Size())), 0600)
+}
+
+// compressedSize returns the original size of name in root and true if it
+// was compressed by the server and has not changed since. Other files,
+// including compressed files uploaded by clients, return false.
+func compressedSize(root *os.Root, name string, fi os.FileInfo) (int64, bool) {
+	if _, ok := compressedName(name); !ok {
+		return 0, false
+	}
+
+	marker, err := root.ReadFile(compressedMarker(name))
+	if err != nil {
+		return 0, false
+	}
+
+	var size, stored int64
+	if n, err := fmt.Sscanf(string(marker), "%d %d\n", &size, &stored); err != nil || n != 2 || size < 0 {
+		return 0, false
+	}
+	if stored != fi.Size() {
+		return 0, false
+	}
+
+	return size, true
+}
+
+// compressedName returns name without the compression suffix and true if
+// name has one, otherwise name and false.
+func compressedName(name string) (string, bool) {
+	for _, suffix := range compressedSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix), true
+		}
+	}
+
+	return name, false
+}
+
+// findCompressed returns the file the server stored compressed for name in
+// root, if there is one.
+func findCompressed(root *os.Root, name string) (string, bool) {
+	for _, suffix := range compressedSuffixes {
+		fi, err := root.Stat(name + suffix)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if _, ok := compressedSize(root, name+suffix, fi); ok {
+			return name + suffix, true
+		}
+	}
+
+	return "", false
+}
+
+// readCloser closes a decompressing reader and the file under it.
+type readCloser struct {
+	io.Reader
+	close func()
+	file  io.Closer
+}
+
+// Close closes the decompressor and the file.
+func (r readCloser) Close() error {
+	if r.close != nil {
+		r.close()
+	}
+
+	return r.file.Close()
+}
+
+// openDecompressed opens a compressed upload in root for reading the original
+// data. The compression method is taken from the file suffix.
+func openDecompressed(root *os.Root, name string) (io.ReadCloser, error) {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(name, compressedSuffixes[compressGzip]):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return readCloser{Reader: zr, close: func() { zr.Close() }, file: f}, nil
+	case strings.HasSuffix(name, compressedSuffixes[compressZstd]):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return readCloser{Reader: zr, close: zr.Close, file: f}, nil
+	default:
+		return f, nil
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompressedUploadAndDownload(t *testing.T) {
+	initLog("-", "none")
+
+	magic := map[string]string{compressGzip: "\x1f\x8b", compressZstd: "\x28\xb5\x2f\xfd"}
+
+	for method, suffix := range compressedSuffixes {
+		dir, err := ioutil.TempDir("", "scpdropCompressTest")
+		if err != nil {
+			t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+		}
+
+		var reply bytes.Buffer
+		sink := newScpSink(bytes.NewBufferString("C0640 5 file\nhello\x00"), &reply, dir)
+		sink.wrap, sink.suffix, _ = uploadWrap(Config{Compress: method}, "testy")
+		if err = sink.receive(".", false); err != nil {
+			t.Errorf("Unable to receive %s upload: %s\n", method, err)
+		}
+
+		if len(sink.files) != 1 || sink.files[0] != "file"+suffix {
+			t.Errorf("Stored %s files (%v) does not match expected ([file%s])\n", method, sink.files, suffix)
+		}
+		stored, _ := ioutil.ReadFile(filepath.Join(dir, "file"+suffix))
+		if !bytes.HasPrefix(stored, []byte(magic[method])) {
+			t.Errorf("Stored %s file (%q) is not compressed\n", method, stored)
+		}
+
+		// The client acks the start, the record and the data.
+		var sent bytes.Buffer
+		source := newScpSource(bytes.NewBufferString("\x00\x00\x00"), &sent, dir)
+		if err = source.send("file"); err != nil {
+			t.Errorf("Unable to send %s download: %s\n", method, err)
+		}
+
+		expected := "C0640 5 file\nhello\x00"
+		if sent.String() != expected {
+			t.Errorf("Sent %s download (%q) does not match expected (%q)\n", method, sent.String(), expected)
+		}
+
+		// The marker is not sent with the files.
+		sent.Reset()
+		source = newScpSource(bytes.NewBufferString("\x00\x00\x00\x00\x00"), &sent, dir)
+		source.recursive = true
+		if err = source.send("."); err != nil {
+			t.Errorf("Unable to send %s directory: %s\n", method, err)
+		}
+		if !bytes.Contains(sent.Bytes(), []byte(expected)) || bytes.Contains(sent.Bytes(), []byte(compressedMarkerSuffix)) {
+			t.Errorf("Sent %s directory (%q) does not match expected (%q)\n", method, sent.String(), expected)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClientCompressedDownload(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropCompressTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A compressed file the server did not compress is sent as it is stored.
+	ioutil.WriteFile(filepath.Join(dir, "upload.gz"), []byte("\x1f\x8bdata"), 0600)
+	// So is a file that changed since it was compressed.
+	ioutil.WriteFile(filepath.Join(dir, "changed.gz"), []byte("\x1f\x8bdata"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, compressedMarker("changed.gz")), []byte("5 20\n"), 0600)
+
+	tests := make(map[string]string)
+	tests["upload.gz"] = "C0600 6 upload.gz\n\x1f\x8bdata\x00"
+	tests["changed.gz"] = "C0600 6 changed.gz\n\x1f\x8bdata\x00"
+	tests["upload"] = "\x01scp: upload: No such file or directory\n"
+	tests[compressedMarker("changed.gz")] = "\x01scp: .changed.gz.scpdrop: No such file or directory\n"
+
+	for target, expected := range tests {
+		var sent bytes.Buffer
+		source := newScpSource(bytes.NewBufferString("\x00\x00\x00"), &sent, dir)
+		if err = source.send(target); err != nil {
+			t.Errorf("Send of %s returned error: %s\n", target, err)
+		}
+		if sent.String() != expected {
+			t.Errorf("Sent %s (%q) does not match expected (%q)\n", target, sent.String(), expected)
+		}
+	}
+}
+
+func TestScpSourceSend(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSourceTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0750)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0600)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "link"))
+	ioutil.WriteFile(filepath.Join(dir, ".file.part-1"), []byte("data"), 0600)
+
+	type testStruct struct {
+		target    string
+		recursive bool
+		acks      string
+		sent      string
+	}
+
+	tests := make(map[string]testStruct)
+	tests["file"] = testStruct{"sub/file", false, "\x00\x00\x00", "C0600 4 file\ndata\x00"}
+	tests["dir"] = testStruct{"sub", true, "\x00\x00\x00\x00\x00", "D0750 0 sub\nC0600 4 file\ndata\x00E\n"}
+	tests["not recursive"] = testStruct{"sub", false, "\x00", "\x01scp: sub: not a regular file\n"}
+	tests["missing"] = testStruct{"missing", false, "\x00", "\x01scp: missing: No such file or directory\n"}
+	tests["outside"] = testStruct{"link", false, "\x00", "\x01scp: link: No such file or directory\n"}
+	tests["partial"] = testStruct{".file.part-1", false, "\x00", "\x01scp: .file.part-1: No such file or directory\n"}
+	tests["refused"] = testStruct{"sub/file", false, "\x00\x01no space\n", "C0600 4 file\n"}
+
+	for name, testIn := range tests {
+		var sent bytes.Buffer
+		source := newScpSource(bytes.NewBufferString(testIn.acks), &sent, dir)
+		source.recursive = testIn.recursive
+		if err = source.send(testIn.target); err != nil {
+			t.Errorf("Test %s returned error: %s\n", name, err)
+		}
+
+		if sent.String() != testIn.sent {
+			t.Errorf("Test %s sent (%q) does not match expected (%q)\n", name, sent.String(), testIn.sent)
+		}
+	}
+}
+
+func TestScpSourcePreserveTimes(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSourceTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0750)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0600)
+	os.Chtimes(filepath.Join(dir, "sub", "file"), time.Unix(1400000000, 0), time.Unix(1500000000, 0))
+	os.Chtimes(filepath.Join(dir, "sub"), time.Unix(1300000000, 0), time.Unix(1300000000, 0))
+
+	var sent bytes.Buffer
+	source := newScpSource(bytes.NewBufferString("\x00\x00\x00\x00\x00\x00\x00"), &sent, dir)
+	source.recursive = true
+	source.preserve = true
+	if err = source.send("sub"); err != nil {
+		t.Errorf("Send returned error: %s\n", err)
+	}
+
+	expected := "T1300000000 0 1300000000 0\nD0750 0 sub\nT1500000000 0 1400000000 0\nC0600 4 file\ndata\x00E\n"
+	if sent.String() != expected {
+		t.Errorf("Sent (%q) does not match expected (%q)\n", sent.String(), expected)
+	}
+}
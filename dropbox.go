@@ -0,0 +1,63 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Drop-box modes for users of the shared directory.
+const (
+	dropBoxUser    = "user"
+	dropBoxSession = "session"
+)
+
+// dropBoxDir returns the directory a session of user in drop-box mode works
+// in. Uploads land in a folder of the user below the shared directory, or in a
+// folder of the session below that, which is created if needed. Downloads
+// only see the folder of the user.
+func dropBoxDir(config Config, user string, id uint64, started time.Time, upload bool) (string, error) {
+	if user == "" || strings.HasPrefix(user, ".") || strings.ContainsAny(user, "/\x00") {
+		return "", fmt.Errorf("Invalid user name %q for drop box", user)
+	}
+
+	dir := filepath.Join(config.SharedDir, user)
+	if upload && config.DropBox == dropBoxSession {
+		dir = filepath.Join(dir, fmt.Sprintf("%s-%d", started.Format("20060102-150405"), id))
+	}
+
+	if upload {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return "", err
+		}
+	}
+
+	return addSepSuffix(dir), nil
+}
+
+// dropBoxCollision returns the collision policy for drop boxes, where existing
+// files are never overwritten.
+func dropBoxCollision(policy string) string {
+	if policy == "" || policy == collisionOverwrite {
+		return collisionRename
+	}
+
+	return policy
+}
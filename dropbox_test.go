@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDropBoxDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scpdropDropBoxTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	started := time.Date(2017, 1, 14, 10, 0, 0, 0, time.Local)
+	shared := addSepSuffix(dir)
+
+	type testStruct struct {
+		mode   string
+		user   string
+		upload bool
+		dir    string
+	}
+
+	tests := make(map[string]testStruct)
+	tests["user upload"] = testStruct{dropBoxUser, "testy", true, shared + "testy/"}
+	tests["session upload"] = testStruct{dropBoxSession, "testy", true, shared + "testy/20170114-100000-7/"}
+	tests["session download"] = testStruct{dropBoxSession, "other", false, shared + "other/"}
+	tests["dot user"] = testStruct{dropBoxUser, "..", true, ""}
+	tests["slash user"] = testStruct{dropBoxUser, "a/b", true, ""}
+
+	for name, testIn := range tests {
+		config := Config{SharedDir: shared, DropBox: testIn.mode}
+		d, err := dropBoxDir(config, testIn.user, 7, started, testIn.upload)
+		if d != testIn.dir || (err != nil) != (testIn.dir == "") {
+			t.Errorf("Test %s dir (%q, %v) does not match expected (%q)\n", name, d, err, testIn.dir)
+		}
+		if ok, _ := dirExists(d); d != "" && ok != testIn.upload {
+			t.Errorf("Test %s dir created (%v) does not match expected (%v)\n", name, ok, testIn.upload)
+		}
+	}
+
+	if p := dropBoxCollision(""); p != collisionRename {
+		t.Errorf("Default drop box collision (%s) does not match expected (%s)\n", p, collisionRename)
+	}
+	if p := dropBoxCollision(collisionReject); p != collisionReject {
+		t.Errorf("Drop box collision (%s) does not match expected (%s)\n", p, collisionReject)
+	}
+}
+
+func TestScpSourcePublished(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropDropBoxTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	userDir := filepath.Join(dir, "user")
+	publishDir := filepath.Join(dir, "published")
+	os.Mkdir(userDir, 0750)
+	os.Mkdir(publishDir, 0750)
+	ioutil.WriteFile(filepath.Join(userDir, "both"), []byte("mine"), 0600)
+	ioutil.WriteFile(filepath.Join(publishDir, "both"), []byte("pub!"), 0600)
+	ioutil.WriteFile(filepath.Join(publishDir, "public"), []byte("data"), 0600)
+
+	type testStruct struct {
+		dir    string
+		target string
+		sent   string
+	}
+
+	tests := make(map[string]testStruct)
+	tests["own first"] = testStruct{userDir, "both", "C0600 4 both\nmine\x00"}
+	tests["published"] = testStruct{userDir, "public", "C0600 4 public\ndata\x00"}
+	tests["missing"] = testStruct{userDir, "other", "\x01scp: other: No such file or directory\n"}
+	tests["no user dir"] = testStruct{filepath.Join(dir, "nobody"), "public", "C0600 4 public\ndata\x00"}
+
+	for name, testIn := range tests {
+		var sent bytes.Buffer
+		source := newScpSource(bytes.NewBufferString("\x00\x00\x00"), &sent, testIn.dir)
+		source.published = []string{publishDir}
+		if err = source.send(testIn.target); err != nil {
+			t.Errorf("Test %s returned error: %s\n", name, err)
+		}
+		if sent.String() != testIn.sent {
+			t.Errorf("Test %s sent (%q) does not match expected (%q)\n", name, sent.String(), testIn.sent)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// encryptedSuffix is appended to the name of files encrypted at rest.
+const encryptedSuffix = ".gpg"
+
+// readKeyRing reads an armored or binary OpenPGP key ring.
+func readKeyRing(filename string) (openpgp.EntityList, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, err := armor.Decode(bytes.NewReader(b)); err == nil {
+		return openpgp.ReadKeyRing(block.Body)
+	}
+
+	return openpgp.ReadKeyRing(bytes.NewReader(b))
+}
+
+// checkEncryptionKeys makes sure uploads can be encrypted to keys.
+func checkEncryptionKeys(keys openpgp.EntityList) error {
+	if len(keys) == 0 {
+		return fmt.Errorf("No keys found")
+	}
+
+	if _, err := openpgp.Encrypt(ioutil.Discard, keys, nil, nil, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// encryptionKeys returns the recipients uploads from user are encrypted to.
+// A key ring named after the user in EncryptKeysDir takes precedence over
+// EncryptTo. No keys are returned if uploads are not encrypted.
+func encryptionKeys(config Config, user string) (openpgp.EntityList, error) {
+	if config.EncryptKeysDir != "" && user != "" {
+		userKeys := filepath.Join(config.EncryptKeysDir, user+".asc")
+		if _, err := os.Stat(userKeys); err == nil {
+			return readKeyRing(userKeys)
+		}
+	}
+
+	if config.EncryptTo == "" {
+		return nil, nil
+	}
+
+	return readKeyRing(config.EncryptTo)
+}
+
+// closeBoth closes an encrypting writer and then the file under it.
+type closeBoth struct {
+	io.WriteCloser
+	file io.Closer
+}
+
+// Close finishes the encrypted message and closes the file.
+func (c closeBoth) Close() error {
+	err := c.WriteCloser.Close()
+	if ferr := c.file.Close(); err == nil {
+		err = ferr
+	}
+
+	return err
+}
+
+// encryptWriter returns a writer that encrypts everything written to it to
+// keys before it is written to f. Closing it closes f.
+func encryptWriter(keys openpgp.EntityList) func(f io.WriteCloser) (io.WriteCloser, error) {
+	return func(f io.WriteCloser) (io.WriteCloser, error) {
+		plaintext, err := openpgp.Encrypt(f, keys, nil, &openpgp.FileHints{IsBinary: true}, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to encrypt: %s", err)
+		}
+
+		return closeBoth{WriteCloser: plaintext, file: f}, nil
+	}
+}
+
+// decryptFile decrypts an encrypted upload with a secret key ring. passphrase
+// is called if the key is protected by a passphrase.
+func decryptFile(in io.Reader, out io.Writer, keys openpgp.EntityList, passphrase func() ([]byte, error)) error {
+	tried := false
+	prompt := func(candidates []openpgp.Key, symmetric bool) ([]byte, error) {
+		if tried || symmetric {
+			return nil, fmt.Errorf("Unable to decrypt the secret key")
+		}
+		tried = true
+
+		pass, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range candidates {
+			if k.PrivateKey != nil && k.PrivateKey.Encrypted {
+				if err := k.PrivateKey.Decrypt(pass); err != nil {
+					return nil, fmt.Errorf("Wrong passphrase")
+				}
+			}
+		}
+
+		return nil, nil
+	}
+
+	md, err := openpgp.ReadMessage(in, keys, prompt, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt: %s", err)
+	}
+
+	if _, err = io.Copy(out, md.UnverifiedBody); err != nil {
+		return fmt.Errorf("Unable to decrypt: %s", err)
+	}
+
+	return nil
+}
+
+// decryptFiles decrypts files with the secret keys in keyRing. Each file is
+// written without its encrypted suffix unless output is set. The passphrase
+// for the key is asked for once on the terminal if needed.
+func decryptFiles(keyRing string, output string, files []string) error {
+	keys, err := readKeyRing(keyRing)
+	if err != nil {
+		return fmt.Errorf("Unable to read key ring: %s", err)
+	}
+
+	var pass []byte
+	passphrase := func() ([]byte, error) {
+		if pass == nil {
+			fmt.Fprintf(os.Stderr, "Passphrase: ")
+			pass, err = terminal.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Fprintln(os.Stderr)
+		}
+		return pass, err
+	}
+
+	for _, file := range files {
+		dst := output
+		if dst == "" {
+			if !strings.HasSuffix(file, encryptedSuffix) {
+				return fmt.Errorf("%s does not end with %s, use -o to name the output", file, encryptedSuffix)
+			}
+			dst = strings.TrimSuffix(file, encryptedSuffix)
+		}
+
+		if err = decryptTo(file, dst, keys, passphrase); err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+
+	return nil
+}
+
+// decryptTo decrypts the file in to dst, or to stdout if dst is "-".
+func decryptTo(in string, dst string, keys openpgp.EntityList, passphrase func() ([]byte, error)) error {
+	f, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if dst == "-" {
+		return decryptFile(f, os.Stdout, keys, passphrase)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	if err = decryptFile(f, out, keys, passphrase); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+func TestEncryptedUpload(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropEncryptTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	entity, err := openpgp.NewEntity("scpdrop", "test", "drop@example.com", &packet.Config{DefaultHash: crypto.SHA256})
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create key: %s\n", err)
+	}
+
+	// Sign the identity again so the hash preference is part of the public key.
+	entity.SerializePrivate(ioutil.Discard, nil)
+
+	var pub bytes.Buffer
+	w, _ := armor.Encode(&pub, openpgp.PublicKeyType, nil)
+	entity.Serialize(w)
+	w.Close()
+
+	keysDir := filepath.Join(dir, "keys")
+	os.Mkdir(keysDir, 0750)
+	if err = ioutil.WriteFile(filepath.Join(keysDir, "testy.asc"), pub.Bytes(), 0644); err != nil {
+		t.Fatalf("FATAL - Unable to write key ring: %s\n", err)
+	}
+
+	keys, err := encryptionKeys(Config{EncryptKeysDir: keysDir}, "testy")
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("FATAL - Unable to read user keys (%d): %v\n", len(keys), err)
+	}
+	if keys, _ = encryptionKeys(Config{EncryptKeysDir: keysDir}, "other"); len(keys) != 0 {
+		t.Errorf("Keys for user without key ring (%d) does not match expected (0)\n", len(keys))
+	}
+
+	var reply bytes.Buffer
+	sink := newScpSink(bytes.NewBufferString("C0644 6 secret\nhello!\x00"), &reply, dir)
+	keys, _ = encryptionKeys(Config{EncryptKeysDir: keysDir}, "testy")
+	sink.wrap = encryptWriter(keys)
+	sink.suffix = encryptedSuffix
+	if err = sink.receive(".", false); err != nil {
+		t.Fatalf("FATAL - Unable to receive: %s\n", err)
+	}
+
+	if len(sink.files) != 1 || sink.files[0] != "secret.gpg" {
+		t.Fatalf("FATAL - Stored files (%v) does not match expected ([secret.gpg]): %q\n", sink.files, reply.String())
+	}
+	stored, _ := ioutil.ReadFile(filepath.Join(dir, "secret.gpg"))
+	if bytes.Contains(stored, []byte("hello!")) {
+		t.Errorf("Stored file contains the plain text\n")
+	}
+
+	var plain bytes.Buffer
+	err = decryptFile(bytes.NewReader(stored), &plain, openpgp.EntityList{entity}, nil)
+	if err != nil || plain.String() != "hello!" {
+		t.Errorf("Decrypted file (%q) does not match expected (\"hello!\"): %v\n", plain.String(), err)
+	}
+}
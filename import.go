@@ -0,0 +1,254 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of user import files.
+const (
+	importCSV  = "csv"
+	importJSON = "json"
+)
+
+var (
+	errImportFormat = errors.New("Import format must be csv or json")
+	errUserType     = errors.New("Type must be permanent or temporary")
+	errExpiry       = errors.New("Expiry must be a date, an RFC 3339 time or a duration")
+	errNoUsers      = errors.New("No users to import")
+)
+
+// importRow is a user in an import file. Password may be "generate" to
+// generate one.
+type importRow struct {
+	adminUserRequest
+	Type   string `json:"type"`
+	Expiry string `json:"expiry"`
+}
+
+// importedUser is a user created by an import.
+type importedUser struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Dir      string `json:"dir"`
+	Expires  string `json:"expires,omitempty"`
+}
+
+// importFormat guesses the format of an import file from its name and
+// content.
+func importFormat(file string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".csv":
+		return importCSV
+	case ".json":
+		return importJSON
+	}
+	if strings.HasPrefix(strings.TrimSpace(string(content)), "[") {
+		return importJSON
+	}
+	return importCSV
+}
+
+// parseImport parses the users of an import file. JSON files hold an array
+// of objects, CSV files a header row naming the columns.
+func parseImport(content []byte, format string) (rows []importRow, err error) {
+	switch format {
+	case importJSON:
+		err = json.Unmarshal(content, &rows)
+	case importCSV:
+		rows, err = parseImportCSV(content)
+	default:
+		err = errImportFormat
+	}
+	if err == nil && len(rows) == 0 {
+		err = errNoUsers
+	}
+
+	return rows, err
+}
+
+// parseImportCSV parses a CSV import file.
+func parseImportCSV(content []byte) (rows []importRow, err error) {
+	r := csv.NewReader(strings.NewReader(string(content)))
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+
+	records, err := r.ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+
+	header := records[0]
+	for i, record := range records[1:] {
+		var row importRow
+		for j, value := range record {
+			if err = row.set(strings.ToLower(strings.TrimSpace(header[j])), value); err != nil {
+				return nil, fmt.Errorf("User %d: %s", i+1, err)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// set sets the field of the row named by a CSV column.
+func (row *importRow) set(column, value string) (err error) {
+	switch column {
+	case "username":
+		row.Username = value
+	case "password":
+		row.Password = value
+	case "privileges":
+		row.Privileges = value
+	case "dir":
+		row.Dir = value
+	case "upsize":
+		row.UpSize = value
+	case "recursive":
+		row.Recursive = value
+	case "type":
+		row.Type = value
+	case "expiry":
+		row.Expiry = value
+	case "cmd":
+		row.Cmd = value
+	case "nouserdir", "plaintext":
+		b := false
+		if value != "" {
+			if b, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("Invalid %s value %q", column, value)
+			}
+		}
+		if column == "nouserdir" {
+			row.NoUserDir = b
+		} else {
+			row.Plaintext = b
+		}
+	default:
+		return fmt.Errorf("Unknown column %q", column)
+	}
+
+	return nil
+}
+
+// userInfo validates an import row and converts it to a UserInfo and the
+// time the user expires, zero if it does not. generated is true if the
+// password was generated.
+func (row importRow) userInfo(config Config, now time.Time) (userInfo UserInfo, expires time.Time, generated bool, err error) {
+	if row.Password == "generate" {
+		row.Password = ""
+	}
+	generated = row.Password == ""
+
+	switch strings.ToLower(row.Type) {
+	case "":
+	case "p", "permanent":
+		row.Permanent = true
+	case "t", "temporary":
+		row.Permanent = false
+	default:
+		return userInfo, expires, generated, errUserType
+	}
+
+	if expires, err = parseExpiry(row.Expiry, now); err != nil {
+		return userInfo, expires, generated, err
+	}
+
+	userInfo, err = row.adminUserRequest.userInfo(config)
+	return userInfo, expires, generated, err
+}
+
+// parseExpiry parses an expiry as an RFC 3339 time, a local date or a
+// duration from now. An empty expiry never expires.
+func parseExpiry(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(d), nil
+	}
+
+	return time.Time{}, errExpiry
+}
+
+// importUsers validates all rows and creates their users in a single update
+// of the passwd file. No user is created if any row is invalid.
+func importUsers(config Config, rows []importRow, now time.Time) ([]importedUser, error) {
+	var users []UserInfo
+	var imported []importedUser
+	expires := make(map[string]time.Time)
+
+	for i, row := range rows {
+		userInfo, expiry, generated, err := row.userInfo(config, now)
+		if err != nil {
+			return nil, fmt.Errorf("User %d: %s", i+1, err)
+		}
+
+		user := importedUser{Username: string(userInfo.Username), Dir: string(userInfo.UserDir)}
+		if generated {
+			user.Password = string(userInfo.Password)
+		}
+		if !expiry.IsZero() {
+			user.Expires = expiry.Format(time.RFC3339)
+			expires[user.Username] = expiry
+		}
+
+		users = append(users, userInfo)
+		imported = append(imported, user)
+	}
+
+	if err := createUsers(users, expires, config.PasswdFile); err != nil {
+		return nil, err
+	}
+
+	return imported, nil
+}
+
+// writeImported writes the imported users and their generated passwords
+// as CSV or JSON.
+func writeImported(w io.Writer, format string, users []importedUser) error {
+	if format == importJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(users)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"username", "password", "dir", "expiry"})
+	for _, user := range users {
+		cw.Write([]string{user.Username, user.Password, user.Dir, user.Expires})
+	}
+	cw.Flush()
+
+	return cw.Error()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImport(t *testing.T) {
+	csvIn := "username, password, privileges, dir, upsize, recursive, type, expiry\n" +
+		"alice,secret,rw,,10M,w,permanent,2030-01-02\n" +
+		"# comment\n" +
+		"bob,generate,r,/srv/bob,,,,24h\n"
+	jsonIn := `[{"username":"alice","password":"secret","privileges":"rw","upsize":"10M","recursive":"w","type":"permanent","expiry":"2030-01-02"},
+{"username":"bob","password":"generate","privileges":"r","dir":"/srv/bob","expiry":"24h"}]`
+
+	tests := make(map[string]string)
+	tests["users.csv"] = csvIn
+	tests["users.json"] = jsonIn
+	tests["-"] = jsonIn
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for file, in := range tests {
+		rows, err := parseImport([]byte(in), importFormat(file, []byte(in)))
+		if err != nil || len(rows) != 2 {
+			t.Fatalf("FATAL - Unable to parse %s (%d rows): %v\n", file, len(rows), err)
+		}
+
+		alice, expires, generated, err := rows[0].userInfo(Config{UsersDir: "/users/"}, now)
+		if err != nil || generated {
+			t.Errorf("%s: first user (%v, %v) does not match expected (nil, false)\n", file, err, generated)
+		}
+		if !alice.Permanent || alice.UpSize != 10*1024*1024 || string(alice.UserDir) != "/users/alice" || string(alice.Recursive) != "w" {
+			t.Errorf("%s: first user (%+v) does not match expected\n", file, alice)
+		}
+		if expected := time.Date(2030, 1, 2, 0, 0, 0, 0, time.Local); !expires.Equal(expected) {
+			t.Errorf("%s: first expiry (%v) does not match expected (%v)\n", file, expires, expected)
+		}
+
+		bob, expires, generated, err := rows[1].userInfo(Config{UsersDir: "/users/"}, now)
+		if err != nil || !generated || len(bob.Password) == 0 || bob.Permanent || string(bob.UserDir) != "/srv/bob/" {
+			t.Errorf("%s: second user (%+v, %v, %v) does not match expected\n", file, bob, generated, err)
+		}
+		if expected := now.Add(24 * time.Hour); !expires.Equal(expected) {
+			t.Errorf("%s: second expiry (%v) does not match expected (%v)\n", file, expires, expected)
+		}
+	}
+
+	invalid := make(map[string]string)
+	invalid["unknown column"] = "username,color\nalice,red\n"
+	invalid["invalid type"] = "username,privileges,type\nalice,r,sometimes\n"
+	invalid["invalid expiry"] = "username,privileges,expiry\nalice,r,soon\n"
+	invalid["no privileges"] = "username,privileges\nalice,\n"
+	invalid["no users"] = "username,privileges\n"
+	invalid["dir with colon"] = "username,privileges,dir\nalice,r,/srv/alice:rw\n"
+	invalid["dir with newline"] = "username,privileges,dir\nalice,r,\"/srv/alice\nroot:$0$pw:rw:/:0::p\"\n"
+
+	for name, in := range invalid {
+		rows, err := parseImport([]byte(in), importCSV)
+		if err == nil {
+			_, err = importUsers(Config{UsersDir: "/users/", PasswdFile: "/nonexistent/passwd"}, rows, now)
+		}
+		if err == nil {
+			t.Errorf("%s: import did not fail\n", name)
+		}
+	}
+}
+
+func TestImportUsers(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropImportTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := Config{UsersDir: addSepSuffix(dir), PasswdFile: filepath.Join(dir, "passwd")}
+	now := time.Now()
+
+	rows, _ := parseImport([]byte("username,password,privileges,expiry\nalice,,rw,1h\nbob,secret,r,\n"), importCSV)
+	users, err := importUsers(config, rows, now)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to import users: %s\n", err)
+	}
+	if len(users) != 2 || users[0].Password == "" || users[1].Password != "" || users[0].Expires == "" {
+		t.Errorf("Imported users (%+v) do not match expected\n", users)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if fi, err := os.Stat(filepath.Join(dir, name)); err != nil || !fi.IsDir() {
+			t.Errorf("User directory of %s was not created: %v\n", name, err)
+		}
+	}
+
+	var out bytes.Buffer
+	writeImported(&out, importCSV, users)
+	if !strings.HasPrefix(out.String(), "username,password,dir,expiry\nalice,"+users[0].Password+",") {
+		t.Errorf("Imported users output (%q) does not match expected\n", out.String())
+	}
+
+	// A duplicate user fails the whole import.
+	before, _ := ioutil.ReadFile(config.PasswdFile)
+	rows, _ = parseImport([]byte("username,privileges\ncarol,r\nbob,r\n"), importCSV)
+	if _, err = importUsers(config, rows, now); err == nil {
+		t.Errorf("Import of existing user did not fail\n")
+	}
+	rows, _ = parseImport([]byte("username,privileges\ncarol,r\ncarol,w\n"), importCSV)
+	if _, err = importUsers(config, rows, now); err == nil {
+		t.Errorf("Import of duplicate users did not fail\n")
+	}
+	if after, _ := ioutil.ReadFile(config.PasswdFile); !bytes.Equal(before, after) {
+		t.Errorf("Failed import changed the passwd file\n")
+	}
+
+	removeExpiredUsers(config.PasswdFile, "", now)
+	if users, _ := listUsers(config.PasswdFile); len(users) != 2 {
+		t.Errorf("Users (%d) removed before expiry\n", len(users))
+	}
+
+	removeExpiredUsers(config.PasswdFile, "", now.Add(2*time.Hour))
+	users2, _ := listUsers(config.PasswdFile)
+	if len(users2) != 1 || string(users2[0].Username) != "bob" {
+		t.Errorf("Users after expiry (%d) do not match expected (bob)\n", len(users2))
+	}
+	if _, err = os.Stat(filepath.Join(dir, "alice")); err != nil {
+		t.Errorf("User directory of expired user was removed: %s\n", err)
+	}
+	if expires, _ := ioutil.ReadFile(expiryFile(config.PasswdFile)); len(expires) != 0 {
+		t.Errorf("Expiry file (%q) does not match expected (\"\")\n", expires)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// instruction formats
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatQR   = "qr"
+)
+
+// errInstructionFormat is returned for unknown instruction formats.
+var errInstructionFormat = errors.New("Instructions must be text, json or qr")
+
+// instructions tell an external party how to connect to the server and
+// transfer files.
+type instructions struct {
+	User        string   `json:"user"`
+	Password    string   `json:"password"`
+	Host        string   `json:"host"`
+	Port        int      `json:"port"`
+	OneShot     bool     `json:"one_shot"`
+	MaxSize     uint64   `json:"max_size,omitempty"`
+	Commands    []string `json:"commands"`
+	Fingerprint string   `json:"fingerprint,omitempty"`
+	KnownHosts  string   `json:"known_hosts,omitempty"`
+}
+
+// newInstructions creates the instructions for a user connecting to host on
+// the port the server listens on. hostKey is the public key of the server,
+// it is left out if nil.
+func newInstructions(userInfo UserInfo, host string, listen string, hostKey ssh.PublicKey) instructions {
+	port := listenPort(listen)
+	in := instructions{User: string(userInfo.Username), Password: string(userInfo.Password), Host: host,
+		Port: port, OneShot: !userInfo.Permanent, MaxSize: userInfo.UpSize}
+
+	scp := scpClientCommand(port)
+	remote := in.User + "@" + host + ":"
+	if strings.Contains(string(userInfo.Privileges), "w") {
+		in.Commands = append(in.Commands, scp+" <file> "+remote)
+	}
+	if strings.Contains(string(userInfo.Privileges), "r") {
+		in.Commands = append(in.Commands, scp+" "+remote+"<file> .")
+	}
+
+	if hostKey != nil {
+		in.Fingerprint = ssh.FingerprintSHA256(hostKey)
+		in.KnownHosts = knownhosts.Line([]string{knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(port)))}, hostKey)
+	}
+
+	return in
+}
+
+// listenPort returns the port of the listen address, 22 if it has none.
+func listenPort(listen string) int {
+	if _, p, err := net.SplitHostPort(listen); err == nil {
+		if n, err := strconv.Atoi(p); err == nil {
+			return n
+		}
+	}
+
+	return 22
+}
+
+// scpClientCommand returns the start of the scp command line a client uses
+// to connect to the server on port.
+func scpClientCommand(port int) string {
+	// -O makes newer clients use the scp protocol instead of sftp.
+	cmd := "scp -O"
+	if port != 22 {
+		cmd += " -P " + strconv.Itoa(port)
+	}
+
+	return cmd
+}
+
+// write writes the instructions in format.
+func (in instructions) write(w io.Writer, format string) error {
+	switch format {
+	case formatText:
+		_, err := io.WriteString(w, in.text())
+		return err
+	case formatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		return enc.Encode(in)
+	case formatQR:
+		// The code holds the short form, the full text is printed below it.
+		qr, err := qrcode.New(in.short(), qrcode.Low)
+		if err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, qr.ToSmallString(false)); err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, "\n"+in.text())
+		return err
+	default:
+		return errInstructionFormat
+	}
+}
+
+// text returns the instructions as text to paste into an email.
+func (in instructions) text() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Server:   %s port %d\n", in.Host, in.Port)
+	fmt.Fprintf(&b, "User:     %s\n", in.User)
+	fmt.Fprintf(&b, "Password: %s\n", in.Password)
+	if in.OneShot {
+		fmt.Fprintf(&b, "The account can only be used once.\n")
+	}
+	if in.MaxSize != 0 {
+		fmt.Fprintf(&b, "Files may be at most %d bytes.\n", in.MaxSize)
+	}
+
+	fmt.Fprintf(&b, "\nTransfer files with:\n")
+	for _, cmd := range in.Commands {
+		fmt.Fprintf(&b, "  %s\n", cmd)
+	}
+
+	if in.Fingerprint != "" {
+		fmt.Fprintf(&b, "\nThe server identifies itself with the host key\n  %s\n", in.Fingerprint)
+		fmt.Fprintf(&b, "To trust it before connecting, add this line to ~/.ssh/known_hosts:\n  %s\n", in.KnownHosts)
+	}
+
+	return b.String()
+}
+
+// short returns the commands, password and fingerprint, small enough for a
+// QR code.
+func (in instructions) short() string {
+	s := strings.Join(in.Commands, "\n") + "\nPassword: " + in.Password + "\n"
+	if in.Fingerprint != "" {
+		s += "Host key: " + in.Fingerprint + "\n"
+	}
+
+	return s
+}
+
+// printInstructions prints the instructions for a new user. The host key is
+// read from PrivateKey and left out if none is configured.
+func printInstructions(userInfo UserInfo, config Config, out userOutput) {
+	var hostKey ssh.PublicKey
+	if config.PrivateKey == "" {
+		logWarning.Println("No PrivateKey configured, the host key is not included")
+	} else if signer, err := loadPrivateKey(config.PrivateKey); err != nil {
+		logWarning.Printf("Unable to read host key, it is not included: %s\n", err)
+	} else {
+		hostKey = signer.PublicKey()
+	}
+
+	in := newInstructions(userInfo, out.Host, config.Listen, hostKey)
+	if err := in.write(os.Stdout, out.Format); err != nil {
+		log.Fatalf("Unable to print instructions: %s\n", err)
+	}
+}
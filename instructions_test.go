@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNewInstructions(t *testing.T) {
+	type testStruct struct {
+		privs  string
+		listen string
+	}
+
+	tests := make(map[testStruct][]string)
+	tests[testStruct{"w", ":2022"}] = []string{"scp -O -P 2022 <file> testy@drop.example.com:"}
+	tests[testStruct{"r", "0.0.0.0:22"}] = []string{"scp -O testy@drop.example.com:<file> ."}
+	tests[testStruct{"rw", "127.0.0.1:2022"}] = []string{"scp -O -P 2022 <file> testy@drop.example.com:",
+		"scp -O -P 2022 testy@drop.example.com:<file> ."}
+
+	for testIn, expectedOut := range tests {
+		userInfo := UserInfo{Username: []byte("testy"), Password: []byte("secret"), Privileges: []byte(testIn.privs)}
+		in := newInstructions(userInfo, "drop.example.com", testIn.listen, nil)
+		if !reflect.DeepEqual(in.Commands, expectedOut) {
+			t.Errorf("Commands (%q) does not match expected (%q)\n", in.Commands, expectedOut)
+		}
+		if in.Fingerprint != "" || in.KnownHosts != "" {
+			t.Errorf("Host key included without a key (%q %q)\n", in.Fingerprint, in.KnownHosts)
+		}
+	}
+}
+
+func TestInstructionsWrite(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(nil)
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create host key: %s\n", err)
+	}
+	hostKey := signer.PublicKey()
+
+	userInfo := UserInfo{Username: []byte("testy"), Password: []byte("secret"), Privileges: []byte("w"), UpSize: 1024}
+	in := newInstructions(userInfo, "drop.example.com", ":2022", hostKey)
+
+	knownHosts := "[drop.example.com]:2022 " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey)))
+	if in.KnownHosts != knownHosts {
+		t.Errorf("Known hosts line (%s) does not match expected (%s)\n", in.KnownHosts, knownHosts)
+	}
+	if in.Fingerprint != ssh.FingerprintSHA256(hostKey) || !in.OneShot || in.MaxSize != 1024 {
+		t.Errorf("Instructions (%+v) do not match the user and host key\n", in)
+	}
+
+	var buf bytes.Buffer
+	if err = in.write(&buf, formatJSON); err != nil {
+		t.Fatalf("FATAL - Unable to write json: %s\n", err)
+	}
+	var decoded instructions
+	if err = json.Unmarshal(buf.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded, in) {
+		t.Errorf("Decoded json (%+v, %v) does not match expected (%+v)\n", decoded, err, in)
+	}
+
+	for _, format := range []string{formatText, formatQR} {
+		buf.Reset()
+		if err = in.write(&buf, format); err != nil {
+			t.Errorf("Unable to write %s: %s\n", format, err)
+		}
+		for _, expected := range []string{"secret", in.Commands[0], in.Fingerprint, knownHosts} {
+			if !strings.Contains(buf.String(), expected) {
+				t.Errorf("Format %s output does not contain %q\n", format, expected)
+			}
+		}
+	}
+
+	if err = in.write(&buf, "html"); err != errInstructionFormat {
+		t.Errorf("Unknown format (%v) does not match expected (%v)\n", err, errInstructionFormat)
+	}
+}
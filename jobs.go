@@ -0,0 +1,365 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Job states, each kept in a subdirectory of the queue directory.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobFailed  = "failed"
+)
+
+// queuePollInterval is how often the queue directory is checked for jobs
+// added by other processes, such as a retry from the jobs command.
+const queuePollInterval = 5 * time.Second
+
+// job is a post-upload processing job for a single file. A job without a
+// file runs the pipeline once on all files of the session.
+type job struct {
+	ID        string        `json:"id"`
+	Created   time.Time     `json:"created"`
+	Attempts  int           `json:"attempts"`
+	LastError string        `json:"last_error,omitempty"`
+	Session   sessionResult `json:"session"`
+	File      string        `json:"file"`
+}
+
+// newJobID returns a unique job id that sorts in creation order.
+func newJobID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+// jobQueue is a persistent queue of jobs stored as JSON files on disk.
+// A job is claimed by renaming it from the pending to the running directory,
+// so jobs that were running when the server stopped are found on restart.
+type jobQueue struct {
+	dir  string
+	wake chan struct{}
+	jobs sync.WaitGroup
+
+	// mu guards closed, which is set once wait has been called so that no
+	// job is added to jobs while it is waited for.
+	mu     sync.Mutex
+	closed bool
+}
+
+// newJobQueue creates a queue in dir and its state subdirectories.
+func newJobQueue(dir string) (*jobQueue, error) {
+	for _, state := range []string{jobPending, jobRunning, jobFailed} {
+		if err := os.MkdirAll(filepath.Join(dir, state), 0750); err != nil {
+			return nil, err
+		}
+	}
+
+	return &jobQueue{dir: dir, wake: make(chan struct{}, 1)}, nil
+}
+
+// path returns the file name of a job in a state.
+func (q *jobQueue) path(state string, id string) string {
+	return filepath.Join(q.dir, state, id+".json")
+}
+
+// write stores a job in a state.
+func (q *jobQueue) write(state string, j job) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary name first so a partial job is never picked up.
+	tmp := q.path(state, j.ID) + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0640); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, q.path(state, j.ID))
+}
+
+// read loads a job from a state.
+func (q *jobQueue) read(state string, id string) (j job, err error) {
+	b, err := ioutil.ReadFile(q.path(state, id))
+	if err != nil {
+		return j, err
+	}
+
+	err = json.Unmarshal(b, &j)
+	return j, err
+}
+
+// enqueue adds a new job and wakes up the workers.
+func (q *jobQueue) enqueue(j job) error {
+	if j.ID == "" {
+		j.ID = newJobID()
+	}
+	if j.Created.IsZero() {
+		j.Created = time.Now()
+	}
+
+	if err := q.write(jobPending, j); err != nil {
+		return err
+	}
+	logDebug.Printf("Queued job %s for %s\n", j.ID, j.File)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// list returns the ids of all jobs in a state, oldest first.
+func (q *jobQueue) list(state string) (ids []string, err error) {
+	names, err := filepath.Glob(filepath.Join(q.dir, state, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(name), ".json"))
+	}
+	sort.Strings(ids)
+
+	return ids, nil
+}
+
+// recover moves jobs that were running when the server stopped back to pending.
+func (q *jobQueue) recover() {
+	ids, err := q.list(jobRunning)
+	if err != nil {
+		logError.Printf("Unable to list running jobs: %s\n", err)
+		return
+	}
+
+	for _, id := range ids {
+		logWarning.Printf("Job %s was interrupted, queueing it again\n", id)
+		if err = os.Rename(q.path(jobRunning, id), q.path(jobPending, id)); err != nil {
+			logError.Printf("Unable to requeue job %s: %s\n", id, err)
+		}
+	}
+}
+
+// retry moves a failed job, or all failed jobs if id is "all", back to pending.
+func (q *jobQueue) retry(id string) (retried []string, err error) {
+	ids := []string{id}
+	if id == "all" {
+		if ids, err = q.list(jobFailed); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range ids {
+		if err = os.Rename(q.path(jobFailed, id), q.path(jobPending, id)); err != nil {
+			return retried, err
+		}
+		retried = append(retried, id)
+	}
+
+	return retried, nil
+}
+
+// add counts a claimed job as running. It returns false if the queue is
+// being waited for and no more jobs may start.
+func (q *jobQueue) add() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.jobs.Add(1)
+
+	return true
+}
+
+// run starts workers that process jobs until done is closed.
+// config is called for every job to get the current config.
+func (q *jobQueue) run(workers int, config func() Config, done <-chan struct{}) {
+	q.recover()
+
+	claimed := make(chan string)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range claimed {
+				q.process(id, config())
+				q.jobs.Done()
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	defer close(claimed)
+
+	for {
+		ids, err := q.list(jobPending)
+		if err != nil {
+			logError.Printf("Unable to list pending jobs: %s\n", err)
+		}
+
+		for _, id := range ids {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			// Claiming by rename makes sure a job is only run once.
+			if err := os.Rename(q.path(jobPending, id), q.path(jobRunning, id)); err != nil {
+				continue
+			}
+
+			if !q.add() {
+				os.Rename(q.path(jobRunning, id), q.path(jobPending, id))
+				return
+			}
+			select {
+			case claimed <- id:
+			case <-done:
+				q.jobs.Done()
+				os.Rename(q.path(jobRunning, id), q.path(jobPending, id))
+				return
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// process runs the pipeline for a claimed job. Jobs with a failed stage are
+// moved to the failed state, whatever the policy of the stage, and finished
+// jobs are removed.
+func (q *jobQueue) process(id string, config Config) {
+	j, err := q.read(jobRunning, id)
+	if err != nil {
+		logError.Printf("Unable to read job %s: %s\n", id, err)
+		os.Rename(q.path(jobRunning, id), q.path(jobFailed, id))
+		return
+	}
+	j.Attempts++
+
+	ctx := context.Background()
+	if config.JobTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.JobTimeout)
+		defer cancel()
+	}
+
+	j.LastError = ""
+	files := []string{j.File}
+	if j.File == "" {
+		files = j.Session.Files
+	}
+
+	var failures []string
+	for _, r := range runPipeline(ctx, config, j.Session, files) {
+		if r.Status == "ok" {
+			continue
+		}
+		failure := fmt.Sprintf("stage %s %s (exit %d)", r.Stage, r.Status, r.ExitCode)
+		if r.Action != policyAbort {
+			failure += ", " + r.Action
+		}
+		failures = append(failures, failure)
+	}
+	j.LastError = strings.Join(failures, "; ")
+
+	if j.LastError == "" {
+		logInfo.Printf("Job %s for %s finished\n", j.ID, j.File)
+		if err = os.Remove(q.path(jobRunning, id)); err != nil {
+			logError.Printf("Unable to remove job %s: %s\n", id, err)
+		}
+		return
+	}
+
+	logError.Printf("Job %s for %s failed: %s\n", j.ID, j.File, j.LastError)
+	if err = q.write(jobFailed, j); err != nil {
+		logError.Printf("Unable to store failed job %s: %s\n", id, err)
+		return
+	}
+	os.Remove(q.path(jobRunning, id))
+}
+
+// printJobs lists the jobs in the given states in a table.
+func (q *jobQueue) printJobs(w io.Writer, states ...string) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tATTEMPTS\tUSER\tFILE\tERROR")
+
+	for _, state := range states {
+		ids, err := q.list(state)
+		if err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			j, err := q.read(state, id)
+			if err != nil {
+				fmt.Fprintf(tw, "%s\t%s\t\t\t\t%s\n", id, state, err)
+				continue
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", j.ID, state, j.Attempts, j.Session.User,
+				filepath.Join(j.Session.Dir, j.File), j.LastError)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// wait waits for running jobs to finish or ctx to be done. No new jobs are
+// started once wait has been called.
+func (q *jobQueue) wait(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	finished := make(chan struct{})
+	go func() {
+		q.jobs.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
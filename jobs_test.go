@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWaitForJobs waits until the queue has no pending or running jobs.
+func testWaitForJobs(q *jobQueue, t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		pending, _ := q.list(jobPending)
+		running, _ := q.list(jobRunning)
+		if len(pending) == 0 && len(running) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Jobs not processed in time\n")
+}
+
+func TestJobQueue(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropJobsTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := newJobQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create queue: %s\n", err)
+	}
+
+	// A job left running by a previous server is recovered on start.
+	interrupted := job{ID: newJobID(), Session: sessionResult{ID: 1, User: "testy", Dir: dir}, File: "good"}
+	if err = q.write(jobRunning, interrupted); err != nil {
+		t.Fatalf("FATAL - Unable to write job: %s\n", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "good"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "bad"), []byte("data"), 0644)
+
+	// The stage fails for files named bad. The config is replaced, not
+	// changed, while the workers run, like a reload does.
+	check := Stage{Name: "check", Cmd: []string{"/bin/sh", "-c", "test \"${0##*/}\" != bad"}, Policy: policyAbort}
+	var mu sync.Mutex
+	config := Config{Stages: []Stage{check}}
+	currentConfig := func() Config {
+		mu.Lock()
+		defer mu.Unlock()
+		return config
+	}
+
+	done := make(chan struct{})
+	go q.run(2, currentConfig, done)
+
+	if err = q.enqueue(job{Session: sessionResult{ID: 2, User: "testy", Dir: dir}, File: "bad"}); err != nil {
+		t.Fatalf("Unable to queue job: %s\n", err)
+	}
+	testWaitForJobs(q, t)
+
+	failed, _ := q.list(jobFailed)
+	if len(failed) != 1 {
+		t.Fatalf("Number of failed jobs (%d) does not match expected (1)\n", len(failed))
+	}
+	j, err := q.read(jobFailed, failed[0])
+	if err != nil {
+		t.Fatalf("Unable to read failed job: %s\n", err)
+	}
+	if j.File != "bad" || j.Attempts != 1 || j.LastError == "" {
+		t.Errorf("Unexpected failed job %+v\n", j)
+	}
+
+	var b bytes.Buffer
+	q.printJobs(&b, jobFailed)
+	if !strings.Contains(b.String(), failed[0]) || !strings.Contains(b.String(), "stage check failed (exit 1)") {
+		t.Errorf("Failed job missing from listing %q\n", b.String())
+	}
+
+	// Retrying after fixing the file makes the job succeed.
+	os.Rename(filepath.Join(dir, "bad"), filepath.Join(dir, "fixed"))
+	j.File = "fixed"
+	q.write(jobFailed, j)
+
+	retried, err := q.retry("all")
+	if err != nil || len(retried) != 1 {
+		t.Fatalf("Retry returned %v, %v\n", retried, err)
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	testWaitForJobs(q, t)
+
+	if failed, _ = q.list(jobFailed); len(failed) != 0 {
+		t.Errorf("Number of failed jobs (%d) does not match expected (0)\n", len(failed))
+	}
+
+	// Failures of stages that let the pipeline continue are kept too.
+	check.Policy = policyContinue
+	mu.Lock()
+	config = Config{Stages: []Stage{check, {Name: "after", Cmd: []string{"true"}, Policy: policyAbort}}}
+	mu.Unlock()
+	ioutil.WriteFile(filepath.Join(dir, "bad"), []byte("data"), 0644)
+	q.enqueue(job{Session: sessionResult{ID: 3, User: "testy", Dir: dir}, File: "bad"})
+	testWaitForJobs(q, t)
+
+	failed, _ = q.list(jobFailed)
+	if len(failed) != 1 {
+		t.Fatalf("Number of failed jobs (%d) does not match expected (1)\n", len(failed))
+	}
+	if j, _ = q.read(jobFailed, failed[0]); j.LastError != "stage check failed (exit 1), continue" {
+		t.Errorf("Job error (%q) does not match expected (%q)\n", j.LastError, "stage check failed (exit 1), continue")
+	}
+
+	close(done)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = q.wait(ctx); err != nil {
+		t.Errorf("Waiting for jobs returned %s\n", err)
+	}
+	if q.add() {
+		t.Errorf("Job started after waiting for the queue\n")
+	}
+}
@@ -18,19 +18,23 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 	"os/user"
 	"path/filepath"
-	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -39,16 +43,69 @@ var scpDropVersion = "1.0"
 
 // Config is the struct used to hold config information.
 type Config struct {
-	Listen     string
-	SharedDir  string
-	UsersDir   string
-	KeysDir    string
-	PrivateKey string
-	LogLevel   string
-	LogFile    string
-	PasswdFile string
-	Cmd        []string
-	ScpPath    string
+	Listen        string
+	SharedDir     string
+	UsersDir      string
+	KeysDir       string
+	PrivateKey    string
+	LogLevel      string
+	LogFile       string
+	PasswdFile    string
+	Cmd           []string
+	DrainTimeout  time.Duration
+	ReloadPoll    time.Duration
+	MetricsListen string
+	AdminListen   string
+	AdminToken    string
+
+	Webhook        string
+	WebhookSecret  string
+	WebhookSpool   string
+	WebhookRetries int
+
+	Stages        []Stage
+	CmdMode       string
+	QuarantineDir string
+	AuditFile     string
+
+	EncryptTo      string
+	EncryptKeysDir string
+	Compress       string
+	ClamdSocket    string
+
+	DropBox       string
+	PublishDir    string
+	ResumeDir     string
+	ResumeTimeout time.Duration
+
+	RateLimit     uint64
+	UserRateLimit uint64
+
+	ShareDir     string
+	ShareTimeout time.Duration
+
+	HandshakeTimeout   time.Duration
+	IdleTimeout        time.Duration
+	MaxSessionDuration time.Duration
+
+	UsernameLength  int
+	UsernameChars   string
+	PasswordLength  int
+	PasswordChars   string
+	PasswordMode    string
+	PassphraseWords int
+
+	Collision        string
+	NormalizeNames   bool
+	MaxNameLength    int
+	AllowedNameChars string
+
+	QueueDir   string
+	Workers    int
+	JobTimeout time.Duration
+
+	// ConfigFile is the path the config was read from, if any.
+	ConfigFile string
 }
 
 // Loggers for the different log levels.
@@ -61,11 +118,17 @@ var (
 
 // printUsage prints some short usage information.
 func printUsage() {
-	uString := `Usage: %s server|user
+	uString := `Usage: %s server|user|share|jobs|decrypt
   server
   	Start the server
   user
-  	Add a new user
+  	Add a new user, or import users from a CSV or JSON file with user import
+  share
+  	Share a file with a one-shot download user
+  jobs
+  	List and retry queued post-upload jobs
+  decrypt
+  	Decrypt uploads encrypted at rest
 `
 	fmt.Fprintf(os.Stderr, uString, os.Args[0])
 }
@@ -136,11 +199,241 @@ func parseConfig(content []byte) (c Config, err error) {
 			c.PasswdFile = value
 		case "cmd":
 			c.Cmd = parseCmdLine(value)
-		case "scppath":
+		case "draintimeout", "handshaketimeout":
+			d, err := parseTimeout(value)
+			if err != nil {
+				return c, fmt.Errorf("Invalid duration for %s line %d, use none to disable it", s[0], lineNr)
+			}
+			if key == "draintimeout" {
+				c.DrainTimeout = d
+			} else {
+				c.HandshakeTimeout = d
+			}
+		case "idletimeout", "maxsessionduration":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return c, fmt.Errorf("Invalid duration for %s line %d", s[0], lineNr)
+			}
+			switch key {
+			case "idletimeout":
+				c.IdleTimeout = d
+			case "maxsessionduration":
+				c.MaxSessionDuration = d
+			}
+		case "reloadpoll":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return c, fmt.Errorf("Invalid duration for ReloadPoll line %d", lineNr)
+			}
+			c.ReloadPoll = d
+		case "metricslisten":
+			c.MetricsListen = value
+		case "adminlisten":
+			c.AdminListen = value
+		case "admintoken":
+			c.AdminToken = value
+		case "stage":
+			st := strings.SplitN(value, " ", 2)
+			var cmd []string
+			if len(st) == 2 {
+				cmd = parseCmdLine(strings.Trim(st[1], " "))
+			}
+			if len(cmd) == 0 || findStage(c.Stages, st[0]) != -1 {
+				return c, fmt.Errorf("Stage needs a unique name and a command line %d", lineNr)
+			}
+			c.Stages = append(c.Stages, Stage{Name: st[0], Cmd: cmd, Policy: policyAbort})
+		case "stagetimeout", "stageenv", "stagepolicy":
+			st := strings.SplitN(value, " ", 2)
+			i := findStage(c.Stages, st[0])
+			if len(st) != 2 || i == -1 {
+				return c, fmt.Errorf("%s needs the name of a previously defined stage line %d", s[0], lineNr)
+			}
+			arg := strings.Trim(st[1], " ")
+
+			switch key {
+			case "stagetimeout":
+				d, err := time.ParseDuration(arg)
+				if err != nil || d < 0 {
+					return c, fmt.Errorf("Invalid duration for StageTimeout line %d", lineNr)
+				}
+				c.Stages[i].Timeout = d
+			case "stageenv":
+				if !strings.Contains(arg, "=") {
+					return c, fmt.Errorf("StageEnv must be in the form NAME=value line %d", lineNr)
+				}
+				c.Stages[i].Env = append(c.Stages[i].Env, arg)
+			case "stagepolicy":
+				switch arg {
+				case policyAbort, policyContinue, policyQuarantine:
+					c.Stages[i].Policy = arg
+				default:
+					return c, fmt.Errorf("Unknown stage policy line %d", lineNr)
+				}
+			}
+		case "quarantinedir":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for QuarantineDir line %d", lineNr)
+			}
+			c.QuarantineDir = value
+		case "auditfile":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for AuditFile line %d", lineNr)
+			}
+			c.AuditFile = value
+		case "encryptto":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for EncryptTo line %d", lineNr)
+			}
+			c.EncryptTo = value
+		case "encryptkeysdir":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for EncryptKeysDir line %d", lineNr)
+			}
+			c.EncryptKeysDir = value
+		case "clamdsocket":
+			c.ClamdSocket = value
+		case "compress":
+			if _, ok := compressedSuffixes[value]; !ok {
+				return c, fmt.Errorf("Compress must be gzip or zstd line %d", lineNr)
+			}
+			c.Compress = value
+		case "dropbox":
+			if value != dropBoxUser && value != dropBoxSession {
+				return c, fmt.Errorf("DropBox must be user or session line %d", lineNr)
+			}
+			c.DropBox = value
+		case "publishdir":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for PublishDir line %d", lineNr)
+			}
+			c.PublishDir = addSepSuffix(value)
+		case "resumedir":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for ResumeDir line %d", lineNr)
+			}
+			c.ResumeDir = value
+		case "resumetimeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return c, fmt.Errorf("Invalid duration for ResumeTimeout line %d", lineNr)
+			}
+			if d == 0 {
+				d = discardPartial
+			}
+			c.ResumeTimeout = d
+		case "ratelimit", "userratelimit":
+			rate, err := toBytes(strings.TrimSuffix(value, "/s"))
+			if err != nil {
+				return c, fmt.Errorf("%s must be a size per second such as 10M line %d", s[0], lineNr)
+			}
+			if key == "ratelimit" {
+				c.RateLimit = rate
+			} else {
+				c.UserRateLimit = rate
+			}
+		case "sharedir":
 			if strings.HasPrefix(value, "/") == false {
-				return c, fmt.Errorf("Only absolute path allowed for ScpPath line %d", lineNr)
+				return c, fmt.Errorf("Only absolute path allowed for ShareDir line %d", lineNr)
 			}
-			c.ScpPath = value
+			c.ShareDir = addSepSuffix(value)
+		case "sharetimeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return c, fmt.Errorf("Invalid duration for ShareTimeout line %d", lineNr)
+			}
+			c.ShareTimeout = d
+		case "collision":
+			switch value {
+			case collisionReject, collisionRename, collisionOverwrite, collisionVersion:
+			default:
+				return c, fmt.Errorf("Collision must be reject, rename, overwrite or version line %d", lineNr)
+			}
+			c.Collision = value
+		case "normalizenames":
+			if value != "yes" && value != "no" {
+				return c, fmt.Errorf("NormalizeNames must be yes or no line %d", lineNr)
+			}
+			c.NormalizeNames = value == "yes"
+		case "maxnamelength":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 255 {
+				return c, fmt.Errorf("MaxNameLength must be a number from 1 to 255 line %d", lineNr)
+			}
+			c.MaxNameLength = n
+		case "allowednamechars":
+			if _, err := parseNameChars(value); err != nil {
+				return c, fmt.Errorf("Invalid AllowedNameChars line %d: %s", lineNr, err)
+			}
+			c.AllowedNameChars = value
+		case "usernamelength", "passwordlength", "passphrasewords":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 256 {
+				return c, fmt.Errorf("%s must be a number from 1 to 256 line %d", s[0], lineNr)
+			}
+			switch key {
+			case "usernamelength":
+				c.UsernameLength = n
+			case "passwordlength":
+				c.PasswordLength = n
+			default:
+				c.PassphraseWords = n
+			}
+		case "usernamechars":
+			chars, err := charClasses(value)
+			if err != nil || strings.Contains(chars, symbolChars) {
+				return c, fmt.Errorf("UsernameChars must be a list of lower, upper and digit line %d", lineNr)
+			}
+			c.UsernameChars = value
+		case "passwordchars":
+			if _, err := charClasses(value); err != nil {
+				return c, fmt.Errorf("PasswordChars must be a list of lower, upper, digit and symbol line %d", lineNr)
+			}
+			c.PasswordChars = value
+		case "passwordmode":
+			if value != passwordModeRandom && value != passwordModePassphrase {
+				return c, fmt.Errorf("PasswordMode must be random or passphrase line %d", lineNr)
+			}
+			c.PasswordMode = value
+		case "queuedir":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for QueueDir line %d", lineNr)
+			}
+			c.QueueDir = value
+		case "workers":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return c, fmt.Errorf("Workers must be a positive number line %d", lineNr)
+			}
+			c.Workers = n
+		case "cmdmode":
+			if value != cmdModeFile && value != cmdModeSession {
+				return c, fmt.Errorf("CmdMode must be file or session line %d", lineNr)
+			}
+			c.CmdMode = value
+		case "jobtimeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return c, fmt.Errorf("Invalid duration for JobTimeout line %d", lineNr)
+			}
+			c.JobTimeout = d
+		case "webhook":
+			if !strings.HasPrefix(value, "http://") && !strings.HasPrefix(value, "https://") {
+				return c, fmt.Errorf("Only http or https URLs allowed for Webhook line %d", lineNr)
+			}
+			c.Webhook = value
+		case "webhooksecret":
+			c.WebhookSecret = value
+		case "webhookspool":
+			if strings.HasPrefix(value, "/") == false {
+				return c, fmt.Errorf("Only absolute path allowed for WebhookSpool line %d", lineNr)
+			}
+			c.WebhookSpool = value
+		case "webhookretries":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return c, fmt.Errorf("WebhookRetries must be a positive number line %d", lineNr)
+			}
+			c.WebhookRetries = n
 		default:
 			return c, fmt.Errorf("Unknown setting line %d: %s", lineNr, value)
 		}
@@ -164,7 +457,7 @@ func getConfig(path string) (c Config, err error) {
 
 	if path != "" {
 		if _, err := os.Stat(path); err != nil {
-			log.Fatalf("Unable to open config file (%s): %s\n", path, err)
+			return c, fmt.Errorf("Unable to open config file (%s): %s", path, err)
 		}
 		confPath = path
 	} else {
@@ -173,7 +466,7 @@ func getConfig(path string) (c Config, err error) {
 				if os.IsNotExist(err) {
 					continue
 				} else {
-					log.Fatalf("Unable to open config file (%s): %s\n", p, err)
+					return c, fmt.Errorf("Unable to open config file (%s): %s", p, err)
 				}
 			} else {
 				confPath = p
@@ -187,12 +480,13 @@ func getConfig(path string) (c Config, err error) {
 
 	b, err := ioutil.ReadFile(confPath)
 	if err != nil {
-		log.Fatalf("Unable to open config file (%s): %s\n", confPath, err)
+		return c, fmt.Errorf("Unable to open config file (%s): %s", confPath, err)
 	}
 	c, err = parseConfig(b)
 	if err != nil {
 		return c, err
 	}
+	c.ConfigFile = confPath
 
 	return c, nil
 }
@@ -208,13 +502,72 @@ func addConfigDefaults(c Config) Config {
 	if c.LogFile == "" {
 		c.LogFile = "-"
 	}
-	if c.ScpPath == "" {
-		c.ScpPath = "/usr/bin/scp"
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = 30 * time.Second
+	}
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = 30 * time.Second
+	}
+	if c.ReloadPoll == 0 {
+		c.ReloadPoll = 5 * time.Second
+	}
+	if c.WebhookRetries == 0 {
+		c.WebhookRetries = 3
+	}
+	if c.ResumeTimeout == 0 {
+		c.ResumeTimeout = 24 * time.Hour
+	}
+	if c.ShareTimeout == 0 {
+		c.ShareTimeout = 72 * time.Hour
+	}
+	if c.Workers == 0 {
+		c.Workers = 2
+	}
+	if c.UsernameLength == 0 {
+		c.UsernameLength = defaultUsernameLength
+	}
+	if c.UsernameChars == "" {
+		c.UsernameChars = defaultUsernameChars
+	}
+	if c.PasswordLength == 0 {
+		c.PasswordLength = defaultPasswordLength
+	}
+	if c.PasswordChars == "" {
+		c.PasswordChars = defaultPasswordChars
+	}
+	if c.PasswordMode == "" {
+		c.PasswordMode = passwordModeRandom
+	}
+	if c.PassphraseWords == 0 {
+		c.PassphraseWords = defaultPassphraseWords
 	}
 
 	return c
 }
 
+// noTimeout is stored for timeouts that are set to none. Timeouts that are
+// not set at all are zero and get their default.
+const noTimeout = time.Duration(-1)
+
+// discardPartial is stored for a ResumeTimeout of 0. Partial uploads are
+// then removed when the connection drops instead of being kept.
+const discardPartial = time.Duration(-1)
+
+// parseTimeout parses a positive duration or none for a timeout that has a
+// default but can be disabled.
+func parseTimeout(value string) (time.Duration, error) {
+	if value == "none" {
+		return noTimeout, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err == nil && d <= 0 {
+		err = errors.New("Timeout must be positive")
+	}
+
+	return d, err
+}
+
 // generateRSAPrivateKeySigner generates a new private key and returns a signer for it.
 func generateRSAPrivateKeySigner(bits int) (s ssh.Signer, err error) {
 	rng := rand.Reader
@@ -236,70 +589,79 @@ func loadPrivateKey(keyname string) (s ssh.Signer, err error) {
 	return ssh.ParsePrivateKey(privatekey)
 }
 
-// runServer starts the scp server.
-func runServer(config Config) {
-	passwdExists, _ := isFile(config.PasswdFile)
-	keysDirEmpty, _ := isEmptyDir(config.KeysDir)
-	if !passwdExists && keysDirEmpty {
-		logError.Fatalf("No passwd file or keys directory")
-	}
-
-	b, err := dirExists(config.UsersDir)
+// runServer starts the scp server and blocks until it receives SIGINT or SIGTERM.
+// Active sessions are then given DrainTimeout to finish before the server exits.
+// The config is reloaded with reload on SIGHUP or when the config file changes.
+func runServer(config Config, reload func() (Config, error)) {
+	server, err := NewServer(config)
 	if err != nil {
-		logError.Fatalf("UsersDir: %v\n", err)
-	} else if b == false {
-		logError.Fatalln("UsersDir does not exist")
+		logError.Fatalln(err)
 	}
 
-	helper := validationHelper{PasswdFile: config.PasswdFile, KeysDir: config.KeysDir}
-	sshConfig := &ssh.ServerConfig{
-		ServerVersion:     "SSH-2.0-scpDrop-" + scpDropVersion,
-		PasswordCallback:  helper.validateUser,
-		PublicKeyCallback: helper.validatePubKey,
+	if err = server.Start(); err != nil {
+		logError.Fatalln(err)
 	}
 
-	var private ssh.Signer
-	if config.PrivateKey == "" {
-		private, err = generateRSAPrivateKeySigner(2048)
-		if err != nil {
-			log.Fatalf("Error while generating private key: %s\n", err)
-		}
-	} else {
-		private, err = loadPrivateKey(config.PrivateKey)
-		if err != nil {
-			log.Fatalf("Error while reading private key: %s\n", err)
-		}
-	}
-	sshConfig.AddHostKey(private)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(sigs)
 
-	listener, err := net.Listen("tcp", config.Listen)
-	if err != nil {
-		log.Fatalf("Failed to listen for connection: %s\n", err)
+	changed := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	if config.ConfigFile != "" {
+		go watchFile(config.ConfigFile, config.ReloadPoll, changed, stop)
 	}
 
-	logInfo.Println("Service started")
-
 	for {
-		nConn, err := listener.Accept()
-		if err != nil {
-			logWarning.Printf("Failed to accept incoming connection: %s\n", err)
-			continue
-		}
+		select {
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				logInfo.Println("Received SIGHUP, reloading config")
+				reloadServer(server, reload)
+				continue
+			}
 
-		sshConn, chans, reqs, err := ssh.NewServerConn(nConn, sshConfig)
-		if err != nil {
-			logWarning.Printf("Failed to handshake with %s: %s\n", nConn.RemoteAddr().String(), err)
-			continue
+			current, _ := server.currentConfig()
+			ctx, cancel := context.WithCancel(context.Background())
+			if current.DrainTimeout == noTimeout {
+				logInfo.Printf("Received %s, draining sessions\n", sig)
+			} else {
+				logInfo.Printf("Received %s, draining sessions for up to %s\n", sig, current.DrainTimeout)
+				ctx, cancel = context.WithTimeout(context.Background(), current.DrainTimeout)
+			}
+			defer cancel()
+
+			if err = server.Shutdown(ctx); err != nil {
+				logWarning.Printf("Shutdown: %s\n", err)
+			}
+			return
+		case <-changed:
+			logInfo.Printf("Config file %s changed, reloading config\n", config.ConfigFile)
+			reloadServer(server, reload)
 		}
+	}
+}
 
-		logInfo.Printf("Connection established  with %s\n", sshConn.RemoteAddr().String())
+// reloadServer reads the config again and applies it to the server.
+// Invalid configs are logged and the running config is kept.
+func reloadServer(server *Server, reload func() (Config, error)) {
+	config, err := reload()
+	if err == nil {
+		err = server.Reload(config)
+	}
 
-		go handleRequests(reqs)
-		go handleChannels(chans, sshConn.Permissions, sshConn.RemoteAddr().String(), config)
+	if err != nil {
+		logError.Printf("Unable to reload config, keeping current config: %s\n", err)
 	}
 }
 
+// logOut is the currently open log file, nil when logging to stdout.
+var logOut *os.File
+
 // initLog initiates the loggers for the different log levels.
+// Calling it again reconfigures the existing loggers in place, so it is safe
+// to use while other goroutines are logging.
 func initLog(filename string, level string) {
 	var out *os.File
 
@@ -314,34 +676,56 @@ func initLog(filename string, level string) {
 		}
 	}
 
-	logDebug = log.New(ioutil.Discard, "", 0)
-	logInfo = log.New(ioutil.Discard, "", 0)
-	logWarning = log.New(ioutil.Discard, "", 0)
-	logError = log.New(ioutil.Discard, "", 0)
+	setLogger(&logDebug, ioutil.Discard, "", 0)
+	setLogger(&logInfo, ioutil.Discard, "", 0)
+	setLogger(&logWarning, ioutil.Discard, "", 0)
+	setLogger(&logError, ioutil.Discard, "", 0)
 
 	logflags := log.Ldate | log.Ltime
 
 	switch level {
 	case "debug":
 		logflags = log.Ldate | log.Ltime | log.Lshortfile
-		logDebug = log.New(out, "Debug: ", logflags)
+		setLogger(&logDebug, out, "Debug: ", logflags)
 		fallthrough
 	case "info":
-		logInfo = log.New(out, "Info: ", logflags)
+		setLogger(&logInfo, out, "Info: ", logflags)
 		fallthrough
 	case "warning":
-		logWarning = log.New(out, "Warning: ", logflags)
+		setLogger(&logWarning, out, "Warning: ", logflags)
 		fallthrough
 	case "error":
-		logError = log.New(out, "Error: ", logflags)
+		setLogger(&logError, out, "Error: ", logflags)
 	case "none":
 	default:
 		log.Fatalln("Unknown log level: ", level)
 	}
+
+	if logOut != nil {
+		logOut.Close()
+	}
+	logOut = nil
+	if out != os.Stdout {
+		logOut = out
+	}
+}
+
+// setLogger creates a logger or reconfigures it if it already exists.
+func setLogger(l **log.Logger, out io.Writer, prefix string, flags int) {
+	if *l == nil {
+		*l = log.New(out, prefix, flags)
+		return
+	}
+
+	(*l).SetOutput(out)
+	(*l).SetPrefix(prefix)
+	(*l).SetFlags(flags)
 }
 
 // parseServerFlags parses flags for the server run option.
-func parseServerFlags(args []string) Config {
+// The returned reload function reads the config file again and applies the
+// same command line overrides on top of it.
+func parseServerFlags(args []string) (config Config, reload func() (Config, error)) {
 	f := flag.NewFlagSet("Server", flag.ExitOnError)
 
 	var laddr = f.String("l", "", "Listen (default \":2022\")")
@@ -353,73 +737,87 @@ func parseServerFlags(args []string) Config {
 	var logFile = f.String("logfile", "", "Log filename (use - for stdout) (default stdout)")
 	var passwdFile = f.String("P", "", "Password file")
 	var cmd = f.String("cmd", "", "Command to run on an uploaded file. Filname will be past as the last argument. @filename to run file")
-	var scpPath = f.String("scp", "", "Path to scp (default \"/usr/bin/scp\")")
+	var drainTimeout = f.String("drain", "", "Time to wait for active sessions on shutdown, none to wait for all of them (default 30s)")
+	var metricsListen = f.String("metrics", "", "Listen address for the prometheus /metrics endpoint (default disabled)")
 	var configFile = f.String("c", "", "Config file path")
 	var genprivkey = f.Bool("genpriv", false, "Generate random private key")
 
 	f.Parse(args)
 
-	var config Config
-
-	var err error
-	config, err = getConfig(*configFile)
-	config = addConfigDefaults(config)
-	if err != nil {
-		log.Fatalf("Unable to read config: %v\n", err)
+	if *sharedDir != "" && !strings.HasPrefix(*sharedDir, string(filepath.Separator)) {
+		log.Fatalf("shared must be an absolute path\n")
+	}
+	if *usersDir != "" && !strings.HasPrefix(*usersDir, string(filepath.Separator)) {
+		log.Fatal("users must be an absolute path\n")
 	}
 
-	if len(config.Cmd) != 0 || *cmd != "" {
-		if runtime.GOOS == "windows" {
-			logError.Fatalln("Cmd not available on windows")
+	reload = func() (Config, error) {
+		config, err := getConfig(*configFile)
+		config = addConfigDefaults(config)
+		if err != nil {
+			return config, err
 		}
+
 		if *cmd != "" {
 			config.Cmd = parseCmdLine(*cmd)
 		}
-	}
-
-	if *scpPath != "" {
-		config.ScpPath = *scpPath
-	}
-
-	if *laddr != "" {
-		config.Listen = *laddr
-	}
-	if *privateKeyPath != "" {
-		config.PrivateKey = *privateKeyPath
-	}
-	if *sharedDir != "" {
-		if !strings.HasPrefix(*sharedDir, string(filepath.Separator)) {
-			log.Fatalf("shared must be an absolute path\n")
+		if *laddr != "" {
+			config.Listen = *laddr
 		}
-		config.SharedDir = addSepSuffix(*sharedDir)
-	}
-	if *usersDir != "" {
-		if !strings.HasPrefix(*usersDir, string(filepath.Separator)) {
-			log.Fatal("users must be an absolute path\n")
+		if *privateKeyPath != "" {
+			config.PrivateKey = *privateKeyPath
 		}
-		config.UsersDir = addSepSuffix(*usersDir)
-	}
-	if *keysDir != "" {
-		config.KeysDir = addSepSuffix(*keysDir)
-	}
-	if *logLevel != "" {
-		config.LogLevel = *logLevel
-	}
-	if *logFile != "" {
-		config.LogFile = *logFile
-	}
-	if *passwdFile != "" {
-		config.PasswdFile = *passwdFile
+		if *sharedDir != "" {
+			config.SharedDir = addSepSuffix(*sharedDir)
+		}
+		if *usersDir != "" {
+			config.UsersDir = addSepSuffix(*usersDir)
+		}
+		if *keysDir != "" {
+			config.KeysDir = addSepSuffix(*keysDir)
+		}
+		if *logLevel != "" {
+			config.LogLevel = *logLevel
+		}
+		if *logFile != "" {
+			config.LogFile = *logFile
+		}
+		if *passwdFile != "" {
+			config.PasswdFile = *passwdFile
+		}
+		if *genprivkey {
+			config.PrivateKey = ""
+		}
+		if *drainTimeout != "" {
+			d, err := parseTimeout(*drainTimeout)
+			if err != nil {
+				return config, fmt.Errorf("Invalid duration for drain: %s", err)
+			}
+			config.DrainTimeout = d
+		}
+		if *metricsListen != "" {
+			config.MetricsListen = *metricsListen
+		}
+
+		return config, nil
 	}
-	if *genprivkey {
-		config.PrivateKey = ""
+
+	config, err := reload()
+	if err != nil {
+		log.Fatalf("Unable to read config: %v\n", err)
 	}
 
-	return config
+	return config, reload
+}
+
+// userOutput sets how a new user is reported.
+type userOutput struct {
+	Format string
+	Host   string
 }
 
 // parseUserFlags parses flags for the add user option.
-func parseUserFlags(args []string) (userInfo UserInfo, config Config, t int) {
+func parseUserFlags(args []string) (userInfo UserInfo, config Config, t int, out userOutput) {
 	f := flag.NewFlagSet("User", flag.ExitOnError)
 
 	// Mandatory
@@ -438,9 +836,13 @@ func parseUserFlags(args []string) (userInfo UserInfo, config Config, t int) {
 	var revUp = f.Bool("recup", false, "Allow recursive uploads")
 	var revDown = f.Bool("recdown", false, "Allow recursive downloads")
 	var upSize = f.String("upsize", "0", "Maximum upload size")
+	var cmd = f.String("cmd", "", "Command to run on this users uploads instead of the global pipeline, or stages=<name>,<name>")
 
 	var keyfile = f.Bool("key", false, "Create key file template")
 
+	f.StringVar(&out.Format, "instructions", "", "Print connection instructions for the user as text, json or qr")
+	f.StringVar(&out.Host, "host", "", "Host name used in the instructions (default the host name)")
+
 	var passwdFile = f.String("passfile", "", "Output passwd file")
 	var configFile = f.String("c", "", "Config file path")
 
@@ -458,13 +860,16 @@ func parseUserFlags(args []string) (userInfo UserInfo, config Config, t int) {
 		os.Exit(1)
 	}
 
-	if userInfo.Plaintext && bytes.Contains(userInfo.Password, []byte(":")) {
-		log.Fatalln("Colons \":\" not allowed in plain text passwords")
+	if *username != "" && !validUsername(*username) {
+		log.Fatalf("Invalid username %q, use letters, digits and \"._-@\"\n", *username)
 	}
-
 	userInfo.Username = []byte(*username)
 	userInfo.Password = []byte(*password)
 
+	if userInfo.Plaintext && bytes.ContainsAny(userInfo.Password, ":\n") {
+		log.Fatalln("Colons \":\" and newlines not allowed in plain text passwords")
+	}
+
 	if *userDir == "" && !*nouserDir {
 		userInfo.UserDir = []byte(config.UsersDir)
 		userInfo.UserDir = append(userInfo.UserDir, userInfo.Username...)
@@ -475,6 +880,9 @@ func parseUserFlags(args []string) (userInfo UserInfo, config Config, t int) {
 			log.Fatalf("userDir must be an absolute path\n")
 		}
 	}
+	if bytes.ContainsAny(userInfo.UserDir, ":\n") {
+		log.Fatalln("Colons \":\" and newlines not allowed in userDir")
+	}
 
 	if *download {
 		userInfo.Privileges = append(userInfo.Privileges, byte('r'))
@@ -500,6 +908,14 @@ func parseUserFlags(args []string) (userInfo UserInfo, config Config, t int) {
 		userInfo.UpSize = uint64(si)
 	}
 
+	if strings.Contains(*cmd, "\n") {
+		log.Fatalln("Newlines not allowed in cmd")
+	}
+	if _, err := pipelineStages(config, *cmd); err != nil {
+		log.Fatalf("Invalid cmd: %s\n", err)
+	}
+	userInfo.Cmd = []byte(*cmd)
+
 	if *passwdFile != "" {
 		config.PasswdFile = *passwdFile
 	}
@@ -508,7 +924,178 @@ func parseUserFlags(args []string) (userInfo UserInfo, config Config, t int) {
 		t = 2
 	}
 
-	return userInfo, config, t
+	if out.Format != "" {
+		if out.Format != formatText && out.Format != formatJSON && out.Format != formatQR {
+			log.Fatalln(errInstructionFormat)
+		}
+		if out.Host == "" {
+			if out.Host, err = os.Hostname(); err != nil {
+				log.Fatalf("Unable to get host name: %s\n", err)
+			}
+		}
+	}
+
+	return userInfo, config, t, out
+}
+
+// parseImportFlags parses flags for the user import option.
+func parseImportFlags(args []string) (config Config, file string, content []byte, format string, out string) {
+	f := flag.NewFlagSet("Import", flag.ExitOnError)
+
+	var inFormat = f.String("format", "", "Format of the import file, csv or json (default from the file name)")
+	var outFormat = f.String("out", "", "Format of the printed credentials, csv or json (default the import format)")
+	var passwdFile = f.String("passfile", "", "Output passwd file")
+	var configFile = f.String("c", "", "Config file path")
+
+	f.Parse(args)
+
+	config, err := getConfig(*configFile)
+	config = addConfigDefaults(config)
+	if err != nil {
+		log.Fatalf("Unable to read config: %v\n", err)
+	}
+
+	if f.NArg() != 1 {
+		log.Fatalln("Exactly one file to import is required, - for stdin")
+	}
+	file = f.Arg(0)
+
+	if file == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		log.Fatalf("Unable to read %s: %s\n", file, err)
+	}
+
+	format = *inFormat
+	if format == "" {
+		format = importFormat(file, content)
+	}
+	out = *outFormat
+	if out == "" {
+		out = format
+	}
+	for _, fm := range []string{format, out} {
+		if fm != importCSV && fm != importJSON {
+			log.Fatalln(errImportFormat)
+		}
+	}
+
+	if *passwdFile != "" {
+		config.PasswdFile = *passwdFile
+	}
+
+	return config, file, content, format, out
+}
+
+// parseShareFlags parses flags for the share option.
+func parseShareFlags(args []string) (config Config, req shareRequest) {
+	f := flag.NewFlagSet("Share", flag.ExitOnError)
+
+	var host = f.String("host", "", "Host name used in the printed command (default the host name)")
+	var expire = f.Duration("expire", 0, "Time until the share expires (default ShareTimeout)")
+	var shareDir = f.String("dir", "", "Path to the share directory (default ShareDir)")
+	var passwdFile = f.String("passfile", "", "Output passwd file")
+	var configFile = f.String("c", "", "Config file path")
+	f.BoolVar(&req.Copy, "copy", false, "Copy the file instead of hard-linking it")
+
+	f.Parse(args)
+
+	config, err := getConfig(*configFile)
+	config = addConfigDefaults(config)
+	if err != nil {
+		log.Fatalf("Unable to read config: %v\n", err)
+	}
+
+	if f.NArg() != 1 {
+		log.Fatalln("Exactly one file to share is required")
+	}
+	req.File = f.Arg(0)
+
+	if *shareDir != "" {
+		if !strings.HasPrefix(*shareDir, string(filepath.Separator)) {
+			log.Fatalln("dir must be an absolute path")
+		}
+		config.ShareDir = addSepSuffix(*shareDir)
+	}
+	if *passwdFile != "" {
+		config.PasswdFile = *passwdFile
+	}
+
+	req.Expire = config.ShareTimeout
+	if *expire > 0 {
+		req.Expire = *expire
+	}
+
+	req.Host = *host
+	if req.Host == "" {
+		if req.Host, err = os.Hostname(); err != nil {
+			log.Fatalf("Unable to get host name: %s\n", err)
+		}
+	}
+
+	return config, req
+}
+
+// parseJobsFlags parses flags for the jobs option.
+func parseJobsFlags(args []string) (config Config, states []string, retry string) {
+	f := flag.NewFlagSet("Jobs", flag.ExitOnError)
+
+	var pending = f.Bool("pending", false, "Only list pending and running jobs")
+	var failed = f.Bool("failed", false, "Only list failed jobs")
+	var retryID = f.String("retry", "", "Queue a failed job again, use \"all\" to retry all failed jobs")
+	var queueDir = f.String("queue", "", "Path to the queue directory")
+	var configFile = f.String("c", "", "Config file path")
+
+	f.Parse(args)
+
+	config, err := getConfig(*configFile)
+	config = addConfigDefaults(config)
+	if err != nil {
+		log.Fatalf("Unable to read config: %v\n", err)
+	}
+
+	if *queueDir != "" {
+		config.QueueDir = *queueDir
+	}
+	if config.QueueDir == "" {
+		log.Fatalln("No queue directory configured")
+	}
+
+	switch {
+	case *pending && !*failed:
+		states = []string{jobPending, jobRunning}
+	case *failed && !*pending:
+		states = []string{jobFailed}
+	default:
+		states = []string{jobPending, jobRunning, jobFailed}
+	}
+
+	return config, states, *retryID
+}
+
+// parseDecryptFlags parses flags for the decrypt option.
+func parseDecryptFlags(args []string) (keyRing string, output string, files []string) {
+	f := flag.NewFlagSet("Decrypt", flag.ExitOnError)
+
+	var keys = f.String("k", "", "Secret key ring (armored or binary)")
+	var out = f.String("o", "", "Output file, - for stdout (default the input without "+encryptedSuffix+")")
+
+	f.Parse(args)
+
+	if *keys == "" {
+		log.Fatalln("A secret key ring is required")
+	}
+	if f.NArg() == 0 {
+		log.Fatalln("No files to decrypt")
+	}
+	if *out != "" && f.NArg() > 1 {
+		log.Fatalln("Only one file can be decrypted with -o")
+	}
+
+	return *keys, *out, f.Args()
 }
 
 func main() {
@@ -517,19 +1104,83 @@ func main() {
 
 	switch flag.Arg(0) {
 	case "server":
-		config := parseServerFlags(flag.Args()[1:])
+		config, reload := parseServerFlags(flag.Args()[1:])
 		initLog(config.LogFile, config.LogLevel)
 		logDebug.Printf("%+v", config)
-		runServer(config)
+		runServer(config, reload)
 	case "user":
-		userInfo, config, t := parseUserFlags(flag.Args()[1:])
+		if flag.Arg(1) == "import" {
+			config, file, content, format, out := parseImportFlags(flag.Args()[2:])
+			initLog(config.LogFile, config.LogLevel)
+			rows, err := parseImport(content, format)
+			if err != nil {
+				log.Fatalf("Unable to parse %s: %s\n", file, err)
+			}
+			users, err := importUsers(config, rows, time.Now())
+			if err != nil {
+				log.Fatalf("Unable to import users: %s\n", err)
+			}
+			if err = writeImported(os.Stdout, out, users); err != nil {
+				log.Fatalf("Unable to print users: %s\n", err)
+			}
+			break
+		}
+
+		userInfo, config, t, out := parseUserFlags(flag.Args()[1:])
 		initLog(config.LogFile, config.LogLevel)
 		switch t {
 		case 1:
-			addUser(userInfo, config.PasswdFile)
+			userInfo, generated := addUser(userInfo, config)
+			switch {
+			case out.Format != "":
+				printInstructions(userInfo, config, out)
+			case generated:
+				fmt.Printf("User: %s Pass: %s\n", string(userInfo.Username), string(userInfo.Password))
+			default:
+				logInfo.Printf("User %s added\n", string(userInfo.Username))
+			}
 		case 2:
 			createKeyFile(userInfo, config.KeysDir)
 		}
+	case "share":
+		config, req := parseShareFlags(flag.Args()[1:])
+		initLog("-", "error")
+		share, password, err := createShare(config, req)
+		if err != nil {
+			log.Fatalf("Unable to share %s: %s\n", req.File, err)
+		}
+
+		fmt.Printf("User: %s Pass: %s\n", share.User, password)
+		fmt.Printf("Expires: %s\n", share.Expires.Format("2006-01-02 15:04:05 MST"))
+		fmt.Println(shareCommand(share, req.Host, config.Listen))
+	case "jobs":
+		config, states, retry := parseJobsFlags(flag.Args()[1:])
+		initLog("-", "error")
+		queue, err := newJobQueue(config.QueueDir)
+		if err != nil {
+			log.Fatalf("Unable to open queue: %s\n", err)
+		}
+
+		if retry != "" {
+			retried, err := queue.retry(retry)
+			for _, id := range retried {
+				fmt.Printf("Job %s queued again\n", id)
+			}
+			if err != nil {
+				log.Fatalf("Unable to retry job: %s\n", err)
+			}
+			return
+		}
+
+		if err = queue.printJobs(os.Stdout, states...); err != nil {
+			log.Fatalf("Unable to list jobs: %s\n", err)
+		}
+	case "decrypt":
+		keyRing, output, files := parseDecryptFlags(flag.Args()[1:])
+		initLog("-", "error")
+		if err := decryptFiles(keyRing, output, files); err != nil {
+			log.Fatalln(err)
+		}
 	default:
 		printUsage()
 	}
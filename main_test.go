@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 )
@@ -40,9 +42,6 @@ func verifyConfig(testNr int, testConfig Config, correctConfig Config, t *testin
 			}
 		}
 	}
-	if testConfig.ScpPath != correctConfig.ScpPath {
-		t.Errorf("Test%d ScpPath (%s) does not match expected (%s)\n", testNr, testConfig.ScpPath, correctConfig.ScpPath)
-	}
 }
 
 func verifyUserInfo(testNr int, testInfo UserInfo, correctInfo UserInfo, t *testing.T) {
@@ -70,6 +69,9 @@ func verifyUserInfo(testNr int, testInfo UserInfo, correctInfo UserInfo, t *test
 	if testInfo.Plaintext != correctInfo.Plaintext {
 		t.Errorf("Test%d Plaintext (%v) does not match expected (%v)\n", testNr, testInfo.Plaintext, correctInfo.Plaintext)
 	}
+	if bytes.Compare(testInfo.Cmd, correctInfo.Cmd) != 0 {
+		t.Errorf("Test%d Cmd (%s) does not match expected (%s)\n", testNr, testInfo.Cmd, correctInfo.Cmd)
+	}
 }
 
 func parseConfigPassTests(t *testing.T) {
@@ -86,12 +88,11 @@ LogLevel debug
 LogFile -
 PasswdFile /tmp/passwd
 Cmd sed 's/Test/<test>/g'
-ScpPath /usr/bin/scp
 `))
 
 	expectedOut = append(expectedOut, Config{Listen: ":2022", SharedDir: "/tmp/shared/", UsersDir: "/tmp/users/",
 		KeysDir: "/tmp/keys/", PrivateKey: "/tmp/test_id_rsa", LogLevel: "debug", LogFile: "-",
-		PasswdFile: "/tmp/passwd", Cmd: []string{"sed", "'s/Test/<test>/g'"}, ScpPath: "/usr/bin/scp"})
+		PasswdFile: "/tmp/passwd", Cmd: []string{"sed", "'s/Test/<test>/g'"}})
 
 	//Messy config
 	testIn = append(testIn, []byte(`listen :2022
@@ -103,12 +104,11 @@ PrivateKey	/tmp/test_id_rsa
 logLevel	 debug
 logFile -
 passwdfile /tmp/passwd
-ScpPath /usr/bin/scp
 `))
 
 	expectedOut = append(expectedOut, Config{Listen: ":2022", SharedDir: "/tmp/shared/", UsersDir: "/tmp/users/",
 		KeysDir: "/tmp/keys/", PrivateKey: "/tmp/test_id_rsa", LogLevel: "debug", LogFile: "-",
-		PasswdFile: "/tmp/passwd", Cmd: []string{}, ScpPath: "/usr/bin/scp"})
+		PasswdFile: "/tmp/passwd", Cmd: []string{}})
 
 	for i, confFile := range testIn {
 		testConfig, err := parseConfig(confFile)
@@ -132,7 +132,6 @@ PrivateKey	/tmp/test_id_rsa
 logLevel	 debug
 logFile -
 passwdfile /tmp/passwd
-ScpPath /usr/bin/scp
 `))
 
 	for i, confFile := range testIn {
@@ -160,19 +159,27 @@ func TestParseServerFlagsWithBlankConfig(t *testing.T) {
 	var expectedOut []Config
 
 	inputArgs = append(inputArgs, []string{"-l", ":2022", "-key", "/tmp/test_id_rsa", "-shared", "/tmp/shared", "-users", "/tmp/users",
-		"-keys", "/tmp/keys", "-log", "debug", "-logfile", "-", "-P", "/tmp/passwd", "-cmd", "testcmd -a testy", "-scp", "/usr/bin/scp", "-c", "empty.conf"})
+		"-keys", "/tmp/keys", "-log", "debug", "-logfile", "-", "-P", "/tmp/passwd", "-cmd", "testcmd -a testy", "-c", "empty.conf"})
 	expectedOut = append(expectedOut, Config{Listen: ":2022", SharedDir: "/tmp/shared" + string(filepath.Separator),
 		UsersDir: "/tmp/users" + string(filepath.Separator), KeysDir: "/tmp/keys" + string(filepath.Separator),
 		PrivateKey: "/tmp/test_id_rsa", LogLevel: "debug", LogFile: "-", PasswdFile: "/tmp/passwd",
-		Cmd: []string{"testcmd", "-a", "testy"}, ScpPath: "/usr/bin/scp"})
+		Cmd: []string{"testcmd", "-a", "testy"}})
 
 	for i, args := range inputArgs {
-		testConfig := parseServerFlags(args)
+		testConfig, _ := parseServerFlags(args)
 		verifyConfig(i+1, testConfig, expectedOut[i], t)
 	}
 }
 
 func TestParseUserFlagsWithBlankConfig(t *testing.T) {
+	stageConf, err := ioutil.TempFile("", "scpdropStageConfTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary config: %s\n", err)
+	}
+	defer os.Remove(stageConf.Name())
+	stageConf.WriteString("Stage scan /bin/true\n")
+	stageConf.Close()
+
 	var inputArgs [][]string
 	var expectedOut []UserInfo
 
@@ -180,8 +187,12 @@ func TestParseUserFlagsWithBlankConfig(t *testing.T) {
 	expectedOut = append(expectedOut, UserInfo{Username: []byte("testy"), Password: []byte("mctest"), Privileges: []byte("w"),
 		UserDir: []byte("testy"), Recursive: []byte("w"), UpSize: 1024, Permanent: false, Plaintext: true})
 
+	inputArgs = append(inputArgs, []string{"-u", "testy", "-p", "mctest", "-up", "-cmd", "stages=scan", "-c", stageConf.Name()})
+	expectedOut = append(expectedOut, UserInfo{Username: []byte("testy"), Password: []byte("mctest"), Privileges: []byte("w"),
+		UserDir: []byte("testy"), Cmd: []byte("stages=scan")})
+
 	for i, args := range inputArgs {
-		userInfo, _, _ := parseUserFlags(args)
+		userInfo, _, _, _ := parseUserFlags(args)
 		verifyUserInfo(i, userInfo, expectedOut[i], t)
 	}
 }
@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// metric is a single counter or gauge, optionally split up by labels.
+type metric struct {
+	name   string
+	help   string
+	kind   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newMetric creates a metric of kind counter or gauge.
+func newMetric(name string, kind string, help string) *metric {
+	return &metric{name: name, help: help, kind: kind, values: make(map[string]float64)}
+}
+
+// Add adds v to the metric with the given label string, such as `method="password"`.
+func (m *metric) Add(labels string, v float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[labels] += v
+}
+
+// Inc increments the metric without labels by one.
+func (m *metric) Inc() {
+	m.Add("", 1)
+}
+
+// Dec decrements the metric without labels by one.
+func (m *metric) Dec() {
+	m.Add("", -1)
+}
+
+// Value returns the current value of the metric with the given label string.
+func (m *metric) Value(labels string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.values[labels]
+}
+
+// writeTo writes the metric in the prometheus text exposition format.
+func (m *metric) writeTo(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	if len(m.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", m.name)
+		return
+	}
+
+	var labels []string
+	for l := range m.values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		if l == "" {
+			fmt.Fprintf(w, "%s %v\n", m.name, m.values[l])
+		} else {
+			fmt.Fprintf(w, "%s{%s} %v\n", m.name, l, m.values[l])
+		}
+	}
+}
+
+// Metrics exported by the server.
+var (
+	metricConnections      = newMetric("scpdrop_connections_total", "counter", "Accepted TCP connections.")
+	metricAuth             = newMetric("scpdrop_auth_total", "counter", "Authentication attempts by method and result.")
+	metricRejected         = newMetric("scpdrop_rejected_commands_total", "counter", "Rejected commands by error type.")
+	metricUploadBytes      = newMetric("scpdrop_uploaded_bytes_total", "counter", "Bytes uploaded.")
+	metricUploadFiles      = newMetric("scpdrop_uploaded_files_total", "counter", "Files uploaded.")
+	metricDownloadBytes    = newMetric("scpdrop_downloaded_bytes_total", "counter", "Bytes downloaded.")
+	metricDownloadFiles    = newMetric("scpdrop_downloaded_files_total", "counter", "Files downloaded.")
+	metricSuppressedFiles  = newMetric("scpdrop_suppressed_files_total", "counter", "Uploads suppressed for exceeding the maximum size.")
+	metricCmdFailures      = newMetric("scpdrop_cmd_failures_total", "counter", "Failed post-upload commands.")
+	metricActiveSessions   = newMetric("scpdrop_active_sessions", "gauge", "Currently running scp sessions.")
+	metricQuarantinedFiles = newMetric("scpdrop_quarantined_files_total", "counter", "Uploads quarantined by the virus scanner.")
+	metricTimeouts         = newMetric("scpdrop_timeouts_total", "counter", "Handshakes and sessions ended by a timeout.")
+
+	allMetrics = []*metric{metricConnections, metricAuth, metricRejected, metricUploadBytes,
+		metricUploadFiles, metricDownloadBytes, metricDownloadFiles, metricSuppressedFiles,
+		metricCmdFailures, metricActiveSessions, metricQuarantinedFiles, metricTimeouts}
+)
+
+// errorLabels maps the errors returned to clients to metric label values.
+var errorLabels = map[error]string{
+	errOnlySCP:            "errOnlySCP",
+	errFewArgs:            "errFewArgs",
+	errDisallowedChars:    "errDisallowedChars",
+	errAbsolutePath:       "errAbsolutePath",
+	errPathTraversal:      "errPathTraversal",
+	errUploadPrivs:        "errUploadPrivs",
+	errDownloadPrivs:      "errDownloadPrivs",
+	errUnsupportedScpFlag: "errUnsupportedScpFlag",
+	errRecursiveDownload:  "errRecursiveDownload",
+	errRecursiveUpload:    "errRecursiveUpload",
+	errUnterminatedQuote:  "errUnterminatedQuote",
+	errScpMode:            "errScpMode",
+	errManyTargets:        "errManyTargets",
+}
+
+// countAuth counts an authentication attempt.
+func countAuth(method string, success bool) {
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	metricAuth.Add(fmt.Sprintf("method=%q,result=%q", method, result), 1)
+}
+
+// countKeyProbe counts a public key that was offered but not accepted.
+// Clients offer several keys before the one that works, so these are not
+// failed logins.
+func countKeyProbe() {
+	metricAuth.Add(`method="publickey",result="probe"`, 1)
+}
+
+// countRejected counts a rejected command by its error type.
+func countRejected(err error) {
+	label, ok := errorLabels[err]
+	if !ok {
+		label = "other"
+	}
+	metricRejected.Add(fmt.Sprintf("error=%q", label), 1)
+}
+
+// metricsHandler serves all metrics in the prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, m := range allMetrics {
+		m.writeTo(w)
+	}
+}
+
+// newMetricsServer creates an http server serving /metrics on addr.
+func newMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
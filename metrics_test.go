@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMetricWriteTo(t *testing.T) {
+	m := newMetric("test_total", "counter", "Test counter.")
+
+	var b bytes.Buffer
+	m.writeTo(&b)
+	expectedOut := "# HELP test_total Test counter.\n# TYPE test_total counter\ntest_total 0\n"
+	if b.String() != expectedOut {
+		t.Errorf("Output (%q) does not match expected (%q)\n", b.String(), expectedOut)
+	}
+
+	m.Add(`method="b"`, 2)
+	m.Add(`method="a"`, 1)
+	m.Add(`method="b"`, 1)
+
+	b.Reset()
+	m.writeTo(&b)
+	expectedOut = "# HELP test_total Test counter.\n# TYPE test_total counter\n" +
+		"test_total{method=\"a\"} 1\ntest_total{method=\"b\"} 3\n"
+	if b.String() != expectedOut {
+		t.Errorf("Output (%q) does not match expected (%q)\n", b.String(), expectedOut)
+	}
+}
+
+func TestCountRejected(t *testing.T) {
+	tests := make(map[error]string)
+	tests[errOnlySCP] = `error="errOnlySCP"`
+	tests[errPathTraversal] = `error="errPathTraversal"`
+	tests[errInvalidByteQuantity] = `error="other"`
+
+	for testIn, expectedOut := range tests {
+		before := metricRejected.Value(expectedOut)
+		countRejected(testIn)
+		if v := metricRejected.Value(expectedOut); v != before+1 {
+			t.Errorf("Counter %s (%v) does not match expected (%v)\n", expectedOut, v, before+1)
+		}
+	}
+}
+
+func TestCountKeyProbe(t *testing.T) {
+	label := `method="publickey",result="probe"`
+	failures := metricAuth.Value(`method="publickey",result="failure"`)
+	before := metricAuth.Value(label)
+
+	dir, _ := ioutil.TempDir("", "scpdropMetricsTest")
+	defer os.RemoveAll(dir)
+	initLog("-", "none")
+
+	key, _ := generateRSAPrivateKeySigner(1024)
+	h := validationHelper{KeysDir: addSepSuffix(dir)}
+	h.validatePubKey(&testSSHConn{user: "testy"}, key.PublicKey())
+
+	if v := metricAuth.Value(label); v != before+1 {
+		t.Errorf("Counter %s (%v) does not match expected (%v)\n", label, v, before+1)
+	}
+	if v := metricAuth.Value(`method="publickey",result="failure"`); v != failures {
+		t.Errorf("Public key failures (%v) does not match expected (%v)\n", v, failures)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	countAuth("password", false)
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(w.Body)
+	for _, m := range allMetrics {
+		if !strings.Contains(string(body), "# TYPE "+m.name+" "+m.kind+"\n") {
+			t.Errorf("Metric %s missing from output\n", m.name)
+		}
+	}
+	if !strings.Contains(string(body), `scpdrop_auth_total{method="password",result="failure"}`) {
+		t.Errorf("Auth failure missing from output\n")
+	}
+}
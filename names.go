@@ -0,0 +1,225 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Policies for uploads with the name of an existing file.
+const (
+	collisionReject    = "reject"
+	collisionRename    = "rename"
+	collisionOverwrite = "overwrite"
+	collisionVersion   = "version"
+)
+
+// errFileExists is returned for an upload of an existing file with the reject policy.
+var errFileExists = errors.New("File already exists")
+
+// nameRules are the rules uploaded file and directory names are cleaned with.
+type nameRules struct {
+	normalize bool
+	maxLength int
+	allowed   charSet
+}
+
+// charRange is a range of characters from lo to hi, inclusive.
+type charRange struct {
+	lo, hi rune
+}
+
+// charSet is a set of characters. An empty set allows every character.
+type charSet []charRange
+
+// parseNameChars parses a set of characters written like the content of a
+// bracket expression, such as "a-zA-Z0-9._-". Characters and ranges are
+// taken literally, a "-" at the start or end is a character of its own.
+// The bracket characters "[]^\" are not allowed so that nothing is read as
+// a regexp.
+func parseNameChars(chars string) (set charSet, err error) {
+	if chars == "" {
+		return nil, errors.New("No characters")
+	}
+	if strings.ContainsAny(chars, "[]^\\") {
+		return nil, errors.New("Only characters and ranges such as a-z are allowed, not [ ] ^ or \\")
+	}
+
+	runes := []rune(chars)
+	for i := 0; i < len(runes); i++ {
+		r := charRange{runes[i], runes[i]}
+		if i+2 < len(runes) && runes[i+1] == '-' {
+			r.hi = runes[i+2]
+			if r.hi < r.lo {
+				return nil, fmt.Errorf("Invalid range %c-%c", r.lo, r.hi)
+			}
+			i += 2
+		}
+		set = append(set, r)
+	}
+
+	return set, nil
+}
+
+// contains returns true if c is in the set.
+func (s charSet) contains(c rune) bool {
+	for _, r := range s {
+		if c >= r.lo && c <= r.hi {
+			return true
+		}
+	}
+
+	return len(s) == 0
+}
+
+// newNameRules returns the name rules set in config.
+func newNameRules(config Config) (rules nameRules, err error) {
+	rules.normalize = config.NormalizeNames
+	rules.maxLength = config.MaxNameLength
+	if config.AllowedNameChars != "" {
+		if rules.allowed, err = parseNameChars(config.AllowedNameChars); err != nil {
+			return rules, err
+		}
+	}
+
+	return rules, nil
+}
+
+// clean returns name changed to follow the rules. Names are normalized to
+// Unicode NFC with control characters removed, disallowed characters are
+// replaced with "_" and long names are shortened, keeping the extension.
+func (r nameRules) clean(name string) (string, error) {
+	if r.normalize {
+		name = strings.Map(func(c rune) rune {
+			if unicode.IsControl(c) {
+				return -1
+			}
+			return c
+		}, norm.NFC.String(name))
+	}
+
+	if len(r.allowed) != 0 {
+		name = strings.Map(func(c rune) rune {
+			if !r.allowed.contains(c) {
+				return '_'
+			}
+			return c
+		}, name)
+	}
+
+	if r.maxLength != 0 && len(name) > r.maxLength {
+		ext := filepath.Ext(name)
+		if len(ext) >= r.maxLength {
+			ext = ""
+		}
+		name = truncateUTF8(strings.TrimSuffix(name, ext), r.maxLength-len(ext)) + ext
+	}
+
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") || reservedName(name) {
+		return "", errInvalidName
+	}
+
+	return name, nil
+}
+
+// reservedName returns true if name is used by scpdrop for its own files, so
+// an upload with that name would be taken for one of them.
+func reservedName(name string) bool {
+	return isCompressedMarker(name) || isPartial(name)
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// numberedName returns name with a number added before the extension, as in
+// "report (1).pdf".
+func numberedName(name string, i int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext)
+}
+
+// versionedName returns name with a timestamp added before the extension, as
+// in "report.20171231-235959.pdf".
+func versionedName(name string, t time.Time) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + t.Format("20060102-150405") + ext
+}
+
+// freeName returns the first of name and the numbered variants of name that,
+// with suffix added, does not exist in root.
+func freeName(root *os.Root, name string, suffix string) string {
+	free := name
+	for i := 1; ; i++ {
+		if _, err := root.Lstat(free + suffix); os.IsNotExist(err) {
+			return free
+		}
+		free = numberedName(name, i)
+	}
+}
+
+// resolveCollision applies policy to an upload stored as name+suffix in root
+// and returns the name the upload is stored as. With the version policy the
+// existing file and its compression marker are kept under a name with its
+// modification time.
+func resolveCollision(root *os.Root, policy string, name string, suffix string) (string, error) {
+	fi, err := root.Lstat(name + suffix)
+	if os.IsNotExist(err) {
+		return name, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	switch policy {
+	case collisionReject:
+		return "", errFileExists
+	case collisionRename:
+		return freeName(root, name, suffix), nil
+	case collisionVersion:
+		if !fi.Mode().IsRegular() {
+			return "", errFileExists
+		}
+		old := freeName(root, versionedName(name, fi.ModTime()), suffix)
+		if err = root.Rename(name+suffix, old+suffix); err != nil {
+			return "", err
+		}
+		// The compression marker stays with the kept version.
+		if err = root.Rename(compressedMarker(name+suffix), compressedMarker(old+suffix)); err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		logInfo.Printf("Kept previous version of %s as %s\n", name+suffix, old+suffix)
+		return name, nil
+	default:
+		return name, nil
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNameRulesClean(t *testing.T) {
+	allowed, _ := parseNameChars("a-zA-Z0-9._-")
+	normalize := nameRules{normalize: true}
+	charset := nameRules{allowed: allowed}
+	short := nameRules{maxLength: 10}
+
+	type testStruct struct {
+		rules nameRules
+		name  string
+		clean string
+		err   error
+	}
+
+	tests := make(map[string]testStruct)
+	tests["unchanged"] = testStruct{nameRules{}, "résumé 1.pdf", "résumé 1.pdf", nil}
+	tests["nfc"] = testStruct{normalize, "résumé.pdf", "résumé.pdf", nil}
+	tests["control"] = testStruct{normalize, "bad\x1b[31mname\t.txt", "bad[31mname.txt", nil}
+	tests["only control"] = testStruct{normalize, "\x07", "", errInvalidName}
+	tests["charset"] = testStruct{charset, "my report (final).pdf", "my_report__final_.pdf", nil}
+	tests["charset dots"] = testStruct{charset, "..", "", errInvalidName}
+	tests["long"] = testStruct{short, "averylongname.pdf", "averyl.pdf", nil}
+	tests["long ext"] = testStruct{short, "a.verylongextension", "a.verylong", nil}
+	tests["long utf8"] = testStruct{short, "åäöåäö.txt", "åäö.txt", nil}
+	tests["marker"] = testStruct{nameRules{}, ".file.gz.scpdrop", "", errInvalidName}
+	tests["partial"] = testStruct{nameRules{}, ".file.part-1484388000000000000", "", errInvalidName}
+
+	for name, testIn := range tests {
+		clean, err := testIn.rules.clean(testIn.name)
+		if err != testIn.err {
+			t.Errorf("Test %s error (%v) does not match expected (%v)\n", name, err, testIn.err)
+		}
+		if clean != testIn.clean {
+			t.Errorf("Test %s name (%q) does not match expected (%q)\n", name, clean, testIn.clean)
+		}
+	}
+}
+
+func TestParseNameChars(t *testing.T) {
+	tests := make(map[string]string)
+	tests["a-z"] = "ab_c_"
+	tests["-a-c"] = "ab-c_"
+	tests["a-c|."] = "ab_c."
+	tests["+-.a-z"] = "ab-c."
+
+	for chars, expected := range tests {
+		allowed, err := parseNameChars(chars)
+		if err != nil {
+			t.Errorf("Characters %q not parsed: %s\n", chars, err)
+			continue
+		}
+		if clean, _ := (nameRules{allowed: allowed}).clean("ab-c."); clean != expected {
+			t.Errorf("Name cleaned with %q (%q) does not match expected (%q)\n", chars, clean, expected)
+		}
+	}
+
+	for _, chars := range []string{"", "a-z]|x", "^a-z", "[:alpha:]", `a-z\d`, "z-a"} {
+		if _, err := parseNameChars(chars); err == nil {
+			t.Errorf("Characters %q did not fail\n", chars)
+		}
+	}
+}
+
+func TestResolveCollision(t *testing.T) {
+	initLog("-", "none")
+
+	type testStruct struct {
+		stored string
+		err    error
+		files  []string
+	}
+
+	tests := make(map[string]testStruct)
+	tests[collisionOverwrite] = testStruct{"report.pdf", nil, []string{"report (1).pdf", "report.pdf"}}
+	tests[collisionReject] = testStruct{"", errFileExists, []string{"report (1).pdf", "report.pdf"}}
+	tests[collisionRename] = testStruct{"report (2).pdf", nil, []string{"report (1).pdf", "report.pdf"}}
+	tests[collisionVersion] = testStruct{"report.pdf", nil, []string{"report (1).pdf", "report.20170102-030405.pdf"}}
+
+	for policy, expected := range tests {
+		dir, err := ioutil.TempDir("", "scpdropNamesTest")
+		if err != nil {
+			t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+		}
+		for _, f := range []string{"report.pdf", "report (1).pdf"} {
+			ioutil.WriteFile(filepath.Join(dir, f), []byte("data"), 0600)
+		}
+		mtime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.Local)
+		os.Chtimes(filepath.Join(dir, "report.pdf"), mtime, mtime)
+
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			t.Fatalf("FATAL - Unable to open root: %s\n", err)
+		}
+		stored, err := resolveCollision(root, policy, "report.pdf", "")
+		root.Close()
+
+		if err != expected.err || stored != expected.stored {
+			t.Errorf("Policy %s stored (%q, %v) does not match expected (%q, %v)\n", policy, stored, err,
+				expected.stored, expected.err)
+		}
+
+		var files []string
+		entries, _ := ioutil.ReadDir(dir)
+		for _, e := range entries {
+			files = append(files, e.Name())
+		}
+		sort.Strings(files)
+		if strings.Join(files, ",") != strings.Join(expected.files, ",") {
+			t.Errorf("Policy %s files (%q) does not match expected (%q)\n", policy, files, expected.files)
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResolveCollisionMarker(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropNamesTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to open root: %s\n", err)
+	}
+	defer root.Close()
+
+	root.WriteFile("report.pdf.gz", []byte("compressed"), 0600)
+	if err = markCompressed(root, "report.pdf.gz", 100); err != nil {
+		t.Fatalf("FATAL - Unable to mark file: %s\n", err)
+	}
+	mtime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.Local)
+	root.Chtimes("report.pdf.gz", mtime, mtime)
+
+	if _, err = resolveCollision(root, collisionVersion, "report.pdf", ".gz"); err != nil {
+		t.Fatalf("FATAL - Unable to keep version: %s\n", err)
+	}
+
+	fi, err := root.Stat("report.20170102-030405.pdf.gz")
+	if err != nil {
+		t.Fatalf("FATAL - Previous version not kept: %s\n", err)
+	}
+	if size, ok := compressedSize(root, "report.20170102-030405.pdf.gz", fi); !ok || size != 100 {
+		t.Errorf("Size of previous version (%d, %v) does not match expected (100, true)\n", size, ok)
+	}
+	if _, err = root.Stat(compressedMarker("report.pdf.gz")); !os.IsNotExist(err) {
+		t.Errorf("Marker of previous version was not moved (%v)\n", err)
+	}
+}
+
+func TestScpSinkCollision(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropNamesTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := "C0644 4 file.txt\ndata\x00C0644 4 file.txt\ndata\x00"
+
+	sink := newScpSink(bytes.NewBufferString(input), ioutil.Discard, dir)
+	sink.collision = collisionRename
+	sink.receive(".", false)
+	if strings.Join(sink.files, ",") != "file.txt,file (1).txt" {
+		t.Errorf("Renamed files (%q) does not match expected (%q)\n", sink.files, "file.txt,file (1).txt")
+	}
+
+	var reply bytes.Buffer
+	sink = newScpSink(bytes.NewBufferString(input), &reply, dir)
+	sink.collision = collisionReject
+	sink.receive(".", false)
+	expected := "\x00\x00\x01scp: file.txt: " + errFileExists.Error() + "\n\x00\x01scp: file.txt: " + errFileExists.Error() + "\n"
+	if len(sink.files) != 0 || reply.String() != expected {
+		t.Errorf("Rejected files (%q, %q) does not match expected (none, %q)\n", sink.files, reply.String(), expected)
+	}
+}
+
+func TestParseConfigNames(t *testing.T) {
+	c, err := parseConfig([]byte("Collision version\nNormalizeNames yes\nMaxNameLength 100\nAllowedNameChars a-z0-9._-\n"))
+	if err != nil {
+		t.Fatalf("Unable to parse config: %s\n", err)
+	}
+	if c.Collision != collisionVersion || !c.NormalizeNames || c.MaxNameLength != 100 || c.AllowedNameChars != "a-z0-9._-" {
+		t.Errorf("Config (%+v) does not match expected\n", c)
+	}
+	for _, line := range []string{"Collision keep", "NormalizeNames maybe", "MaxNameLength 0", "MaxNameLength 300", "AllowedNameChars a-z][", "AllowedNameChars a-z^", "AllowedNameChars z-a"} {
+		if _, err := parseConfig([]byte(line + "\n")); err == nil {
+			t.Errorf("Config line %q didnt fail as expected\n", line)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	_ "embed"
+	"strings"
+)
+
+// effLargeWordlist is EFF's large word list for passphrases, one
+// "<dice roll>\t<word>" line for each of the 7776 rolls of five dice.
+// https://www.eff.org/deeplinks/2016/07/new-wordlists-random-passphrases
+//
+//go:embed eff_large_wordlist.txt
+var effLargeWordlist string
+
+// passphraseSeparator separates the words of a passphrase.
+const passphraseSeparator = "-"
+
+// passphraseWords are the words of the embedded word list.
+var passphraseWords = parseWordlist(effLargeWordlist)
+
+// parseWordlist returns the words of a diceware word list. The few words
+// containing the separator, such as t-shirt, are left out so passphrases
+// always split into their words.
+func parseWordlist(list string) (words []string) {
+	for _, line := range strings.Split(list, "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && !strings.Contains(fields[1], passphraseSeparator) {
+			words = append(words, fields[1])
+		}
+	}
+
+	return words
+}
+
+// randPassphrase creates a passphrase of n random words from the word list
+// separated by dashes. Each word adds almost 13 bits of entropy.
+func randPassphrase(n int) []byte {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = passphraseWords[randIndex(len(passphraseWords))]
+	}
+
+	return []byte(strings.Join(words, passphraseSeparator))
+}
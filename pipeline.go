@@ -0,0 +1,353 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Failure policies for pipeline stages.
+const (
+	policyAbort      = "abort"
+	policyContinue   = "continue"
+	policyQuarantine = "quarantine"
+)
+
+// Modes for running the pipeline, once per uploaded file or once per session
+// with all uploaded files as arguments.
+const (
+	cmdModeFile    = "file"
+	cmdModeSession = "session"
+)
+
+// Stage is a named post-upload command in the processing pipeline.
+type Stage struct {
+	Name    string
+	Cmd     []string
+	Timeout time.Duration
+	Env     []string
+	Policy  string
+}
+
+// stageResult is the outcome of running a stage on a file.
+type stageResult struct {
+	Time     time.Time `json:"time"`
+	Session  uint64    `json:"session"`
+	User     string    `json:"user"`
+	File     string    `json:"file,omitempty"`
+	Files    []string  `json:"files,omitempty"`
+	Stage    string    `json:"stage"`
+	Status   string    `json:"status"`
+	ExitCode int       `json:"exit_code"`
+	Duration string    `json:"duration"`
+	Action   string    `json:"action,omitempty"`
+}
+
+// findStage returns the index of the named stage or -1 if it does not exist.
+func findStage(stages []Stage, name string) int {
+	for i, s := range stages {
+		if s.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// pipelineStages returns the stages to run on uploaded files. A configured
+// Cmd runs first as a stage named "cmd" with the continue policy.
+//
+// A non empty userCmd replaces the global pipeline. It is either a command
+// line, run like Cmd, or "stages=" followed by a comma separated list of
+// stage names from the config.
+func pipelineStages(config Config, userCmd string) (stages []Stage, err error) {
+	if userCmd != "" {
+		if !strings.HasPrefix(userCmd, "stages=") {
+			cmd := parseCmdLine(userCmd)
+			if len(cmd) == 0 {
+				return nil, fmt.Errorf("Empty command")
+			}
+			return []Stage{{Name: "cmd", Cmd: cmd, Policy: policyContinue}}, nil
+		}
+
+		for _, name := range strings.Split(strings.TrimPrefix(userCmd, "stages="), ",") {
+			i := findStage(config.Stages, strings.TrimSpace(name))
+			if i == -1 {
+				return nil, fmt.Errorf("Unknown stage %q", name)
+			}
+			stages = append(stages, config.Stages[i])
+		}
+
+		return stages, nil
+	}
+
+	if len(config.Cmd) != 0 {
+		stages = append(stages, Stage{Name: "cmd", Cmd: config.Cmd, Policy: policyContinue})
+	}
+
+	return append(stages, config.Stages...), nil
+}
+
+// checkUserStages returns an error if a user in the passwd file or the keys
+// directory runs stages that are not in config.
+func checkUserStages(config Config) error {
+	users, err := listUsers(config.PasswdFile)
+	if err != nil {
+		return err
+	}
+	for _, userInfo := range users {
+		if _, err = pipelineStages(config, string(userInfo.Cmd)); err != nil {
+			return fmt.Errorf("User %s: %s", userInfo.Username, err)
+		}
+	}
+
+	return keyUsers(config.KeysDir, func(user string, privs []string) error {
+		if len(privs) < 6 {
+			return nil
+		}
+		if _, err := pipelineStages(config, privs[5]); err != nil {
+			return fmt.Errorf("Key user %s: %s", user, err)
+		}
+		return nil
+	})
+}
+
+// pipelineEnv returns the environment variables describing the upload that
+// are passed to every stage. The size and checksum are only set when the
+// pipeline runs on a single file.
+func pipelineEnv(result sessionResult, files []string) []string {
+	env := []string{
+		"SCPDROP_USER=" + result.User,
+		"SCPDROP_REMOTE_ADDR=" + result.RemoteAddr,
+		"SCPDROP_SESSION_ID=" + strconv.FormatUint(result.ID, 10),
+		"SCPDROP_USER_DIR=" + result.Dir,
+		"SCPDROP_FILES=" + strings.Join(result.Files, "\n"),
+	}
+
+	if len(files) == 1 {
+		size, sum, err := fileChecksum(files[0])
+		if err != nil {
+			logError.Printf("Unable to checksum %s: %s\n", files[0], err)
+		} else {
+			env = append(env, "SCPDROP_FILE_SIZE="+strconv.FormatInt(size, 10), "SCPDROP_SHA256="+sum)
+		}
+	}
+
+	return env
+}
+
+// runStage runs a single stage on files. The stage is killed if ctx is done.
+func runStage(ctx context.Context, stage Stage, files []string, env []string) (status string, exitCode int) {
+	if stage.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, stage.Timeout)
+		defer cancel()
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+
+	args := append(append([]string(nil), stage.Cmd[1:]...), files...)
+	file := strings.Join(files, " ")
+
+	cmd := exec.CommandContext(ctx, stage.Cmd[0], args...)
+	cmd.Env = append(append(os.Environ(), env...), stage.Env...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Children of a killed stage may keep the output pipes open.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+
+	if stdout.Len() > 0 {
+		logInfo.Printf("Stage %s STDOUT: %s\n", stage.Name, stdout.String())
+	}
+	if stderr.Len() > 0 {
+		logError.Printf("Stage %s STDERR: %s\n", stage.Name, stderr.String())
+	}
+
+	switch {
+	case err == nil:
+		return "ok", 0
+	case ctx.Err() != nil:
+		logError.Printf("Stage %s on file %s stopped: %s\n", stage.Name, file, ctx.Err())
+		return "timeout", -1
+	default:
+		logError.Printf("Unable to run stage %s \"%q\" on file %s: %s\n", stage.Name, cmd.Args, file, err)
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "failed", exitErr.ExitCode()
+		}
+		return "failed", -1
+	}
+}
+
+// runPipeline runs all stages in order on uploaded files and applies the
+// failure policy of a failing stage. files is a single file, or all files of
+// the session when the pipeline runs once per session. The results are
+// logged and written to the audit file if one is configured. Remaining
+// stages are skipped once ctx is done.
+func runPipeline(ctx context.Context, config Config, result sessionResult, files []string) (results []stageResult) {
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, filepath.Join(result.Dir, f))
+	}
+	name := strings.Join(paths, " ")
+
+	// newResult creates a result for a stage with the files it ran on.
+	newResult := func(stage string) stageResult {
+		r := stageResult{Time: time.Now(), Session: result.ID, User: result.User, Stage: stage}
+		if len(files) == 1 {
+			r.File = files[0]
+		} else {
+			r.Files = files
+		}
+		return r
+	}
+
+	stages, err := pipelineStages(config, result.Cmd)
+	if err != nil {
+		logError.Printf("Pipeline for %s not run: %s\n", name, err)
+		r := newResult("config")
+		r.Status, r.ExitCode, r.Action = "failed", -1, policyAbort
+		writeAudit(config.AuditFile, r)
+		return append(results, r)
+	}
+
+	if err = checkUploads(result.Dir, files); err != nil {
+		logError.Printf("Pipeline for %s not run: %s\n", name, err)
+		r := newResult("confine")
+		r.Status, r.ExitCode, r.Action = "failed", -1, policyAbort
+		writeAudit(config.AuditFile, r)
+		return append(results, r)
+	}
+
+	env := pipelineEnv(result, paths)
+
+	for _, stage := range stages {
+		if ctx.Err() != nil {
+			logError.Printf("Pipeline for %s stopped before stage %s: %s\n", name, stage.Name, ctx.Err())
+			r := newResult(stage.Name)
+			r.Status, r.ExitCode, r.Action = "timeout", -1, policyAbort
+			writeAudit(config.AuditFile, r)
+			return append(results, r)
+		}
+
+		r := newResult(stage.Name)
+		r.Status, r.ExitCode = runStage(ctx, stage, paths, env)
+		r.Duration = time.Since(r.Time).String()
+
+		if r.Status != "ok" {
+			metricCmdFailures.Inc()
+			r.Action = stage.Policy
+			if stage.Policy == policyQuarantine {
+				for _, file := range paths {
+					if err := quarantine(file, config.QuarantineDir); err != nil {
+						logError.Printf("Unable to quarantine %s: %s\n", file, err)
+						r.Action = policyAbort
+					}
+				}
+			}
+		}
+
+		logInfo.Printf("Stage %s on %s: %s (exit %d, %s) %s\n", r.Stage, name, r.Status, r.ExitCode, r.Duration, r.Action)
+		writeAudit(config.AuditFile, r)
+		results = append(results, r)
+
+		if r.Status != "ok" && stage.Policy != policyContinue {
+			break
+		}
+	}
+
+	return results
+}
+
+// checkUploads makes sure every file, relative to dir, is still a regular
+// file inside dir before it is handed to a stage. An upload replaced by a
+// symlink could otherwise make a stage read or change any file.
+func checkUploads(dir string, files []string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	for _, f := range files {
+		fi, err := root.Lstat(removeSepPrefix(filepath.FromSlash(f)))
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", f)
+		}
+	}
+
+	return nil
+}
+
+// quarantine moves a file into the quarantine directory. The name is prefixed
+// with a timestamp so files with the same name do not overwrite each other.
+func quarantine(file string, quarantineDir string) error {
+	return quarantineAs(file, filepath.Base(file), quarantineDir)
+}
+
+// quarantineAs moves a file into the quarantine directory under name.
+func quarantineAs(file string, name string, quarantineDir string) error {
+	if quarantineDir == "" {
+		return fmt.Errorf("No QuarantineDir configured")
+	}
+
+	dst := filepath.Join(quarantineDir, fmt.Sprintf("%d-%s", time.Now().UnixNano(), name))
+	if err := os.Rename(file, dst); err != nil {
+		return err
+	}
+	logWarning.Printf("Quarantined %s as %s\n", file, dst)
+
+	return nil
+}
+
+// auditMu serializes writes to the audit file.
+var auditMu sync.Mutex
+
+// writeAudit appends v as a JSON line to the audit file. Nothing is written
+// if no audit file is configured.
+func writeAudit(auditFile string, v interface{}) {
+	if auditFile == "" {
+		return
+	}
+
+	line, err := json.Marshal(v)
+	if err != nil {
+		logError.Printf("Unable to encode audit entry: %s\n", err)
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	if err = appendToFile(auditFile, append(line, '\n')); err != nil {
+		logError.Printf("Unable to write audit file: %s\n", err)
+	}
+}
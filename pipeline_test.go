@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParseConfigStages(t *testing.T) {
+	conf := []byte(`Cmd sha256sum
+Stage scan /bin/sh -c "exit 1"
+StageTimeout scan 10s
+StageEnv scan SCAN_MODE=full
+StagePolicy scan quarantine
+Stage compress gzip -k
+QuarantineDir /tmp/quarantine
+AuditFile /tmp/audit.log
+`)
+
+	config, err := parseConfig(conf)
+	if err != nil {
+		t.Fatalf("Unable to parse config: %s\n", err)
+	}
+
+	stages, err := pipelineStages(config, "")
+	if err != nil {
+		t.Fatalf("Unable to get stages: %s\n", err)
+	}
+	if len(stages) != 3 {
+		t.Fatalf("Number of stages (%d) does not match expected (3)\n", len(stages))
+	}
+
+	expectedNames := []string{"cmd", "scan", "compress"}
+	expectedPolicies := []string{policyContinue, policyQuarantine, policyAbort}
+	for i, stage := range stages {
+		if stage.Name != expectedNames[i] {
+			t.Errorf("Stage %d name (%s) does not match expected (%s)\n", i, stage.Name, expectedNames[i])
+		}
+		if stage.Policy != expectedPolicies[i] {
+			t.Errorf("Stage %d policy (%s) does not match expected (%s)\n", i, stage.Policy, expectedPolicies[i])
+		}
+	}
+	if stages[1].Timeout != 10*time.Second || len(stages[1].Env) != 1 || stages[1].Env[0] != "SCAN_MODE=full" {
+		t.Errorf("Unexpected scan stage %+v\n", stages[1])
+	}
+
+	var testIn [][]byte
+	testIn = append(testIn, []byte("StageTimeout scan 10s\n"))
+	testIn = append(testIn, []byte("Stage scan clamscan\nStage scan clamscan\n"))
+	testIn = append(testIn, []byte("Stage scan clamscan\nStagePolicy scan ignore\n"))
+	testIn = append(testIn, []byte("Stage scan clamscan\nStageEnv scan NOEQUALS\n"))
+	testIn = append(testIn, []byte("Stage scan\n"))
+	testIn = append(testIn, []byte("Stage scan \v\n"))
+
+	for i, confFile := range testIn {
+		if _, err := parseConfig(confFile); err == nil {
+			t.Errorf("Test%d didnt fail as expected\n", i)
+		}
+	}
+}
+
+func TestPipelineStagesUserCmd(t *testing.T) {
+	config := Config{Cmd: []string{"global"}, Stages: []Stage{{Name: "scan", Cmd: []string{"clamscan"}, Policy: policyQuarantine},
+		{Name: "compress", Cmd: []string{"gzip"}, Policy: policyAbort}}}
+
+	type testStruct struct {
+		names []string
+		err   bool
+	}
+
+	tests := make(map[string]testStruct)
+	tests[""] = testStruct{[]string{"cmd", "scan", "compress"}, false}
+	tests["mycmd -a"] = testStruct{[]string{"cmd"}, false}
+	tests["stages=compress"] = testStruct{[]string{"compress"}, false}
+	tests["stages=compress,scan"] = testStruct{[]string{"compress", "scan"}, false}
+	tests["stages=scan,missing"] = testStruct{nil, true}
+	tests[" \t"] = testStruct{nil, true}
+
+	for userCmd, expected := range tests {
+		stages, err := pipelineStages(config, userCmd)
+		if (err != nil) != expected.err {
+			t.Errorf("Error for %q (%v) does not match expected (%v)\n", userCmd, err, expected.err)
+			continue
+		}
+
+		var names []string
+		for _, stage := range stages {
+			names = append(names, stage.Name)
+		}
+		if strings.Join(names, ",") != strings.Join(expected.names, ",") {
+			t.Errorf("Stages for %q (%v) does not match expected (%v)\n", userCmd, names, expected.names)
+		}
+	}
+
+	stages, _ := pipelineStages(config, "mycmd -a")
+	if strings.Join(stages[0].Cmd, " ") != "mycmd -a" {
+		t.Errorf("User cmd (%q) does not match expected (%q)\n", stages[0].Cmd, "mycmd -a")
+	}
+}
+
+func TestCheckUserStages(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropStagesTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keysDir := filepath.Join(dir, "keys")
+	os.Mkdir(keysDir, 0750)
+	config := Config{PasswdFile: filepath.Join(dir, "passwd"), KeysDir: addSepSuffix(keysDir),
+		Stages: []Stage{{Name: "scan", Cmd: []string{"true"}}}}
+
+	ioutil.WriteFile(config.PasswdFile, []byte("user1:$0$pass:w:/tmp/:0::t:stages=scan\n"), 0644)
+	key, _ := generateRSAPrivateKeySigner(1024)
+	keyLine := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey())))
+	ioutil.WriteFile(filepath.Join(keysDir, "user2"), []byte(keyLine+" w:/tmp/:0::p:stages=scan\n"), 0644)
+	if err = checkUserStages(config); err != nil {
+		t.Errorf("Configured stages not accepted: %s\n", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(keysDir, "user2"), []byte(keyLine+" w:/tmp/:0::p:stages=scna\n"), 0644)
+	if err = checkUserStages(config); err == nil {
+		t.Errorf("Unknown stage of key user not rejected\n")
+	}
+	os.Remove(filepath.Join(keysDir, "user2"))
+
+	appendToFile(config.PasswdFile, []byte("user3:$0$pass:w:/tmp/:0::t:stages=scan,missing\n"))
+	if err = checkUserStages(config); err == nil {
+		t.Errorf("Unknown stage of passwd user not rejected\n")
+	}
+
+	req := adminUserRequest{Username: "user4", Password: "pass", Privileges: "w", Cmd: "stages=missing"}
+	if _, err = req.userInfo(config); err == nil {
+		t.Errorf("User with unknown stage was created\n")
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropPipelineTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	quarantineDir := filepath.Join(dir, "quarantine")
+	os.Mkdir(quarantineDir, 0750)
+	auditFile := filepath.Join(dir, "audit.log")
+
+	type testStruct struct {
+		statuses    []string
+		quarantined bool
+	}
+
+	ok := Stage{Name: "ok", Cmd: []string{"/bin/sh", "-c", "test -f \"$0\""}, Policy: policyAbort}
+	fail := Stage{Name: "fail", Cmd: []string{"/bin/sh", "-c", "exit 3"}, Policy: policyAbort}
+	env := Stage{Name: "env", Cmd: []string{"/bin/sh", "-c", "test \"$MODE\" = full"}, Env: []string{"MODE=full"}, Policy: policyAbort}
+	slow := Stage{Name: "slow", Cmd: []string{"/bin/sh", "-c", "exec sleep 5"}, Timeout: 50 * time.Millisecond, Policy: policyAbort}
+
+	failContinue := fail
+	failContinue.Policy = policyContinue
+	failQuarantine := fail
+	failQuarantine.Policy = policyQuarantine
+
+	tests := make(map[*[]Stage]testStruct)
+	tests[&[]Stage{ok, env}] = testStruct{[]string{"ok", "ok"}, false}
+	tests[&[]Stage{fail, ok}] = testStruct{[]string{"failed"}, false}
+	tests[&[]Stage{failContinue, ok}] = testStruct{[]string{"failed", "ok"}, false}
+	tests[&[]Stage{slow, ok}] = testStruct{[]string{"timeout"}, false}
+	tests[&[]Stage{failQuarantine, ok}] = testStruct{[]string{"failed"}, true}
+
+	for testIn, expectedOut := range tests {
+		if err = ioutil.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+			t.Fatalf("FATAL - Unable to create upload: %s\n", err)
+		}
+
+		config := Config{Stages: *testIn, QuarantineDir: quarantineDir, AuditFile: auditFile}
+		results := runPipeline(context.Background(), config, sessionResult{ID: 1, User: "testy", Dir: dir}, []string{"file"})
+
+		if len(results) != len(expectedOut.statuses) {
+			t.Errorf("Number of results (%d) does not match expected (%d)\n", len(results), len(expectedOut.statuses))
+			continue
+		}
+		for i, r := range results {
+			if r.Status != expectedOut.statuses[i] {
+				t.Errorf("Stage %s status (%s) does not match expected (%s)\n", r.Stage, r.Status, expectedOut.statuses[i])
+			}
+		}
+
+		_, err = os.Stat(filepath.Join(dir, "file"))
+		if expectedOut.quarantined != os.IsNotExist(err) {
+			t.Errorf("File quarantined (%v) does not match expected (%v)\n", os.IsNotExist(err), expectedOut.quarantined)
+		}
+	}
+
+	audit, err := ioutil.ReadFile(auditFile)
+	if err != nil {
+		t.Fatalf("Unable to read audit file: %s\n", err)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(bytes.NewReader(audit))
+	for scanner.Scan() {
+		var r stageResult
+		if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Errorf("Invalid audit line %q: %s\n", scanner.Text(), err)
+		}
+		lines++
+	}
+	if lines != 7 {
+		t.Errorf("Number of audit lines (%d) does not match expected (7)\n", lines)
+	}
+}
+
+func TestPipelineEnv(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropPipelineTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"one", "two"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, f), []byte("data"), 0644); err != nil {
+			t.Fatalf("FATAL - Unable to create upload: %s\n", err)
+		}
+	}
+
+	result := sessionResult{ID: 7, User: "testy", RemoteAddr: "127.0.0.1:1234", Dir: dir, Files: []string{"one", "two"}}
+	sum := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+
+	type testStruct struct {
+		files []string
+		check string
+	}
+
+	tests := make(map[string]testStruct)
+	tests["file"] = testStruct{[]string{"one"}, `test "$SCPDROP_USER" = testy -a "$SCPDROP_REMOTE_ADDR" = 127.0.0.1:1234 ` +
+		`-a "$SCPDROP_SESSION_ID" = 7 -a "$SCPDROP_USER_DIR" = "` + dir + `" -a "$SCPDROP_FILE_SIZE" = 4 ` +
+		`-a "$SCPDROP_SHA256" = ` + sum + ` -a "$SCPDROP_FILES" = "$(printf 'one\ntwo')"`}
+	tests["session"] = testStruct{[]string{"one", "two"}, `test "$#" = 1 -a "$0" = "` + filepath.Join(dir, "one") +
+		`" -a "$1" = "` + filepath.Join(dir, "two") + `" -a -z "$SCPDROP_FILE_SIZE"`}
+
+	for name, testIn := range tests {
+		config := Config{Stages: []Stage{{Name: "check", Cmd: []string{"/bin/sh", "-c", testIn.check}, Policy: policyAbort}}}
+		results := runPipeline(context.Background(), config, result, testIn.files)
+
+		if len(results) != 1 || results[0].Status != "ok" {
+			t.Errorf("Test %s results (%+v) does not match expected (ok)\n", name, results)
+		}
+	}
+}
+
+func TestCheckUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scpdropPipelineTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0750)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0600)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "link"))
+
+	tests := make(map[string]bool)
+	tests["sub/file"] = true
+	tests["/sub/file"] = true
+	tests["sub"] = false
+	tests["link"] = false
+	tests["missing"] = false
+	tests["../etc/passwd"] = false
+
+	for file, expected := range tests {
+		if err = checkUploads(dir, []string{file}); (err == nil) != expected {
+			t.Errorf("File %s allowed (%v) does not match expected (%v): %v\n", file, err == nil, expected, err)
+		}
+	}
+}
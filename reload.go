@@ -0,0 +1,155 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// diffConfig returns a human readable line for every setting that differs
+// between two configs.
+func diffConfig(old Config, new Config) (diff []string) {
+	o := reflect.ValueOf(old)
+	n := reflect.ValueOf(new)
+
+	for i := 0; i < o.NumField(); i++ {
+		if name := o.Type().Field(i).Name; strings.HasSuffix(name, "Token") || strings.HasSuffix(name, "Secret") {
+			if o.Field(i).String() != n.Field(i).String() {
+				diff = append(diff, fmt.Sprintf("%s: changed", o.Type().Field(i).Name))
+			}
+			continue
+		}
+		if !reflect.DeepEqual(o.Field(i).Interface(), n.Field(i).Interface()) {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", o.Type().Field(i).Name,
+				o.Field(i).Interface(), n.Field(i).Interface()))
+		}
+	}
+
+	return diff
+}
+
+// Reload validates a new config and swaps it in for new connections.
+// Connections that are already established keep the config they started with.
+// The listen address can not be changed without a restart.
+func (s *Server) Reload(config Config) error {
+	if err := validateServerConfig(config); err != nil {
+		return err
+	}
+
+	old, _ := s.currentConfig()
+
+	if config.Listen != old.Listen {
+		logWarning.Printf("Listen can not be changed without a restart, keeping %s\n", old.Listen)
+		config.Listen = old.Listen
+	}
+	if config.MetricsListen != old.MetricsListen {
+		logWarning.Printf("MetricsListen can not be changed without a restart, keeping %q\n", old.MetricsListen)
+		config.MetricsListen = old.MetricsListen
+	}
+	if config.QueueDir != old.QueueDir || config.Workers != old.Workers {
+		logWarning.Println("QueueDir and Workers can not be changed without a restart")
+		config.QueueDir = old.QueueDir
+		config.Workers = old.Workers
+	}
+	if config.AdminListen != old.AdminListen || config.AdminToken != old.AdminToken {
+		logWarning.Println("AdminListen and AdminToken can not be changed without a restart")
+		config.AdminListen = old.AdminListen
+		config.AdminToken = old.AdminToken
+	}
+
+	diff := diffConfig(old, config)
+	if len(diff) == 0 {
+		logInfo.Println("Config reloaded, nothing changed")
+		return nil
+	}
+
+	s.mu.Lock()
+	hostKey := s.hostKey
+	s.mu.Unlock()
+
+	if config.PrivateKey != old.PrivateKey {
+		var err error
+		if hostKey, err = loadHostKey(config); err != nil {
+			return err
+		}
+	}
+
+	if config.LogFile != old.LogFile && config.LogFile != "-" {
+		f, err := os.OpenFile(config.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			return fmt.Errorf("Unable to open log file: %s", err)
+		}
+		f.Close()
+	}
+
+	if config.LogFile != old.LogFile || config.LogLevel != old.LogLevel {
+		initLog(config.LogFile, config.LogLevel)
+	}
+
+	s.mu.Lock()
+	s.config = config
+	s.sshConfig = newSSHConfig(config, hostKey)
+	s.hostKey = hostKey
+	s.mu.Unlock()
+
+	for _, d := range diff {
+		logInfo.Printf("Config changed %s\n", d)
+	}
+
+	return nil
+}
+
+// watchFile sends on changed every time the modification time or size of a
+// file changes. The file is checked every interval until stop is closed.
+func watchFile(path string, interval time.Duration, changed chan<- struct{}, stop <-chan struct{}) {
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(path); err == nil {
+		lastMod = fi.ModTime()
+		lastSize = fi.Size()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			fi, err := os.Stat(path)
+			if err != nil {
+				logDebug.Printf("Unable to stat %s: %s\n", path, err)
+				continue
+			}
+
+			if fi.ModTime().Equal(lastMod) && fi.Size() == lastSize {
+				continue
+			}
+			lastMod = fi.ModTime()
+			lastSize = fi.Size()
+
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
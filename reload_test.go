@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	old := Config{Listen: ":2022", SharedDir: "/tmp/shared/", Cmd: []string{"gzip"}}
+
+	tests := make(map[string]Config)
+	tests[""] = Config{Listen: ":2022", SharedDir: "/tmp/shared/", Cmd: []string{"gzip"}}
+	tests["SharedDir: /tmp/shared/ -> /tmp/other/"] = Config{Listen: ":2022", SharedDir: "/tmp/other/", Cmd: []string{"gzip"}}
+	tests["Cmd: [gzip] -> [gpg -e]"] = Config{Listen: ":2022", SharedDir: "/tmp/shared/", Cmd: []string{"gpg", "-e"}}
+
+	for expectedOut, testIn := range tests {
+		diff := diffConfig(old, testIn)
+		if expectedOut == "" {
+			if len(diff) != 0 {
+				t.Errorf("Unexpected diff %q\n", diff)
+			}
+		} else if len(diff) != 1 || diff[0] != expectedOut {
+			t.Errorf("Diff (%q) does not match expected (%q)\n", diff, expectedOut)
+		}
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	initLog("-", "none")
+	config, cleanup := testServerConfig(t)
+	defer cleanup()
+
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create server: %s\n", err)
+	}
+
+	newConfig := config
+	newConfig.Listen = ":2033"
+	newConfig.SharedDir = "/tmp/shared/"
+	if err = server.Reload(newConfig); err != nil {
+		t.Errorf("Valid config not reloaded: %s\n", err)
+	}
+
+	current, _ := server.currentConfig()
+	if current.SharedDir != newConfig.SharedDir {
+		t.Errorf("SharedDir (%s) does not match expected (%s)\n", current.SharedDir, newConfig.SharedDir)
+	}
+	if current.Listen != config.Listen {
+		t.Errorf("Listen (%s) changed by reload, expected (%s)\n", current.Listen, config.Listen)
+	}
+
+	badConfig := newConfig
+	badConfig.UsersDir = "/nonexistent/scpdrop/users/"
+	if err = server.Reload(badConfig); err == nil {
+		t.Errorf("Invalid config reloaded\n")
+	}
+
+	current, _ = server.currentConfig()
+	if current.UsersDir != config.UsersDir {
+		t.Errorf("UsersDir (%s) changed by invalid reload, expected (%s)\n", current.UsersDir, config.UsersDir)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	initLog("-", "none")
+	dir, err := ioutil.TempDir("", "scpdropWatchTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	confFile := filepath.Join(dir, "scpdrop.conf")
+	if err = ioutil.WriteFile(confFile, []byte("Listen :2022\n"), 0644); err != nil {
+		t.Fatalf("FATAL - Unable to create config file: %s\n", err)
+	}
+
+	changed := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go watchFile(confFile, 10*time.Millisecond, changed, stop)
+
+	select {
+	case <-changed:
+		t.Errorf("Change reported for unmodified file\n")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err = ioutil.WriteFile(confFile, []byte("Listen :2022\nLogLevel debug\n"), 0644); err != nil {
+		t.Fatalf("FATAL - Unable to update config file: %s\n", err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Errorf("No change reported for modified file\n")
+	}
+}
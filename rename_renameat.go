@@ -0,0 +1,40 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameIntoRoot moves the file oldpath to name below root. The directory of
+// name is opened beneath root, so no symlink can move the file elsewhere.
+func renameIntoRoot(oldpath string, root *os.Root, name string) error {
+	dir, err := root.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	if err = unix.Renameat(unix.AT_FDCWD, oldpath, int(dir.Fd()), filepath.Base(name)); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// errors returned when parsing an scp command
+var (
+	errUnterminatedQuote = errors.New("Unterminated quote in command")
+	errScpMode           = errors.New("Exactly one of -t and -f is required")
+	errManyTargets       = errors.New("Only one target allowed for uploads")
+)
+
+// scpCommand is a parsed remote scp command such as "scp -r -t -- dir".
+type scpCommand struct {
+	Upload    bool // -t
+	Download  bool // -f
+	Recursive bool // -r
+	DirOnly   bool // -d
+	Preserve  bool // -p
+	Verbose   bool // -v
+	Quiet     bool // -q
+	Paths     []string
+}
+
+// splitCommand splits a command line into words the way a shell does for
+// quoting. Single quotes, double quotes and backslash escapes are handled
+// and runs of spaces separate words. Nothing else is expanded.
+func splitCommand(command string) (words []string, err error) {
+	var word []rune
+	inWord := false
+	quote := rune(0)
+	escaped := false
+
+	for _, c := range command {
+		switch {
+		case escaped:
+			word = append(word, c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word = append(word, c)
+			}
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else if c == '\\' {
+				escaped = true
+			} else {
+				word = append(word, c)
+			}
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+		default:
+			word = append(word, c)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || escaped {
+		return nil, errUnterminatedQuote
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+
+	return words, nil
+}
+
+// parseScpCommand parses a remote scp command. Short flags may be combined,
+// as in "-rt", and "--" ends the flags. Uploads take exactly one target and
+// downloads one or more sources.
+func parseScpCommand(command string) (cmd scpCommand, err error) {
+	words, err := splitCommand(command)
+	if err != nil {
+		return cmd, err
+	}
+
+	if len(words) == 0 || words[0] != "scp" {
+		return cmd, errOnlySCP
+	}
+
+	i := 1
+	for ; i < len(words); i++ {
+		w := words[i]
+		if w == "--" {
+			i++
+			break
+		}
+		if !strings.HasPrefix(w, "-") || w == "-" {
+			break
+		}
+
+		for _, flag := range w[1:] {
+			switch flag {
+			case 't':
+				cmd.Upload = true
+			case 'f':
+				cmd.Download = true
+			case 'r':
+				cmd.Recursive = true
+			case 'd':
+				cmd.DirOnly = true
+			case 'p':
+				cmd.Preserve = true
+			case 'v':
+				cmd.Verbose = true
+			case 'q':
+				cmd.Quiet = true
+			default:
+				return cmd, errUnsupportedScpFlag
+			}
+		}
+	}
+	cmd.Paths = words[i:]
+
+	if cmd.Upload == cmd.Download {
+		return cmd, errScpMode
+	}
+	if len(cmd.Paths) == 0 {
+		return cmd, errFewArgs
+	}
+	if cmd.Upload && len(cmd.Paths) != 1 {
+		return cmd, errManyTargets
+	}
+
+	return cmd, nil
+}
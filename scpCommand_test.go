@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := make(map[string][]string)
+	tests["scp -t dir"] = []string{"scp", "-t", "dir"}
+	tests["scp  -t   dir "] = []string{"scp", "-t", "dir"}
+	tests[`scp -t 'my file'`] = []string{"scp", "-t", "my file"}
+	tests[`scp -t "my \"file\""`] = []string{"scp", "-t", `my "file"`}
+	tests[`scp -t my\ file`] = []string{"scp", "-t", "my file"}
+	tests[`scp -t ''`] = []string{"scp", "-t", ""}
+
+	for command, expected := range tests {
+		words, err := splitCommand(command)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %s\n", command, err)
+		}
+		if !reflect.DeepEqual(words, expected) {
+			t.Errorf("Words (%q) does not match expected (%q)\n", words, expected)
+		}
+	}
+
+	for _, command := range []string{`scp -t 'dir`, `scp -t "dir`, `scp -t dir\`} {
+		if _, err := splitCommand(command); err != errUnterminatedQuote {
+			t.Errorf("Error (%v) does not match expected (%v)\n", err, errUnterminatedQuote)
+		}
+	}
+}
+
+func TestParseScpCommand(t *testing.T) {
+	type result struct {
+		cmd scpCommand
+		err error
+	}
+	tests := make(map[string]result)
+	tests["scp -t dir"] = result{scpCommand{Upload: true, Paths: []string{"dir"}}, nil}
+	tests["scp -rt dir"] = result{scpCommand{Upload: true, Recursive: true, Paths: []string{"dir"}}, nil}
+	tests["scp -v -p -d -t -- -dir"] = result{scpCommand{Upload: true, Verbose: true, Preserve: true, DirOnly: true, Paths: []string{"-dir"}}, nil}
+	tests["scp -qf 'a b' c"] = result{scpCommand{Download: true, Quiet: true, Paths: []string{"a b", "c"}}, nil}
+	tests["scp -t a b"] = result{scpCommand{Upload: true, Paths: []string{"a", "b"}}, errManyTargets}
+	tests["scp -tf dir"] = result{scpCommand{Upload: true, Download: true, Paths: []string{"dir"}}, errScpMode}
+	tests["scp -r dir"] = result{scpCommand{Recursive: true, Paths: []string{"dir"}}, errScpMode}
+	tests["scp -t"] = result{scpCommand{Upload: true, Paths: []string{}}, errFewArgs}
+	tests["scp -x -t dir"] = result{scpCommand{}, errUnsupportedScpFlag}
+	tests["ls -t dir"] = result{scpCommand{}, errOnlySCP}
+
+	for command, expected := range tests {
+		cmd, err := parseScpCommand(command)
+		if err != expected.err {
+			t.Errorf("Error for %q (%v) does not match expected (%v)\n", command, err, expected.err)
+		}
+		if !reflect.DeepEqual(cmd, expected.cmd) {
+			t.Errorf("Command (%+v) does not match expected (%+v)\n", cmd, expected.cmd)
+		}
+	}
+}
+
+func TestValidateCommandPaths(t *testing.T) {
+	perm := &ssh.Permissions{CriticalOptions: map[string]string{"privs": "rw"}}
+
+	tests := make(map[string]error)
+	tests["scp -t 'my file'"] = nil
+	tests["scp -f a..b c"] = nil
+	tests["scp -rt dir"] = nil
+	tests["scp -t /etc"] = errAbsolutePath
+	tests["scp -f ok ../secret"] = errPathTraversal
+	tests["scp -t 'a;b'"] = errDisallowedChars
+	tests["scp -rf dir"] = errRecursiveDownload
+
+	for command, expected := range tests {
+		if _, err := validateCommand(command, perm, "w"); err != expected {
+			t.Errorf("Error for %q (%v) does not match expected (%v)\n", command, err, expected)
+		}
+	}
+}
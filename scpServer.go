@@ -16,13 +16,15 @@ Copyright 2017 Oscar Carlsson
 package main
 
 import (
-	"bytes"
+	"context"
 	"errors"
+	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
-	"os/exec"
+	"io"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // characters disallowed in scp commands.
@@ -53,7 +55,7 @@ func handleRequests(reqs <-chan *ssh.Request) {
 }
 
 // handleChannels handles incoming channels and only allows exec request types
-func handleChannels(chans <-chan ssh.NewChannel, perm *ssh.Permissions, address string, config Config) {
+func (s *Server) handleChannels(chans <-chan ssh.NewChannel, perm *ssh.Permissions, address string, config Config) {
 	for newChannel := range chans {
 		if newChannel.ChannelType() != "session" {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
@@ -78,12 +80,45 @@ func handleChannels(chans <-chan ssh.NewChannel, perm *ssh.Permissions, address
 					//Evaluate env variable
 					ok = true
 				case "exec":
+					var command string
+					if len(req.Payload) > 4 {
+						command = string(req.Payload[4:])
+					}
+					id, started := s.beginSession(perm.CriticalOptions["user"], address, command)
+					if !started {
+						channel.Write([]byte("Server is shutting down\r\n"))
+						logInfo.Printf("Rejected exec from %s during shutdown\n", address)
+						channel.Close()
+						break
+					}
 					ok = true
-					handleExec(channel, req, perm, address, config)
+					throttled, release := s.throttle(channel, config, perm.CriticalOptions["user"])
+					s.handleExec(throttled, req, perm, address, config, id)
+					release()
+					s.endSession(id)
 				case "simple@putty.projects.tartarus.org":
 					channel.Write([]byte("Putty not supported\r\n"))
 				case "subsystem":
-					logWarning.Printf("Unsupported subsystem: %s\n", string(req.Payload))
+					if config.ResumeDir == "" || len(req.Payload) < 4 || string(req.Payload[4:]) != "sftp" {
+						logWarning.Printf("Unsupported subsystem: %s\n", string(req.Payload))
+						break
+					}
+					id, started := s.beginSession(perm.CriticalOptions["user"], address, "sftp")
+					if !started {
+						channel.Write([]byte("Server is shutting down\r\n"))
+						logInfo.Printf("Rejected sftp from %s during shutdown\n", address)
+						channel.Close()
+						break
+					}
+					// The client waits for the reply before it starts sftp.
+					if req.WantReply {
+						req.Reply(true, nil)
+						req.WantReply = false
+					}
+					throttled, release := s.throttle(channel, config, perm.CriticalOptions["user"])
+					s.handleSftp(throttled, perm, address, config, id)
+					release()
+					s.endSession(id)
 				default:
 					channel.Write([]byte("Unsupported request type\r\n"))
 					logWarning.Printf("Unsupported request type: %s\n", req.Type)
@@ -98,147 +133,285 @@ func handleChannels(chans <-chan ssh.NewChannel, perm *ssh.Permissions, address
 	}
 }
 
+// sessionResult holds information about a finished exec session.
+type sessionResult struct {
+	ID         uint64
+	User       string
+	RemoteAddr string
+	Dir        string
+	Cmd        string
+	Files      []string
+	Sums       map[string]fileSum
+	Started    time.Time
+
+	Quarantined []quarantinedFile
+	Finished    time.Time
+}
+
 // handleExec handles incoming exec requests. Only scp requests are allowed.
-func handleExec(channel ssh.Channel, req *ssh.Request, perm *ssh.Permissions, address string, config Config) {
+func (s *Server) handleExec(channel ssh.Channel, req *ssh.Request, perm *ssh.Permissions, address string, config Config, id uint64) {
 	defer channel.Close()
 
+	channel, stop := watchSession(channel, config, address)
+	defer stop()
+
+	started := time.Now()
+
 	command := string(req.Payload[4:])
 	logInfo.Printf("Command from %s: %q\n", address, command)
 
-	_, err := validateCommand(command, perm, perm.CriticalOptions["recurse"])
+	scpCmd, err := validateCommand(command, perm, perm.CriticalOptions["recurse"])
 	if err != nil {
+		countRejected(err)
 		channel.Write([]byte(string(err.Error()) + "\r\n"))
 		logWarning.Printf("%s ran illegal command %q\n", address, command)
 		logWarning.Printf("%s received error message \"%q\"\n", address, err.Error())
 		return
 	}
 
-	args := strings.Split(command, " ")
+	dir, dropBox, err := sessionDir(config, perm, id, started, scpCmd.Upload)
+	if err != nil {
+		logError.Printf("Unable to prepare drop box for %s: %s\n", perm.CriticalOptions["user"], err)
+		channel.Write([]byte("Unable to prepare drop box\r\n"))
+		return
+	}
 
-	if perm.CriticalOptions["dir"] == "/" {
-		logWarning.Println("DIR == /")
+	maxSize, _ := strconv.ParseUint(perm.CriticalOptions["size"], 10, 64)
+
+	wrap, suffix, err := uploadWrap(config, perm.CriticalOptions["user"])
+	if err != nil {
+		logError.Printf("Unable to prepare uploads for %s: %s\n", perm.CriticalOptions["user"], err)
+		channel.Write([]byte("Unable to store uploads\r\n"))
+		return
 	}
 
-	dir := perm.CriticalOptions["dir"]
-	if dir == "" {
-		dir = config.SharedDir
+	// Transfers are handled by the built-in sink and source, which open
+	// every file through a root handle of dir, so neither paths nor
+	// symlinks can lead outside of it.
+	var uploadedFiles []string
+	var sums map[string]fileSum
+	var quarantined []quarantinedFile
+	if scpCmd.Upload {
+		sink, err := uploadSink(channel, channel, dir, config, maxSize, dropBox)
+		if err != nil {
+			logError.Printf("Unable to prepare uploads for %s: %s\n", perm.CriticalOptions["user"], err)
+			channel.Write([]byte("Unable to store uploads\r\n"))
+			return
+		}
+		sink.wrap, sink.suffix = wrap, suffix
+		receiveFiles(sink, scpCmd)
+		uploadedFiles, sums, quarantined = sink.files, sink.sums, sink.quarantined
+	} else {
+		var published []string
+		if dropBox && config.PublishDir != "" {
+			published = append(published, config.PublishDir)
+		}
+		sendFiles(channel, scpCmd, dir, published)
 	}
 
-	args[len(args)-1] = dir + args[len(args)-1]
+	result := sessionResult{ID: id, User: perm.CriticalOptions["user"], RemoteAddr: address,
+		Dir: dir, Cmd: perm.CriticalOptions["cmd"], Files: uploadedFiles, Sums: sums, Started: started, Quarantined: quarantined}
+	s.processUploads(channel, config, result)
+}
 
-	cmd := exec.Command(config.ScpPath, args[1:]...)
+// handleSftp serves the sftp subsystem for resumable uploads.
+func (s *Server) handleSftp(channel ssh.Channel, perm *ssh.Permissions, address string, config Config, id uint64) {
+	defer channel.Close()
 
-	filechan := make(chan string)
-	defer close(filechan)
+	channel, stop := watchSession(channel, config, address)
+	defer stop()
 
-	maxSize, _ := strconv.ParseUint(perm.CriticalOptions["size"], 10, 64)
+	started := time.Now()
+	user := perm.CriticalOptions["user"]
 
-	cmd.Stdin = scpReader{reader: channel, phase: new(int), filesize: new(uint64),
-		currsize: new(uint64), maxSize: maxSize, dirname: new(string),
-		filename: new(string), filechan: filechan}
-	cmd.Stdout = scpWriter{writer: channel, phase: new(int), filesize: new(uint64),
-		currsize: new(uint64), dirname: new(string), filename: new(string), filechan: filechan}
-	cmd.Stderr = scpWriter{writer: channel, phase: new(int), filesize: new(uint64),
-		currsize: new(uint64), dirname: new(string), filename: new(string), filechan: filechan}
+	if !strings.Contains(perm.CriticalOptions["privs"], "w") {
+		countRejected(errUploadPrivs)
+		logWarning.Printf("%s started sftp without upload privileges\n", address)
+		return
+	}
 
-	var uploadedFiles []string
-	go func() {
-		for file := range filechan {
-			uploadedFiles = append(uploadedFiles, file)
-		}
-	}()
+	dir, dropBox, err := sessionDir(config, perm, id, started, true)
+	if err != nil {
+		logError.Printf("Unable to prepare drop box for %s: %s\n", user, err)
+		return
+	}
 
-	logDebug.Printf("Running command: %q\n", cmd.Args)
-	if err = cmd.Start(); err != nil {
-		logError.Printf("Could not start command: %q\n", err)
+	maxSize, _ := strconv.ParseUint(perm.CriticalOptions["size"], 10, 64)
+
+	wrap, suffix, err := uploadWrap(config, user)
+	if err != nil {
+		logError.Printf("Unable to prepare uploads for %s: %s\n", user, err)
 		return
 	}
 
-	if _, err = cmd.Process.Wait(); err != nil {
-		logError.Printf("Unable to wait for %q: %s\n", command, err)
+	sink, err := uploadSink(nil, nil, dir, config, maxSize, dropBox)
+	if err != nil {
+		logError.Printf("Unable to prepare uploads for %s: %s\n", user, err)
+		return
 	}
+	sink.wrap, sink.suffix = wrap, suffix
+	h, err := newSftpHandler(sink, filepath.Join(config.ResumeDir, stageDirName(user)), config.ResumeTimeout)
+	if err != nil {
+		logError.Printf("Unable to prepare resumable uploads for %s: %s\n", user, err)
+		return
+	}
+	defer h.close()
 
-	if len(config.Cmd) != 0 {
-		for _, f := range uploadedFiles {
-			var stdout bytes.Buffer
-			var stderr bytes.Buffer
+	logInfo.Printf("sftp session from %s in %s\n", address, dir)
+	server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: h, FilePut: h, FileCmd: h, FileList: h})
+	if err = server.Serve(); err != nil && err != io.EOF {
+		logWarning.Printf("sftp session from %s ended: %s\n", address, err)
+	}
 
-			args = append(config.Cmd[1:], dir+f)
+	result := sessionResult{ID: id, User: user, RemoteAddr: address, Dir: dir, Cmd: perm.CriticalOptions["cmd"],
+		Files: sink.files, Sums: sink.sums, Started: started, Quarantined: sink.quarantined}
+	s.processUploads(channel, config, result)
+}
 
-			cmd = exec.Command(config.Cmd[0], args...)
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
-			if err = cmd.Run(); err != nil {
-				logError.Printf("Unable to run command \"%q\" on file %s\n", cmd.Args, f)
+// sessionDir returns the directory a session works in and true if it is a
+// drop box. Users of the shared directory only see their own folder in drop
+// boxes.
+func sessionDir(config Config, perm *ssh.Permissions, id uint64, started time.Time, upload bool) (string, bool, error) {
+	if perm.CriticalOptions["dir"] == "/" {
+		logWarning.Println("DIR == /")
+	}
+
+	dir := perm.CriticalOptions["dir"]
+	if dir == "" {
+		dir = config.SharedDir
+	}
+
+	if config.DropBox == "" || dir != config.SharedDir {
+		return dir, false, nil
+	}
+
+	dir, err := dropBoxDir(config, perm.CriticalOptions["user"], id, started, upload)
+	return dir, true, err
+}
+
+// uploadSink creates a sink storing uploads below dir with the upload
+// settings of config.
+func uploadSink(r io.Reader, w io.Writer, dir string, config Config, maxSize uint64, dropBox bool) (*scpSink, error) {
+	sink := newScpSink(r, w, dir)
+	sink.maxSize = maxSize
+	sink.clamd = config.ClamdSocket
+	sink.quarantineDir = config.QuarantineDir
+	sink.collision = config.Collision
+	if dropBox {
+		sink.collision = dropBoxCollision(config.Collision)
+	}
+	names, err := newNameRules(config)
+	if err != nil {
+		return nil, err
+	}
+	sink.names = names
+
+	return sink, nil
+}
+
+// processUploads audits quarantined files, runs or queues the pipeline for
+// the uploaded files of a finished session and sends the webhook.
+func (s *Server) processUploads(channel ssh.Channel, config Config, result sessionResult) {
+	uploadedFiles, quarantined, id := result.Files, result.Quarantined, result.ID
+
+	for _, q := range quarantined {
+		writeAudit(config.AuditFile, stageResult{Time: time.Now(), Session: id, User: result.User, File: q.Name,
+			Stage: "clamd", Status: q.Reason, ExitCode: -1, Action: policyQuarantine})
+	}
+
+	if len(config.Cmd) != 0 || len(config.Stages) != 0 || result.Cmd != "" {
+		// Each job is a file, or all files of the session in session mode.
+		var jobs [][]string
+		if config.CmdMode == cmdModeSession && len(uploadedFiles) != 0 {
+			jobs = append(jobs, uploadedFiles)
+		} else {
+			for _, f := range uploadedFiles {
+				jobs = append(jobs, []string{f})
 			}
+		}
 
-			if stdout.Len() > 0 {
-				logInfo.Printf("STDOUT: %s\n", stdout.String())
+		for _, files := range jobs {
+			if s.queue == nil {
+				runPipeline(context.Background(), config, result, files)
+				continue
 			}
 
-			if stderr.Len() > 0 {
-				logError.Printf("STDERR: %s\n", stderr.String())
+			j := job{Session: result}
+			if len(files) == 1 && config.CmdMode != cmdModeSession {
+				j.File = files[0]
+			}
+			if err := s.queue.enqueue(j); err != nil {
+				logError.Printf("Unable to queue job for %s, running it now: %s\n", strings.Join(files, " "), err)
+				runPipeline(context.Background(), config, result, files)
 			}
 		}
 	}
+	result.Finished = time.Now()
+
+	if hook := newWebhook(config); hook != nil && (len(uploadedFiles) != 0 || len(quarantined) != 0) {
+		// The client does not need to wait for the notification to be delivered.
+		channel.Close()
+		s.sendWebhook(hook, newWebhookPayload(s.boot, result))
+	}
 }
 
-// validateCommand makes sure unallowed or dangerous commands are not executed.
-func validateCommand(command string, perm *ssh.Permissions, recPerms string) (cmd string, err error) {
-	c := strings.Split(command, " ")
+// receiveFiles handles an upload with the built-in scp sink.
+func receiveFiles(sink *scpSink, scpCmd scpCommand) {
+	sink.recursive = scpCmd.Recursive
 
-	if c[0] != "scp" {
-		return "", errOnlySCP
+	if err := sink.receive(scpCmd.Paths[0], scpCmd.DirOnly); err != nil {
+		logWarning.Printf("Upload to %s ended with error: %s\n", sink.dir, err)
 	}
+}
 
-	if len(c) == 1 {
-		return "", errFewArgs
-	}
+// sendFiles handles a download with the built-in scp source.
+func sendFiles(channel ssh.Channel, scpCmd scpCommand, dir string, published []string) {
+	source := newScpSource(channel, channel, dir)
+	source.recursive = scpCmd.Recursive
+	source.preserve = scpCmd.Preserve
+	source.published = published
 
-	if strings.IndexAny(command, disallowedChars) != -1 {
-		return "", errDisallowedChars
+	if err := source.send(scpCmd.Paths...); err != nil {
+		logWarning.Printf("Download from %s ended with error: %s\n", dir, err)
 	}
+}
 
-	if strings.HasPrefix(c[len(c)-1], string(filepath.Separator)) {
-		return "", errAbsolutePath
+// validateCommand makes sure unallowed or dangerous commands are not executed.
+func validateCommand(command string, perm *ssh.Permissions, recPerms string) (cmd scpCommand, err error) {
+	if cmd, err = parseScpCommand(command); err != nil {
+		return cmd, err
 	}
 
-	if strings.Index(command, "..") != -1 {
-		return "", errPathTraversal
-	}
+	for _, p := range cmd.Paths {
+		if strings.IndexAny(p, disallowedChars) != -1 {
+			return cmd, errDisallowedChars
+		}
 
-	recurse := false
-	download := false
-	for _, flag := range c[1 : len(c)-1] {
-		switch flag {
-		case "-r":
-			recurse = true
-		case "-d":
-		case "--":
-		//case "-v": //Verbose mode messes up the the reader/writer
-		case "-t":
-			cmd = "-t"
-			if !strings.Contains(perm.CriticalOptions["privs"], "w") {
-				return "", errUploadPrivs
-			}
-		case "-f":
-			cmd = "-f"
-			download = true
-			if !strings.Contains(perm.CriticalOptions["privs"], "r") {
-				return "", errDownloadPrivs
+		if strings.HasPrefix(p, string(filepath.Separator)) {
+			return cmd, errAbsolutePath
+		}
+
+		for _, elem := range strings.Split(p, string(filepath.Separator)) {
+			if elem == ".." {
+				return cmd, errPathTraversal
 			}
-		default:
-			return "", errUnsupportedScpFlag
 		}
 	}
 
-	if recurse {
-		if download && !strings.Contains(recPerms, "r") {
-			return "", errRecursiveDownload
+	if cmd.Upload && !strings.Contains(perm.CriticalOptions["privs"], "w") {
+		return cmd, errUploadPrivs
+	}
+	if cmd.Download && !strings.Contains(perm.CriticalOptions["privs"], "r") {
+		return cmd, errDownloadPrivs
+	}
+
+	if cmd.Recursive {
+		if cmd.Download && !strings.Contains(recPerms, "r") {
+			return cmd, errRecursiveDownload
 		}
 
-		if !download && !strings.Contains(recPerms, "w") {
-			return "", errRecursiveUpload
+		if cmd.Upload && !strings.Contains(recPerms, "w") {
+			return cmd, errRecursiveUpload
 		}
 	}
 
@@ -0,0 +1,614 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errors returned by the built-in scp sink
+var (
+	errFileTooLarge  = errors.New("File exceeds the maximum upload size")
+	errInvalidRecord = errors.New("Invalid scp protocol record")
+	errInvalidName   = errors.New("Invalid file name")
+	errNotADirectory = errors.New("Target is not a directory")
+)
+
+// scpSink receives files from an scp client the way "scp -t" does. Every
+// file is opened beneath the root of the user directory and transformed while
+// it is received, so the original data never touches the filesystem.
+type scpSink struct {
+	r         *bufio.Reader
+	w         io.Writer
+	dir       string
+	recursive bool
+	maxSize   uint64
+
+	// wrap, if set, wraps every file written. Closing the returned writer
+	// must close the file. suffix is appended to the stored file names.
+	wrap   func(f io.WriteCloser) (io.WriteCloser, error)
+	suffix string
+
+	// collision is the policy for uploads of existing files and names the
+	// rules file and directory names from the client are cleaned with.
+	collision string
+	names     nameRules
+
+	// clamd, if set, is the clamd socket every file is scanned with while
+	// it is received. Infected files are moved to quarantineDir.
+	clamd         string
+	quarantineDir string
+
+	// files are the stored files relative to dir and sums their size and
+	// checksum by name.
+	files       []string
+	sums        map[string]fileSum
+	quarantined []quarantinedFile
+
+	// root is the sink directory while files are received.
+	root *os.Root
+}
+
+// uploadWrap returns how uploads from user are transformed before they are
+// stored and the suffix added to their names. wrap is nil if uploads are
+// stored as they are sent.
+func uploadWrap(config Config, user string) (wrap func(io.WriteCloser) (io.WriteCloser, error), suffix string, err error) {
+	if config.Compress != "" {
+		wrap, suffix = compressWriter(config.Compress), compressedSuffixes[config.Compress]
+	}
+
+	keys, err := encryptionKeys(config, user)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(keys) != 0 {
+		wrap = chainWrap(wrap, encryptWriter(keys))
+		suffix += encryptedSuffix
+	}
+
+	return wrap, suffix, nil
+}
+
+// chainWrap returns a wrapper where data written passes outer and then inner
+// before it reaches the file. outer may be nil.
+func chainWrap(outer, inner func(io.WriteCloser) (io.WriteCloser, error)) func(io.WriteCloser) (io.WriteCloser, error) {
+	if outer == nil {
+		return inner
+	}
+
+	return func(f io.WriteCloser) (io.WriteCloser, error) {
+		w, err := inner(f)
+		if err != nil {
+			return nil, err
+		}
+
+		return outer(w)
+	}
+}
+
+// newScpSink creates a sink that reads records from r, answers on w and
+// stores files below dir.
+func newScpSink(r io.Reader, w io.Writer, dir string) *scpSink {
+	return &scpSink{r: bufio.NewReader(r), w: w, dir: dir, sums: make(map[string]fileSum)}
+}
+
+// fileSum is the size and hex encoded sha256 checksum of an upload as it was
+// received, before it was transformed and stored.
+type fileSum struct {
+	Size   int64
+	SHA256 string
+}
+
+// ack tells the client the last record was accepted.
+func (s *scpSink) ack() error {
+	_, err := s.w.Write([]byte{0})
+	return err
+}
+
+// warn sends a non fatal error for the last record to the client.
+func (s *scpSink) warn(err error) {
+	fmt.Fprintf(s.w, "\x01scp: %s\n", err)
+}
+
+// fatal sends a fatal error to the client, which ends the transfer.
+func (s *scpSink) fatal(err error) error {
+	fmt.Fprintf(s.w, "\x02scp: %s\n", err)
+	return err
+}
+
+// parseRecord parses a C or D record such as "C0644 1024 name\n".
+func parseRecord(line string) (mode os.FileMode, size uint64, name string, err error) {
+	fields := strings.SplitN(strings.TrimSuffix(line[1:], "\n"), " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", errInvalidRecord
+	}
+
+	m, err := strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", errInvalidRecord
+	}
+	if size, err = strconv.ParseUint(fields[1], 10, 63); err != nil {
+		return 0, 0, "", errInvalidRecord
+	}
+
+	name = fields[2]
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") || reservedName(name) {
+		return 0, 0, "", errInvalidName
+	}
+
+	return os.FileMode(m).Perm(), size, name, nil
+}
+
+// fileTimes are the times sent in a T record by "scp -p".
+type fileTimes struct {
+	mtime time.Time
+	atime time.Time
+}
+
+// parseTimes parses a T record such as "T1500000000 0 1500000000 0\n".
+func parseTimes(line string) (*fileTimes, error) {
+	fields := strings.Fields(line[1:])
+	if len(fields) != 4 {
+		return nil, errInvalidRecord
+	}
+
+	var v [4]int64
+	for i, f := range fields {
+		n, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || n < 0 {
+			return nil, errInvalidRecord
+		}
+		v[i] = n
+	}
+	if v[1] > 999999 || v[3] > 999999 {
+		return nil, errInvalidRecord
+	}
+
+	return &fileTimes{mtime: time.Unix(v[0], v[1]*1000), atime: time.Unix(v[2], v[3]*1000)}, nil
+}
+
+// receive reads records until the client closes the stream. target is the
+// path, relative to the sink directory, given to "scp -t". If dirOnly is set
+// the target has to be an existing directory. Every file is created relative
+// to the sink directory, so neither the target nor symlinks below the
+// directory can reach files outside of it.
+func (s *scpSink) receive(target string, dirOnly bool) error {
+	root, err := os.OpenRoot(s.dir)
+	if err != nil {
+		return s.fatal(err)
+	}
+	defer root.Close()
+	s.root = root
+
+	target = filepath.Clean(target)
+	if reservedName(filepath.Base(target)) {
+		return s.fatal(errInvalidName)
+	}
+	fi, err := root.Stat(target)
+	targetIsDir := err == nil && fi.IsDir()
+	if dirOnly && !targetIsDir {
+		return s.fatal(errNotADirectory)
+	}
+
+	if err := s.ack(); err != nil {
+		return err
+	}
+
+	// cur is the directory files are stored in, relative to s.dir.
+	cur := target
+	var parents []string
+
+	// times are the times of the next C or D record. The times of a
+	// directory are set when it is left, after its files are written.
+	var times *fileTimes
+	var dirTimes []*fileTimes
+
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		logDebug.Printf("Sink record: %q\n", line)
+
+		switch line[0] {
+		case 'C':
+			mode, size, name, err := parseRecord(line)
+			if err == nil {
+				name, err = s.names.clean(name)
+			}
+			if err != nil {
+				return s.fatal(err)
+			}
+
+			rel := target
+			if targetIsDir || len(parents) != 0 {
+				rel = filepath.Join(cur, name)
+			}
+			err = s.receiveFile(rel, mode, size, times)
+			times = nil
+			if err != nil {
+				return err
+			}
+		case 'D':
+			if !s.recursive {
+				return s.fatal(errRecursiveUpload)
+			}
+			mode, _, name, err := parseRecord(line)
+			if err == nil {
+				name, err = s.names.clean(name)
+			}
+			if err != nil {
+				return s.fatal(err)
+			}
+
+			// Like scp, a directory sent to a target that does not exist
+			// is created with the target name.
+			rel := filepath.Join(cur, name)
+			if !targetIsDir && len(parents) == 0 {
+				rel = target
+			}
+			if err = root.Mkdir(rel, mode|0700); err != nil && !os.IsExist(err) {
+				return s.fatal(err)
+			}
+
+			parents = append(parents, cur)
+			dirTimes = append(dirTimes, times)
+			times = nil
+			cur = rel
+			s.ack()
+		case 'E':
+			if len(parents) == 0 {
+				return s.fatal(errInvalidRecord)
+			}
+			if t := dirTimes[len(dirTimes)-1]; t != nil {
+				if err := root.Chtimes(cur, t.atime, t.mtime); err != nil {
+					logWarning.Printf("Unable to set times of %s: %s\n", cur, err)
+				}
+			}
+			cur = parents[len(parents)-1]
+			parents = parents[:len(parents)-1]
+			dirTimes = dirTimes[:len(dirTimes)-1]
+			s.ack()
+		case 'T':
+			if times, err = parseTimes(line); err != nil {
+				return s.fatal(err)
+			}
+			s.ack()
+		case 1:
+			logWarning.Printf("scp client warning: %s", line[1:])
+		case 2:
+			return fmt.Errorf("scp client error: %s", strings.TrimSpace(line[1:]))
+		default:
+			return s.fatal(errInvalidRecord)
+		}
+	}
+}
+
+// scanResult is the outcome of scanning a file.
+type scanResult struct {
+	virus string
+	err   error
+}
+
+// quarantine moves an infected file, or a file that could not be scanned, to
+// the quarantine directory and returns the error reported to the client.
+func (s *scpSink) quarantine(name string, path string, res scanResult) error {
+	reason := "Virus found: " + res.virus
+	if res.err != nil {
+		reason = fmt.Sprintf("Scan failed: %s", res.err)
+	}
+	logWarning.Printf("Upload %s rejected: %s\n", path, reason)
+	metricQuarantinedFiles.Inc()
+
+	if err := quarantineAs(path, filepath.Base(name), s.quarantineDir); err != nil {
+		logError.Printf("Unable to quarantine %s, removing it: %s\n", path, err)
+		os.Remove(path)
+	}
+	s.quarantined = append(s.quarantined, quarantinedFile{Name: filepath.ToSlash(name), Reason: reason})
+
+	if res.err != nil {
+		return fmt.Errorf("Unable to scan file")
+	}
+	return fmt.Errorf("Virus found")
+}
+
+// discardOnError writes to w until a write fails and discards everything
+// after that, so the rest of a file can still be read from the client.
+type discardOnError struct {
+	w   io.Writer
+	err error
+}
+
+// Write writes p to the underlying writer unless a previous write failed.
+func (d *discardOnError) Write(p []byte) (int, error) {
+	if d.err == nil {
+		_, d.err = d.w.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// partialName returns the hidden name a file is written to while it is
+// received, in the same directory as name.
+func partialName(name string) string {
+	return filepath.Join(filepath.Dir(name), fmt.Sprintf(".%s%s%d", filepath.Base(name), partialMarker, time.Now().UnixNano()))
+}
+
+// partialMarker is part of the names of files that are being received.
+const partialMarker = ".part-"
+
+// isPartial returns true if name is a file that is being received.
+func isPartial(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, partialMarker)
+}
+
+// partialStarted returns when the partial file name was created. ok is
+// false if name is not a partial file.
+func partialStarted(name string) (started time.Time, ok bool) {
+	if !isPartial(name) {
+		return started, false
+	}
+
+	nanos, err := strconv.ParseInt(name[strings.LastIndex(name, partialMarker)+len(partialMarker):], 10, 64)
+	if err != nil {
+		return started, false
+	}
+
+	return time.Unix(0, nanos), true
+}
+
+// removePartial removes the partial files below dir created before before,
+// which are left over by a server that stopped while receiving them.
+func removePartial(dir string, before time.Time) {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return nil
+		}
+		if started, ok := partialStarted(fi.Name()); !ok || !started.Before(before) {
+			return nil
+		}
+
+		logInfo.Printf("Removing stale partial upload %s\n", path)
+		if err := os.Remove(path); err != nil {
+			logError.Printf("Unable to remove %s: %s\n", path, err)
+		}
+		return nil
+	})
+}
+
+// commit gives a completely received file its name rel with the suffix added
+// and returns the name it is stored as. Unless files may be overwritten the
+// file is hard linked, which fails instead of replacing a file created since
+// the collision policy was applied.
+func (s *scpSink) commit(tmp string, rel string) (string, error) {
+	if s.collision == "" || s.collision == collisionOverwrite {
+		return rel + s.suffix, s.root.Rename(tmp, rel+s.suffix)
+	}
+
+	for tries := 0; ; tries++ {
+		stored, err := resolveCollision(s.root, s.collision, rel, s.suffix)
+		if err != nil {
+			return "", err
+		}
+
+		err = s.root.Link(tmp, stored+s.suffix)
+		if err == nil {
+			s.root.Remove(tmp)
+			if stored != rel {
+				logInfo.Printf("Upload %s stored as %s\n", rel, stored)
+			}
+			return stored + s.suffix, nil
+		} else if !os.IsExist(err) {
+			return "", err
+		} else if s.collision == collisionReject || tries == 10 {
+			return "", errFileExists
+		}
+	}
+}
+
+// upload is a file being stored by the sink. The data is written to a hidden
+// file that only gets its name once the whole file is received.
+type upload struct {
+	s        *scpSink
+	rel      string
+	name     string
+	tmp      string
+	size     uint64
+	out      io.WriteCloser
+	dst      *discardOnError
+	sum      hash.Hash
+	scanned  chan scanResult
+	scanPipe *io.PipeWriter
+	storeErr error
+}
+
+// create starts storing a file of size bytes as rel. Errors are kept until
+// finish so the data can still be read from the client.
+func (s *scpSink) create(rel string, mode os.FileMode, size uint64) *upload {
+	u := &upload{s: s, rel: rel, name: rel + s.suffix, size: size, dst: &discardOnError{w: ioutil.Discard}, sum: sha256.New()}
+	u.tmp = partialName(u.name)
+	path := filepath.Join(s.dir, u.name)
+
+	if s.maxSize != 0 && size > s.maxSize {
+		logInfo.Printf("Suppressed file %s Size %d\n", path, size)
+		metricSuppressedFiles.Inc()
+		u.storeErr = errFileTooLarge
+		return u
+	}
+	if _, err := s.root.Lstat(u.name); err == nil && s.collision == collisionReject {
+		// Rejected files are refused before the data is stored.
+		u.storeErr = errFileExists
+		return u
+	}
+
+	f, err := s.root.OpenFile(u.tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		u.storeErr = err
+		return u
+	}
+	if s.wrap == nil {
+		u.out = f
+	} else if u.out, u.storeErr = s.wrap(f); u.storeErr != nil {
+		f.Close()
+		s.root.Remove(u.tmp)
+		u.out = nil
+		return u
+	}
+	u.dst.w = u.out
+
+	// The data is scanned while it is written so a scanner sees the
+	// original data even if the stored file is encrypted.
+	if s.clamd != "" {
+		u.scanned = make(chan scanResult, 1)
+		pr, pw := io.Pipe()
+		u.scanPipe = pw
+		go func() {
+			virus, err := clamdScan(s.clamd, pr)
+			io.Copy(ioutil.Discard, pr)
+			u.scanned <- scanResult{virus, err}
+		}()
+		u.dst.w = io.MultiWriter(u.out, pw)
+	}
+
+	return u
+}
+
+// direct returns true if the file is stored as it is sent, so its data may
+// be placed at tmp by other means than Write.
+func (u *upload) direct() bool {
+	return u.out != nil && u.storeErr == nil && u.s.wrap == nil && u.s.clamd == ""
+}
+
+// Write stores p. Write errors are kept until finish.
+func (u *upload) Write(p []byte) (int, error) {
+	u.sum.Write(p)
+	return u.dst.Write(p)
+}
+
+// close closes the stored file and the scanner and returns the scan result.
+func (u *upload) close() (res scanResult) {
+	if u.out != nil {
+		if err := u.out.Close(); u.dst.err == nil {
+			u.dst.err = err
+		}
+	}
+	if u.scanPipe != nil {
+		u.scanPipe.Close()
+		res = <-u.scanned
+	}
+
+	return res
+}
+
+// abort removes the partly stored file.
+func (u *upload) abort() {
+	u.close()
+	if u.out != nil {
+		u.s.root.Remove(u.tmp)
+	}
+}
+
+// finish gives the completely received file its name. Infected files are
+// quarantined. If times is set they are preserved on the stored file.
+func (u *upload) finish(times *fileTimes) error {
+	s := u.s
+	res := u.close()
+	if u.out == nil {
+		return u.storeErr
+	}
+	// Nothing is left behind unless the file is committed or quarantined.
+	defer s.root.Remove(u.tmp)
+
+	err := u.storeErr
+	if err == nil && (res.virus != "" || res.err != nil) {
+		err = s.quarantine(u.name, filepath.Join(s.dir, u.tmp), res)
+	}
+	if err == nil {
+		err = u.dst.err
+	}
+	if err == nil && times != nil {
+		err = s.root.Chtimes(u.tmp, times.atime, times.mtime)
+	}
+	if err == nil {
+		u.name, err = s.commit(u.tmp, u.rel)
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.wrap != nil && isCompressedSuffix(s.suffix) {
+		if err = markCompressed(s.root, u.name, u.size); err != nil {
+			logWarning.Printf("Unable to mark %s as compressed, it is downloaded compressed: %s\n", filepath.Join(s.dir, u.name), err)
+		}
+	}
+
+	logInfo.Printf("Uploaded file %s Size %d\n", filepath.Join(s.dir, u.name), u.size)
+	metricUploadFiles.Inc()
+	metricUploadBytes.Add("", float64(u.size))
+	s.files = append(s.files, filepath.ToSlash(u.name))
+	s.sums[filepath.ToSlash(u.name)] = fileSum{Size: int64(u.size), SHA256: hex.EncodeToString(u.sum.Sum(nil))}
+
+	return nil
+}
+
+// receiveFile receives the data of a C record and stores it as rel. If the
+// transfer fails nothing is stored. If times is set they are preserved on the
+// stored file. Errors storing the file are reported to the client as warnings
+// so the remaining files are still received.
+func (s *scpSink) receiveFile(rel string, mode os.FileMode, size uint64, times *fileTimes) error {
+	u := s.create(rel, mode, size)
+
+	if err := s.ack(); err != nil {
+		u.abort()
+		return err
+	}
+
+	if _, err := io.CopyN(u, s.r, int64(size)); err != nil {
+		u.abort()
+		return err
+	}
+
+	// The client ends the data with a zero byte or an error message.
+	if b, err := s.r.ReadByte(); err != nil {
+		u.abort()
+		return err
+	} else if b != 0 {
+		u.abort()
+		return fmt.Errorf("scp client aborted %s", rel)
+	}
+
+	if err := u.finish(times); err != nil {
+		logError.Printf("Unable to store %s: %s\n", filepath.Join(s.dir, u.name), err)
+		s.warn(fmt.Errorf("%s: %s", rel, err))
+		return nil
+	}
+
+	return s.ack()
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseRecord(t *testing.T) {
+	type testStruct struct {
+		mode os.FileMode
+		size uint64
+		name string
+		err  error
+	}
+
+	tests := make(map[string]testStruct)
+	tests["C0644 1024 file.txt\n"] = testStruct{0644, 1024, "file.txt", nil}
+	tests["D0755 0 dir\n"] = testStruct{0755, 0, "dir", nil}
+	tests["C0644 5 name with spaces\n"] = testStruct{0644, 5, "name with spaces", nil}
+	tests["C0644 5\n"] = testStruct{0, 0, "", errInvalidRecord}
+	tests["C0689 5 file\n"] = testStruct{0, 0, "", errInvalidRecord}
+	tests["C0644 -5 file\n"] = testStruct{0, 0, "", errInvalidRecord}
+	tests["C0644 5 ../file\n"] = testStruct{0, 0, "", errInvalidName}
+	tests["D0755 0 ..\n"] = testStruct{0, 0, "", errInvalidName}
+	tests["C0644 5 .file.gz.scpdrop\n"] = testStruct{0, 0, "", errInvalidName}
+	tests["D0755 0 .dir.part-1484388000000000000\n"] = testStruct{0, 0, "", errInvalidName}
+
+	for line, expected := range tests {
+		mode, size, name, err := parseRecord(line)
+		if err != expected.err {
+			t.Errorf("Error for %q (%v) does not match expected (%v)\n", line, err, expected.err)
+			continue
+		}
+		if mode != expected.mode || size != expected.size || name != expected.name {
+			t.Errorf("Record %q (%o %d %q) does not match expected (%o %d %q)\n", line, mode, size, name,
+				expected.mode, expected.size, expected.name)
+		}
+	}
+}
+
+func TestScpSinkReceive(t *testing.T) {
+	initLog("-", "none")
+
+	type testStruct struct {
+		target    string
+		recursive bool
+		input     string
+		files     []string
+		reply     string
+	}
+
+	tests := make(map[string]testStruct)
+	tests["file"] = testStruct{".", false, "C0644 4 file\ndata\x00",
+		[]string{"file"}, "\x00\x00\x00"}
+	tests["rename"] = testStruct{"renamed", false, "C0644 4 file\ndata\x00",
+		[]string{"renamed"}, "\x00\x00\x00"}
+	tests["recursive"] = testStruct{".", true, "D0755 0 sub\nC0644 4 file\ndata\x00E\nC0644 4 top\ndata\x00",
+		[]string{"sub/file", "top"}, "\x00\x00\x00\x00\x00\x00\x00"}
+	tests["new dir"] = testStruct{"newdir", true, "D0755 0 sub\nC0644 4 file\ndata\x00E\n",
+		[]string{"newdir/file"}, "\x00\x00\x00\x00\x00"}
+	tests["not recursive"] = testStruct{".", false, "D0755 0 sub\nC0644 4 file\ndata\x00E\n",
+		nil, "\x00\x02scp: " + errRecursiveUpload.Error() + "\n"}
+	tests["too large"] = testStruct{".", false, "C0644 11 large\ndata data!!\x00C0644 4 file\ndata\x00",
+		[]string{"file"}, "\x00\x00\x01scp: large: " + errFileTooLarge.Error() + "\n\x00\x00"}
+	tests["bad name"] = testStruct{".", false, "C0644 4 ../file\ndata\x00",
+		nil, "\x00\x02scp: " + errInvalidName.Error() + "\n"}
+	tests["partial"] = testStruct{".", false, "C0644 4 .file.part-1\ndata\x00",
+		nil, "\x00\x02scp: " + errInvalidName.Error() + "\n"}
+	tests["marker target"] = testStruct{".file.gz.scpdrop", false, "C0644 4 file\ndata\x00",
+		nil, "\x02scp: " + errInvalidName.Error() + "\n"}
+
+	for name, testIn := range tests {
+		dir, err := ioutil.TempDir("", "scpdropSinkTest")
+		if err != nil {
+			t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+		}
+
+		var reply bytes.Buffer
+		sink := newScpSink(bytes.NewBufferString(testIn.input), &reply, dir)
+		sink.recursive = testIn.recursive
+		sink.maxSize = 10
+		sink.receive(testIn.target, false)
+
+		if reply.String() != testIn.reply {
+			t.Errorf("Test %s reply (%q) does not match expected (%q)\n", name, reply.String(), testIn.reply)
+		}
+		if len(sink.files) != len(testIn.files) {
+			t.Errorf("Test %s files (%v) does not match expected (%v)\n", name, sink.files, testIn.files)
+		}
+		for i, f := range testIn.files {
+			if i < len(sink.files) && sink.files[i] != f {
+				t.Errorf("Test %s file (%s) does not match expected (%s)\n", name, sink.files[i], f)
+			}
+			if b, err := ioutil.ReadFile(filepath.Join(dir, f)); err != nil || string(b) != "data" {
+				t.Errorf("Test %s content of %s (%q) does not match expected (data): %v\n", name, f, b, err)
+			}
+			if sum := sink.sums[f]; sum.Size != 4 || sum.SHA256 != "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7" {
+				t.Errorf("Test %s checksum of %s (%v) does not match expected\n", name, f, sum)
+			}
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestParseTimes(t *testing.T) {
+	tests := make(map[string]*fileTimes)
+	tests["T1500000000 0 1400000000 0\n"] = &fileTimes{time.Unix(1500000000, 0), time.Unix(1400000000, 0)}
+	tests["T1500000000 250000 1400000000 5\n"] = &fileTimes{time.Unix(1500000000, 250000000), time.Unix(1400000000, 5000)}
+	tests["T1500000000 0 1400000000\n"] = nil
+	tests["T1500000000 1000000 1400000000 0\n"] = nil
+	tests["T-1 0 1400000000 0\n"] = nil
+	tests["Tnow 0 1400000000 0\n"] = nil
+
+	for line, expected := range tests {
+		times, err := parseTimes(line)
+		if expected == nil {
+			if err != errInvalidRecord {
+				t.Errorf("Error for %q (%v) does not match expected (%v)\n", line, err, errInvalidRecord)
+			}
+			continue
+		}
+		if err != nil || !times.mtime.Equal(expected.mtime) || !times.atime.Equal(expected.atime) {
+			t.Errorf("Times for %q (%v, %v) does not match expected (%v)\n", line, times, err, expected)
+		}
+	}
+}
+
+func TestScpSinkPreserveTimes(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSinkTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := "T1400000000 0 1400000000 0\nD0755 0 sub\nT1500000000 0 1500000000 0\nC0644 4 file\ndata\x00E\n"
+	var reply bytes.Buffer
+	sink := newScpSink(bytes.NewBufferString(input), &reply, dir)
+	sink.recursive = true
+	if err = sink.receive(".", false); err != nil {
+		t.Fatalf("Receive returned error: %s\n", err)
+	}
+
+	expected := map[string]int64{"sub": 1400000000, "sub/file": 1500000000}
+	for name, mtime := range expected {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Unable to stat %s: %s\n", name, err)
+		} else if fi.ModTime().Unix() != mtime {
+			t.Errorf("Mtime of %s (%d) does not match expected (%d)\n", name, fi.ModTime().Unix(), mtime)
+		}
+	}
+}
+
+func TestScpSinkConfined(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSinkTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	userDir := filepath.Join(dir, "user")
+	os.Mkdir(userDir, 0750)
+	os.Mkdir(filepath.Join(dir, "outside"), 0750)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600)
+	os.Symlink("../secret", filepath.Join(userDir, "link"))
+	os.Symlink("../outside", filepath.Join(userDir, "dirlink"))
+
+	inputs := []string{"C0644 4 link\ndata\x00", "D0755 0 dirlink\nC0644 4 file\ndata\x00E\n"}
+	for _, input := range inputs {
+		sink := newScpSink(bytes.NewBufferString(input), ioutil.Discard, userDir)
+		sink.recursive = true
+		sink.receive(".", false)
+		for _, f := range sink.files {
+			if fi, err := os.Lstat(filepath.Join(userDir, f)); err != nil || !fi.Mode().IsRegular() {
+				t.Errorf("File %s not stored as a regular file in the sink directory: %v\n", f, err)
+			}
+		}
+	}
+
+	if b, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(b) != "secret" {
+		t.Errorf("File outside the sink directory changed to %q\n", b)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "outside", "file")); !os.IsNotExist(err) {
+		t.Errorf("File created outside the sink directory: %v\n", err)
+	}
+}
+
+// testCheckReader calls check before the reads after the first one.
+type testCheckReader struct {
+	chunks []string
+	check  func()
+}
+
+func (r *testCheckReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	if r.check != nil && len(r.chunks) == 1 {
+		r.check()
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestScpSinkAtomic(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSinkTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The file only gets its name when all data is received.
+	checked := false
+	r := &testCheckReader{chunks: []string{"C0644 8 file\ndata", "data\x00"}}
+	r.check = func() {
+		checked = true
+		if _, err := os.Stat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+			t.Errorf("Partial upload visible under its name: %v\n", err)
+		}
+		if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 || !isPartial(entries[0].Name()) {
+			t.Errorf("Partial upload not written to a hidden file\n")
+		}
+	}
+	sink := newScpSink(r, ioutil.Discard, dir)
+	sink.receive(".", false)
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "file")); !checked || string(b) != "datadata" {
+		t.Errorf("Upload (%q, %v) does not match expected (%q)\n", b, err, "datadata")
+	}
+
+	// An aborted upload leaves nothing behind.
+	sink = newScpSink(bytes.NewBufferString("C0644 8 aborted\ndata"), ioutil.Discard, dir)
+	sink.receive(".", false)
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Aborted upload left %d files, expected 1\n", len(entries))
+	}
+}
+
+func TestRemovePartial(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSinkTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "sub"), 0750)
+	stale := filepath.Join(dir, "sub", filepath.Base(partialName("file")))
+	ioutil.WriteFile(stale, []byte("data"), 0600)
+	started := time.Now()
+	current := filepath.Join(dir, fmt.Sprintf(".file%s%d", partialMarker, started.Add(time.Second).UnixNano()))
+	ioutil.WriteFile(current, []byte("data"), 0600)
+	other := filepath.Join(dir, ".file.part-backup")
+	ioutil.WriteFile(other, []byte("data"), 0600)
+
+	removePartial(dir, started)
+
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Stale partial upload was not removed (%v)\n", err)
+	}
+	if _, err = os.Stat(current); err != nil {
+		t.Errorf("Partial upload started after the server was removed (%v)\n", err)
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Errorf("File that is not a partial upload was removed (%v)\n", err)
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errSkipped is returned when the client refused a single file or directory.
+var errSkipped = errors.New("Skipped by client")
+
+// scpSource sends files to an scp client the way "scp -f" does. Every file is
+// opened beneath the root of the user directory and compressed uploads are
+// downloaded as the original data.
+type scpSource struct {
+	r         *bufio.Reader
+	w         io.Writer
+	dir       string
+	recursive bool
+	preserve  bool
+
+	// published are more directories searched, in order, for paths that
+	// are not in dir.
+	published []string
+
+	// root is the directory the path being sent was found in and rootDir
+	// its path.
+	root    *os.Root
+	rootDir string
+}
+
+// newScpSource creates a source that sends files below dir on w and reads
+// the client responses from r.
+func newScpSource(r io.Reader, w io.Writer, dir string) *scpSource {
+	return &scpSource{r: bufio.NewReader(r), w: w, dir: dir}
+}
+
+// response reads the client response to the last record.
+func (s *scpSource) response() error {
+	b, err := s.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b == 0 {
+		return nil
+	}
+
+	msg, _ := s.r.ReadString('\n')
+	if b == 1 {
+		logWarning.Printf("scp client warning: %s", msg)
+		return errSkipped
+	}
+
+	return fmt.Errorf("scp client error: %s", strings.TrimSpace(msg))
+}
+
+// warn tells the client a single path could not be sent.
+func (s *scpSource) warn(err error) {
+	fmt.Fprintf(s.w, "\x01scp: %s\n", err)
+}
+
+// send sends the paths, relative to the source directory, given to "scp -f".
+// Every file is opened relative to the source directory, so neither the
+// paths nor symlinks below the directory can reach files outside of it.
+// Paths not found in the source directory are looked up in the published
+// directories. Directories that do not exist are skipped.
+func (s *scpSource) send(targets ...string) error {
+	var roots []*os.Root
+	var dirs []string
+	for _, dir := range append([]string{s.dir}, s.published...) {
+		root, err := os.OpenRoot(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		defer root.Close()
+		roots, dirs = append(roots, root), append(dirs, dir)
+	}
+
+	if err := s.response(); err != nil {
+		return err
+	}
+
+	for _, target := range targets {
+		if err := s.sendPath(roots, dirs, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// find returns the name and info of the file stored for name in root.
+func find(root *os.Root, name string) (string, os.FileInfo, error) {
+	fi, err := root.Stat(name)
+	if os.IsNotExist(err) {
+		// The client asks for the original name of a compressed upload.
+		if stored, ok := findCompressed(root, name); ok {
+			name = stored
+			fi, err = root.Stat(name)
+		}
+	}
+
+	return name, fi, err
+}
+
+// sendPath sends a single file or directory from the first of roots it is
+// found in.
+func (s *scpSource) sendPath(roots []*os.Root, dirs []string, target string) error {
+	var name string
+	var fi os.FileInfo
+	err := error(os.ErrNotExist)
+	for i, root := range roots {
+		// Files that are being received, or were left over by a crash,
+		// are not served.
+		if isPartial(filepath.Base(target)) || isCompressedMarker(filepath.Base(target)) {
+			break
+		}
+		if name, fi, err = find(root, filepath.Clean(target)); err == nil {
+			s.root, s.rootDir = root, dirs[i]
+			break
+		}
+	}
+	if err != nil {
+		logWarning.Printf("Unable to send %s from %s: %s\n", target, s.dir, err)
+		s.warn(fmt.Errorf("%s: No such file or directory", target))
+		return nil
+	}
+
+	if fi.IsDir() {
+		if !s.recursive {
+			s.warn(fmt.Errorf("%s: not a regular file", target))
+			return nil
+		}
+		err = s.sendDir(name, fi)
+	} else {
+		err = s.sendFile(name, fi)
+	}
+
+	if err == errSkipped {
+		return nil
+	}
+	return err
+}
+
+// sendTimes sends the times of a file or directory in a T record, like
+// "scp -p" does before the C or D record.
+func (s *scpSource) sendTimes(fi os.FileInfo) error {
+	mtime, atime := fi.ModTime(), accessTime(fi)
+	fmt.Fprintf(s.w, "T%d %d %d %d\n", mtime.Unix(), mtime.Nanosecond()/1000,
+		atime.Unix(), atime.Nanosecond()/1000)
+
+	return s.response()
+}
+
+// sendDir sends a directory and everything in it. name is relative to the
+// source directory.
+func (s *scpSource) sendDir(name string, fi os.FileInfo) error {
+	if s.preserve {
+		if err := s.sendTimes(fi); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(s.w, "D%04o 0 %s\n", fi.Mode().Perm(), fi.Name())
+	if err := s.response(); err != nil {
+		return err
+	}
+
+	var entries []os.FileInfo
+	d, err := s.root.Open(name)
+	if err == nil {
+		entries, err = d.Readdir(-1)
+		d.Close()
+	}
+	if err != nil {
+		logError.Printf("Unable to read directory %s: %s\n", filepath.Join(s.rootDir, name), err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	for _, entry := range entries {
+		child := filepath.Join(name, entry.Name())
+		switch {
+		case isPartial(entry.Name()), isCompressedMarker(entry.Name()):
+			continue
+		case entry.IsDir():
+			err = s.sendDir(child, entry)
+		case entry.Mode().IsRegular():
+			err = s.sendFile(child, entry)
+		default:
+			continue
+		}
+		if err != nil && err != errSkipped {
+			return err
+		}
+	}
+
+	fmt.Fprintf(s.w, "E\n")
+	return s.response()
+}
+
+// sendFile sends a single file. Uploads the server compressed are sent
+// decompressed and without the compression suffix, other files are sent as
+// they are stored. name is relative to the source directory.
+func (s *scpSource) sendFile(name string, fi os.FileInfo) error {
+	path := filepath.Join(s.rootDir, name)
+	base, size := fi.Name(), fi.Size()
+	open := func() (io.ReadCloser, error) { return s.root.Open(name) }
+	if original, ok := compressedSize(s.root, name, fi); ok {
+		base, _ = compressedName(base)
+		size = original
+		open = func() (io.ReadCloser, error) { return openDecompressed(s.root, name) }
+	}
+	if strings.Contains(base, "\n") {
+		logWarning.Printf("Not sending %s, newline in name\n", path)
+		return nil
+	}
+
+	r, err := open()
+	if err != nil {
+		logError.Printf("Unable to open %s: %s\n", path, err)
+		s.warn(fmt.Errorf("%s: %s", base, err))
+		return nil
+	}
+	defer r.Close()
+
+	if s.preserve {
+		if err = s.sendTimes(fi); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(s.w, "C%04o %d %s\n", fi.Mode().Perm(), size, base)
+	if err = s.response(); err != nil {
+		return err
+	}
+
+	// The size is already sent, so a file that changed can not be recovered.
+	if _, err = io.CopyN(s.w, r, size); err != nil {
+		return fmt.Errorf("Unable to send %s: %s", path, err)
+	}
+	s.w.Write([]byte{0})
+	if err = s.response(); err != nil {
+		return err
+	}
+
+	logInfo.Printf("Downloaded file %s Size %d\n", path, size)
+	metricDownloadFiles.Inc()
+	metricDownloadBytes.Add("", float64(size))
+
+	return nil
+}
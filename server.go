@@ -0,0 +1,517 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errServerClosed is returned by Serve after Shutdown has been called.
+var errServerClosed = errors.New("Server closed")
+
+// Server is an scp server that can be started and gracefully shut down.
+type Server struct {
+	listener      net.Listener
+	metricsServer *http.Server
+	adminServer   *http.Server
+	queue         *jobQueue
+	limits        rateLimits
+
+	mu          sync.Mutex
+	config      Config
+	sshConfig   *ssh.ServerConfig
+	hostKey     ssh.Signer
+	conns       map[*ssh.ServerConn]struct{}
+	sessions    sync.WaitGroup
+	active      map[uint64]sessionInfo
+	lastSession uint64
+	draining    bool
+	done        chan struct{}
+
+	// stopped is closed when the remaining connections are closed at the
+	// end of a shutdown.
+	stopped chan struct{}
+
+	// boot identifies this run of the server in webhook payloads.
+	boot string
+
+	// hooks are the webhook deliveries running in the background. No more
+	// are started once hooksClosed is set.
+	hooks       sync.WaitGroup
+	hooksClosed bool
+}
+
+// sessionInfo describes an active exec session.
+type sessionInfo struct {
+	ID         uint64    `json:"id"`
+	User       string    `json:"user"`
+	RemoteAddr string    `json:"remote_addr"`
+	Command    string    `json:"command"`
+	Started    time.Time `json:"started"`
+}
+
+// NewServer validates the config and prepares a server for it.
+func NewServer(config Config) (*Server, error) {
+	if err := validateServerConfig(config); err != nil {
+		return nil, err
+	}
+
+	hostKey, err := loadHostKey(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var queue *jobQueue
+	if config.QueueDir != "" {
+		if queue, err = newJobQueue(config.QueueDir); err != nil {
+			return nil, fmt.Errorf("QueueDir: %s", err)
+		}
+	}
+
+	return &Server{
+		config:    config,
+		sshConfig: newSSHConfig(config, hostKey),
+		hostKey:   hostKey,
+		queue:     queue,
+		conns:     make(map[*ssh.ServerConn]struct{}),
+		active:    make(map[uint64]sessionInfo),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+		boot:      strconv.FormatInt(time.Now().UnixNano(), 36),
+	}, nil
+}
+
+// validateServerConfig checks that the directories and files a config
+// points to are usable by the server.
+func validateServerConfig(config Config) error {
+	passwdExists, _ := isFile(config.PasswdFile)
+	keysDirEmpty, _ := isEmptyDir(config.KeysDir)
+	if !passwdExists && keysDirEmpty {
+		return fmt.Errorf("No passwd file or keys directory")
+	}
+
+	b, err := dirExists(config.UsersDir)
+	if err != nil {
+		return fmt.Errorf("UsersDir: %v", err)
+	} else if b == false {
+		return fmt.Errorf("UsersDir does not exist")
+	}
+
+	if (len(config.Cmd) != 0 || len(config.Stages) != 0) && runtime.GOOS == "windows" {
+		return fmt.Errorf("Cmd not available on windows")
+	}
+
+	if err := checkUserStages(config); err != nil {
+		return err
+	}
+
+	if config.ClamdSocket != "" && config.QuarantineDir == "" {
+		return fmt.Errorf("QuarantineDir is required for ClamdSocket")
+	}
+
+	if config.EncryptTo != "" {
+		keys, err := readKeyRing(config.EncryptTo)
+		if err == nil {
+			err = checkEncryptionKeys(keys)
+		}
+		if err != nil {
+			return fmt.Errorf("EncryptTo: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// loadHostKey loads the configured private key or generates a new one if
+// none is set.
+func loadHostKey(config Config) (ssh.Signer, error) {
+	if config.PrivateKey == "" {
+		private, err := generateRSAPrivateKeySigner(2048)
+		if err != nil {
+			return nil, fmt.Errorf("Error while generating private key: %s", err)
+		}
+		return private, nil
+	}
+
+	private, err := loadPrivateKey(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Error while reading private key: %s", err)
+	}
+
+	return private, nil
+}
+
+// newSSHConfig creates the ssh server configuration for a config and host key.
+func newSSHConfig(config Config, hostKey ssh.Signer) *ssh.ServerConfig {
+	helper := validationHelper{PasswdFile: config.PasswdFile, KeysDir: config.KeysDir}
+	sshConfig := &ssh.ServerConfig{
+		ServerVersion:     "SSH-2.0-scpDrop-" + scpDropVersion,
+		PasswordCallback:  helper.validateUser,
+		PublicKeyCallback: helper.validatePubKey,
+	}
+	sshConfig.AddHostKey(hostKey)
+
+	return sshConfig
+}
+
+// Start opens the listener and serves connections in the background.
+func (s *Server) Start() error {
+	config, _ := s.currentConfig()
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for connection: %s", err)
+	}
+	s.listener = listener
+
+	if config.MetricsListen != "" {
+		metricsListener, err := net.Listen("tcp", config.MetricsListen)
+		if err != nil {
+			listener.Close()
+			return fmt.Errorf("Failed to listen for metrics: %s", err)
+		}
+
+		s.metricsServer = newMetricsServer(config.MetricsListen)
+		go s.metricsServer.Serve(metricsListener)
+		logInfo.Printf("Serving metrics on %s\n", metricsListener.Addr())
+	}
+
+	if config.AdminListen != "" {
+		if config.AdminToken == "" {
+			s.closeListeners()
+			return fmt.Errorf("AdminToken is required for the admin API")
+		}
+
+		adminListener, err := listenAdmin(config.AdminListen)
+		if err != nil {
+			s.closeListeners()
+			return fmt.Errorf("Failed to listen for admin API: %s", err)
+		}
+
+		s.adminServer = newAdminServer(s, config.AdminToken)
+		go s.adminServer.Serve(adminListener)
+		logInfo.Printf("Serving admin API on %s\n", config.AdminListen)
+	}
+
+	go removeStalePartial(config, time.Now())
+	go s.retryWebhooks()
+	go s.cleanResumeDir()
+	go s.expireUsers()
+
+	if s.queue != nil {
+		go s.queue.run(config.Workers, func() Config {
+			c, _ := s.currentConfig()
+			return c
+		}, s.done)
+	}
+
+	logInfo.Println("Service started")
+	go s.Serve()
+
+	return nil
+}
+
+// retryWebhooks periodically delivers spooled webhook notifications until
+// the server is shut down.
+func (s *Server) retryWebhooks() {
+	ticker := time.NewTicker(webhookSpoolInterval)
+	defer ticker.Stop()
+
+	for {
+		config, _ := s.currentConfig()
+		if hook := newWebhook(config); hook != nil {
+			hook.flushSpool()
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Addr returns the address the server is listening on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts incoming connections until Shutdown is called.
+func (s *Server) Serve() error {
+	for {
+		nConn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return errServerClosed
+			default:
+			}
+			logWarning.Printf("Failed to accept incoming connection: %s\n", err)
+			continue
+		}
+		metricConnections.Inc()
+
+		go s.handleConn(nConn)
+	}
+}
+
+// handleConn performs the ssh handshake and dispatches the connection.
+func (s *Server) handleConn(nConn net.Conn) {
+	config, sshConfig := s.currentConfig()
+
+	// Clients that do not finish the handshake and authentication in time
+	// are disconnected.
+	if config.HandshakeTimeout > 0 {
+		nConn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+	}
+	sshConn, chans, reqs, err := ssh.NewServerConn(nConn, sshConfig)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			countTimeout(timeoutHandshake)
+		}
+		logWarning.Printf("Failed to handshake with %s: %s\n", nConn.RemoteAddr().String(), err)
+		return
+	}
+	nConn.SetDeadline(time.Time{})
+
+	if sshConn.Permissions != nil && sshConn.Permissions.Extensions["method"] == "publickey" {
+		logInfo.Printf("Login: %s\n", sshConn.User())
+		countAuth("publickey", true)
+	}
+
+	if !s.trackConn(sshConn) {
+		logInfo.Printf("Shutting down, closing connection with %s\n", sshConn.RemoteAddr().String())
+		sshConn.Close()
+		return
+	}
+	defer s.untrackConn(sshConn)
+
+	logInfo.Printf("Connection established  with %s\n", sshConn.RemoteAddr().String())
+
+	go handleRequests(reqs)
+	s.handleChannels(chans, sshConn.Permissions, sshConn.RemoteAddr().String(), config)
+}
+
+// currentConfig returns the config and ssh config used for new connections.
+func (s *Server) currentConfig() (Config, *ssh.ServerConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.config, s.sshConfig
+}
+
+// trackConn registers a connection. It returns false if the server is shutting down.
+func (s *Server) trackConn(c *ssh.ServerConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return false
+	}
+	s.conns[c] = struct{}{}
+
+	return true
+}
+
+// untrackConn removes a connection from the server.
+func (s *Server) untrackConn(c *ssh.ServerConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c)
+}
+
+// beginSession registers an active exec session and returns its id. It
+// returns false if the server is shutting down and no new sessions are allowed.
+func (s *Server) beginSession(user string, address string, command string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.draining {
+		return 0, false
+	}
+	s.sessions.Add(1)
+	metricActiveSessions.Inc()
+
+	s.lastSession++
+	s.active[s.lastSession] = sessionInfo{ID: s.lastSession, User: user, RemoteAddr: address,
+		Command: command, Started: time.Now()}
+
+	return s.lastSession, true
+}
+
+// endSession marks an exec session as finished.
+func (s *Server) endSession(id uint64) {
+	s.mu.Lock()
+	delete(s.active, id)
+	s.mu.Unlock()
+
+	metricActiveSessions.Dec()
+	s.sessions.Done()
+}
+
+// activeSessions returns the currently running exec sessions ordered by id.
+func (s *Server) activeSessions() (sessions []sessionInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, info := range s.active {
+		sessions = append(sessions, info)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+
+	return sessions
+}
+
+// closeConns closes all open connections.
+func (s *Server) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	close(s.stopped)
+
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// closeListeners closes the scp listener and the http servers.
+func (s *Server) closeListeners() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+}
+
+// Shutdown stops accepting new connections and waits for active sessions to
+// finish. If ctx expires first the remaining connections are closed and the
+// context error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return errServerClosed
+	}
+	s.draining = true
+	close(s.done)
+	s.mu.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+
+	logInfo.Println("Shutting down, waiting for active sessions")
+
+	drained := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		logInfo.Println("All sessions finished")
+	case <-ctx.Done():
+		logWarning.Println("Drain timeout exceeded, closing active sessions")
+		err = ctx.Err()
+	}
+
+	if s.queue != nil && err == nil {
+		if err = s.queue.wait(ctx); err != nil {
+			logWarning.Println("Drain timeout exceeded, unfinished jobs will run on next start")
+		}
+	}
+
+	if err == nil {
+		if err = s.waitWebhooks(ctx); err != nil {
+			logWarning.Println("Drain timeout exceeded, spooling pending webhooks")
+		}
+	}
+
+	s.closeConns()
+	s.closeListeners()
+
+	s.mu.Lock()
+	s.hooksClosed = true
+	s.mu.Unlock()
+	s.hooks.Wait()
+	logInfo.Println("Service stopped")
+
+	return err
+}
+
+// removeStalePartial removes the partial uploads created before started
+// from the directories users upload to.
+func removeStalePartial(config Config, started time.Time) {
+	for _, dir := range uploadDirs(config) {
+		removePartial(dir, started)
+	}
+}
+
+// uploadDirs returns the directories of config that uploads are stored in,
+// without directories that are below another one.
+func uploadDirs(config Config) []string {
+	dirs := []string{config.SharedDir, config.UsersDir}
+
+	users, err := listUsers(config.PasswdFile)
+	if err != nil {
+		logError.Printf("Unable to read users: %s\n", err)
+	}
+	for _, userInfo := range users {
+		dirs = append(dirs, string(userInfo.UserDir))
+	}
+
+	keyUsers(config.KeysDir, func(user string, privs []string) error {
+		dirs = append(dirs, privs[1])
+		return nil
+	})
+
+	var clean []string
+	for _, dir := range dirs {
+		if dir != "" {
+			clean = append(clean, addSepSuffix(filepath.Clean(dir)))
+		}
+	}
+	sort.Strings(clean)
+
+	var out []string
+	for _, dir := range clean {
+		if len(out) == 0 || !strings.HasPrefix(dir, out[len(out)-1]) {
+			out = append(out, dir)
+		}
+	}
+
+	return out
+}
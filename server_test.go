@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServerConfig creates a temporary server setup with a single permanent
+// plain text user "testuser" with password "testpass".
+func testServerConfig(t *testing.T) (config Config, cleanup func()) {
+	dir, err := ioutil.TempDir("", "scpdropServerTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+
+	usersDir := filepath.Join(dir, "users")
+	if err = os.Mkdir(usersDir, 0750); err != nil {
+		t.Fatalf("FATAL - Unable to create users directory: %s\n", err)
+	}
+
+	passwdFile := filepath.Join(dir, "passwd")
+	line := "testuser:$0$testpass:rw:" + addSepSuffix(usersDir) + ":0::p\n"
+	if err = ioutil.WriteFile(passwdFile, []byte(line), 0644); err != nil {
+		t.Fatalf("FATAL - Unable to create passwd file: %s\n", err)
+	}
+
+	config = addConfigDefaults(Config{Listen: "127.0.0.1:0", UsersDir: addSepSuffix(usersDir),
+		PasswdFile: passwdFile})
+
+	return config, func() { os.RemoveAll(dir) }
+}
+
+// testStartServer creates and starts a server for config.
+func testStartServer(config Config, t *testing.T) *Server {
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create server: %s\n", err)
+	}
+	if err = server.Start(); err != nil {
+		t.Fatalf("FATAL - Unable to start server: %s\n", err)
+	}
+
+	return server
+}
+
+// testDial connects to a test server as testuser.
+func testDial(server *Server) (*ssh.Client, error) {
+	return ssh.Dial("tcp", server.Addr().String(), &ssh.ClientConfig{
+		User:            "testuser",
+		Auth:            []ssh.AuthMethod{ssh.Password("testpass")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+func TestServerShutdown(t *testing.T) {
+	initLog("-", "none")
+	config, cleanup := testServerConfig(t)
+	defer cleanup()
+
+	server := testStartServer(config, t)
+
+	client, err := testDial(server)
+	if err != nil {
+		t.Fatalf("Unable to connect to server: %s\n", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown without active sessions returned %s\n", err)
+	}
+
+	if conn, err := net.DialTimeout("tcp", server.Addr().String(), time.Second); err == nil {
+		conn.Close()
+		t.Errorf("Server still accepting connections after shutdown\n")
+	}
+
+	if err = server.Shutdown(ctx); err != errServerClosed {
+		t.Errorf("Second shutdown returned (%v), expected (%v)\n", err, errServerClosed)
+	}
+}
+
+func TestServerShutdownDrain(t *testing.T) {
+	initLog("-", "none")
+	config, cleanup := testServerConfig(t)
+	defer cleanup()
+
+	tests := make(map[time.Duration]error)
+	tests[5*time.Second] = nil
+	tests[100*time.Millisecond] = context.DeadlineExceeded
+
+	for timeout, expectedOut := range tests {
+		server := testStartServer(config, t)
+
+		client, err := testDial(server)
+		if err != nil {
+			t.Fatalf("Unable to connect to server: %s\n", err)
+		}
+
+		// The exec request is only answered once the upload has finished,
+		// so the channel is used directly. The client ends the upload after
+		// two seconds.
+		channel, reqs, err := client.OpenChannel("session", nil)
+		if err != nil {
+			t.Fatalf("Unable to open session: %s\n", err)
+		}
+		go ssh.DiscardRequests(reqs)
+		channel.SendRequest("exec", false, ssh.Marshal(struct{ Command string }{"scp -t file"}))
+		go io.Copy(ioutil.Discard, channel)
+		time.AfterFunc(2*time.Second, func() { channel.CloseWrite() })
+		time.Sleep(300 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err = server.Shutdown(ctx); err != expectedOut {
+			t.Errorf("Shutdown with timeout %s returned (%v), expected (%v)\n", timeout, err, expectedOut)
+		}
+		cancel()
+
+		channel.Close()
+		client.Close()
+	}
+}
+
+// testProbeSigner offers a public key without holding its private key.
+type testProbeSigner struct {
+	ssh.Signer
+}
+
+func (s testProbeSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return nil, errors.New("No private key")
+}
+
+func TestServerCountsKeyLogins(t *testing.T) {
+	initLog("-", "none")
+	config, cleanup := testServerConfig(t)
+	defer cleanup()
+
+	keysDir, err := ioutil.TempDir("", "scpdropServerTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(keysDir)
+
+	key, err := generateRSAPrivateKeySigner(1024)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to generate key: %s\n", err)
+	}
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key.PublicKey()))) + " rw:" + config.UsersDir + ":0:\n"
+	if err = ioutil.WriteFile(filepath.Join(keysDir, "testy"), []byte(line), 0644); err != nil {
+		t.Fatalf("FATAL - Unable to write key file: %s\n", err)
+	}
+	config.KeysDir = addSepSuffix(keysDir)
+
+	server := testStartServer(config, t)
+	defer server.Shutdown(context.Background())
+
+	label := `method="publickey",result="success"`
+	before := metricAuth.Value(label)
+
+	dial := func(signer ssh.Signer) error {
+		client, err := ssh.Dial("tcp", server.Addr().String(), &ssh.ClientConfig{
+			User:            "testy",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			Timeout:         5 * time.Second,
+		})
+		if err == nil {
+			client.Close()
+		}
+		return err
+	}
+
+	// A client that only asks if the key is accepted is not logged in.
+	if err = dial(testProbeSigner{key}); err == nil {
+		t.Errorf("Login without the private key succeeded\n")
+	}
+	if v := metricAuth.Value(label); v != before {
+		t.Errorf("Public key logins after probe (%v) does not match expected (%v)\n", v, before)
+	}
+
+	if err = dial(key); err != nil {
+		t.Fatalf("Unable to log in with key: %s\n", err)
+	}
+	// The server counts the login after the client is told it succeeded.
+	deadline := time.Now().Add(5 * time.Second)
+	for metricAuth.Value(label) == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v := metricAuth.Value(label); v != before+1 {
+		t.Errorf("Public key logins (%v) does not match expected (%v)\n", v, before+1)
+	}
+}
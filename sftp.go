@@ -0,0 +1,318 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/sftp"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumeCleanInterval is how often expired partial uploads are removed.
+const resumeCleanInterval = 10 * time.Minute
+
+// sftpHandler serves the sftp subsystem for resumable uploads. The data of
+// an upload is written to a staging directory at the offsets the client
+// sends. When the client closes the file it is stored by the sink like an
+// scp upload. If the connection drops the staged data is kept, so the client
+// can continue the upload from the last received byte with "reput".
+type sftpHandler struct {
+	sink     *scpSink
+	stageDir string
+	timeout  time.Duration
+
+	// mu serializes storing finished uploads in the sink.
+	mu sync.Mutex
+}
+
+// newSftpHandler creates a handler storing uploads with sink. Partial
+// uploads are staged in stageDir for timeout.
+func newSftpHandler(sink *scpSink, stageDir string, timeout time.Duration) (*sftpHandler, error) {
+	if err := os.MkdirAll(stageDir, 0700); err != nil {
+		return nil, err
+	}
+
+	root, err := os.OpenRoot(sink.dir)
+	if err != nil {
+		return nil, err
+	}
+	sink.root = root
+
+	return &sftpHandler{sink: sink, stageDir: stageDir, timeout: timeout}, nil
+}
+
+// stageDirName returns the name of the staging directory of user below
+// ResumeDir. The name is a hash so no username can point elsewhere.
+func stageDirName(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:16])
+}
+
+// close releases the sink directory.
+func (h *sftpHandler) close() {
+	h.sink.root.Close()
+}
+
+// stagedPath returns where the partial upload of rel is staged. Every upload
+// is a single file named after the escaped path.
+func (h *sftpHandler) stagedPath(rel string) string {
+	return filepath.Join(h.stageDir, url.PathEscape(rel))
+}
+
+// staged returns the info of the partial upload of rel. Expired partial
+// uploads are removed. With a ResumeTimeout of 0 partial uploads never
+// expire, as they are removed when the connection drops.
+func (h *sftpHandler) staged(rel string) (os.FileInfo, error) {
+	fi, err := os.Stat(h.stagedPath(rel))
+	if err != nil {
+		return nil, err
+	}
+	if h.timeout != discardPartial && time.Since(fi.ModTime()) > h.timeout {
+		os.Remove(h.stagedPath(rel))
+		return nil, os.ErrNotExist
+	}
+
+	return namedInfo{FileInfo: fi, name: filepath.Base(rel)}, nil
+}
+
+// sftpRel returns a request path relative to the sink directory.
+func sftpRel(r *sftp.Request) string {
+	return strings.TrimPrefix(filepath.Clean(r.Filepath), "/")
+}
+
+// Filewrite opens the staged file of an upload. The staged data is kept
+// unless the client truncates the file, so offsets continue a partial upload.
+func (h *sftpHandler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	rel := sftpRel(r)
+	if rel == "" || reservedName(filepath.Base(rel)) {
+		return nil, sftp.ErrSSHFxFailure
+	}
+	if fi, err := h.sink.root.Stat(filepath.Dir(rel)); err != nil || !fi.IsDir() {
+		return nil, sftp.ErrSSHFxNoSuchFile
+	}
+	if _, err := h.staged(rel); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	flags := os.O_RDWR | os.O_CREATE
+	if r.Pflags().Trunc {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(h.stagedPath(rel), flags, 0600)
+	if err != nil {
+		logError.Printf("Unable to stage %s: %s\n", rel, err)
+		return nil, sftp.ErrSSHFxFailure
+	}
+
+	return &sftpUpload{h: h, rel: rel, f: f}, nil
+}
+
+// Fileread refuses downloads, the subsystem only takes uploads.
+func (h *sftpHandler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return nil, sftp.ErrSSHFxPermissionDenied
+}
+
+// Filecmd accepts setting attributes, which are ignored, and refuses
+// everything else.
+func (h *sftpHandler) Filecmd(r *sftp.Request) error {
+	if r.Method == "Setstat" {
+		return nil
+	}
+
+	return sftp.ErrSSHFxPermissionDenied
+}
+
+// Filelist answers stat requests for directories and partial uploads, so a
+// client can find out where to continue an upload. Listing is refused.
+func (h *sftpHandler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	if r.Method != "Stat" {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	rel := sftpRel(r)
+	if rel != "" {
+		if fi, err := h.staged(rel); err == nil {
+			return listerAt{fi}, nil
+		}
+	}
+
+	fi, err := h.sink.root.Stat(filepath.Join(".", rel))
+	if err != nil || !fi.IsDir() {
+		return nil, sftp.ErrSSHFxNoSuchFile
+	}
+
+	return listerAt{fi}, nil
+}
+
+// sftpUpload is an upload staged by the sftp subsystem.
+type sftpUpload struct {
+	h   *sftpHandler
+	rel string
+	f   *os.File
+
+	// ended is set when the connection ended with the file still open.
+	ended bool
+}
+
+// WriteAt writes p to the staged file. Uploads larger than the size limit
+// of the user are refused.
+func (u *sftpUpload) WriteAt(p []byte, off int64) (int, error) {
+	if max := u.h.sink.maxSize; max != 0 && uint64(off)+uint64(len(p)) > max {
+		return 0, errFileTooLarge
+	}
+
+	return u.f.WriteAt(p, off)
+}
+
+// TransferError is called when the connection ends before the file is
+// closed by the client.
+func (u *sftpUpload) TransferError(err error) {
+	logInfo.Printf("Upload of %s interrupted: %s\n", u.rel, err)
+	u.ended = true
+}
+
+// Close stores the staged file with the sink, unless the connection ended
+// before the client closed it. The staged file is then kept so the upload
+// can be continued, unless ResumeTimeout is 0.
+func (u *sftpUpload) Close() error {
+	defer u.f.Close()
+
+	fi, err := u.f.Stat()
+	if err != nil {
+		return err
+	}
+	if u.ended && u.h.timeout == discardPartial {
+		logInfo.Printf("Removed partial upload %s Size %d\n", u.rel, fi.Size())
+		return os.Remove(u.f.Name())
+	}
+	if u.ended {
+		logInfo.Printf("Kept partial upload %s Size %d\n", u.rel, fi.Size())
+		return nil
+	}
+	defer os.Remove(u.f.Name())
+
+	s := u.h.sink
+	name, err := s.names.clean(filepath.Base(u.rel))
+	if err != nil {
+		return err
+	}
+	rel := filepath.Join(filepath.Dir(u.rel), name)
+
+	u.h.mu.Lock()
+	defer u.h.mu.Unlock()
+
+	// Uploads stored as they are sent are renamed over the file created
+	// by the sink instead of copied, after they are read for the checksum.
+	// The data is copied if the staging directory is on another file system.
+	up := s.create(rel, 0644, uint64(fi.Size()))
+	moved := false
+	if up.direct() && u.f.Chmod(0644) == nil {
+		if _, err = io.Copy(up.sum, io.NewSectionReader(u.f, 0, fi.Size())); err != nil {
+			up.abort()
+			return err
+		}
+		if moved = renameIntoRoot(u.f.Name(), s.root, up.tmp) == nil; !moved {
+			up.sum.Reset()
+		}
+	}
+	if !moved {
+		if _, err = io.Copy(up, io.NewSectionReader(u.f, 0, fi.Size())); err != nil {
+			up.abort()
+			return err
+		}
+	}
+	if err = up.finish(nil); err != nil {
+		logError.Printf("Unable to store %s: %s\n", filepath.Join(s.dir, up.name), err)
+		return err
+	}
+
+	return nil
+}
+
+// namedInfo is file info with another name.
+type namedInfo struct {
+	os.FileInfo
+	name string
+}
+
+// Name returns the name.
+func (n namedInfo) Name() string {
+	return n.name
+}
+
+// listerAt lists a fixed set of files.
+type listerAt []os.FileInfo
+
+// ListAt copies the files from offset to ls.
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// cleanResumeDir periodically removes partial uploads that were not
+// continued within ResumeTimeout until the server is shut down.
+func (s *Server) cleanResumeDir() {
+	ticker := time.NewTicker(resumeCleanInterval)
+	defer ticker.Stop()
+
+	for {
+		config, _ := s.currentConfig()
+		if config.ResumeDir != "" {
+			removeExpired(config.ResumeDir, config.ResumeTimeout)
+		}
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// removeExpired removes the files below dir that were not written to for
+// longer than timeout. Nothing is removed for discardPartial, the staged
+// files are then those of uploads still in progress.
+func removeExpired(dir string, timeout time.Duration) {
+	if timeout == discardPartial {
+		return
+	}
+
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() || time.Since(fi.ModTime()) <= timeout {
+			return nil
+		}
+
+		logInfo.Printf("Removing expired partial upload %s\n", path)
+		if err := os.Remove(path); err != nil {
+			logError.Printf("Unable to remove %s: %s\n", path, err)
+		}
+		return nil
+	})
+}
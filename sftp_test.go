@@ -0,0 +1,210 @@
+package main
+
+import (
+	"github.com/pkg/sftp"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sftpPut returns a request opening path for writing, truncated if trunc is set.
+func sftpPut(path string, trunc bool) *sftp.Request {
+	r := sftp.NewRequest("Put", path)
+	r.Flags = 0x02 | 0x08 // write, create
+	if trunc {
+		r.Flags |= 0x10
+	}
+	return r
+}
+
+func TestSftpHandlerResume(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSftpTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	userDir := filepath.Join(dir, "user")
+	stageDir := filepath.Join(dir, "resume", "testy")
+	os.Mkdir(userDir, 0750)
+
+	sink := newScpSink(nil, nil, userDir)
+	sink.maxSize = 10
+	h, err := newSftpHandler(sink, stageDir, time.Hour)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create handler: %s\n", err)
+	}
+	defer h.close()
+
+	// The first connection drops after half the file.
+	w, err := h.Filewrite(sftpPut("/big.bin", true))
+	if err != nil {
+		t.Fatalf("FATAL - Unable to open upload: %s\n", err)
+	}
+	w.WriteAt([]byte("01234"), 0)
+	w.(*sftpUpload).TransferError(os.ErrClosed)
+	if err = w.(*sftpUpload).Close(); err != nil {
+		t.Errorf("Close of interrupted upload returned error (%v)\n", err)
+	}
+	if _, err = os.Stat(filepath.Join(userDir, "big.bin")); !os.IsNotExist(err) {
+		t.Errorf("Interrupted upload was stored (%v)\n", err)
+	}
+
+	l, err := h.Filelist(sftp.NewRequest("Stat", "/big.bin"))
+	if err != nil {
+		t.Fatalf("FATAL - Unable to stat partial upload: %s\n", err)
+	}
+	infos := make([]os.FileInfo, 1)
+	l.ListAt(infos, 0)
+	if infos[0].Size() != 5 || infos[0].Name() != "big.bin" {
+		t.Errorf("Partial upload (%s %d) does not match expected (big.bin 5)\n", infos[0].Name(), infos[0].Size())
+	}
+
+	// The client continues where it stopped.
+	w, err = h.Filewrite(sftpPut("/big.bin", false))
+	if err != nil {
+		t.Fatalf("FATAL - Unable to open upload: %s\n", err)
+	}
+	w.WriteAt([]byte("56789"), 5)
+	if err = w.(*sftpUpload).Close(); err != nil {
+		t.Errorf("Close of resumed upload returned error (%v)\n", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(userDir, "big.bin"))
+	if string(data) != "0123456789" {
+		t.Errorf("Stored upload (%q, %v) does not match expected (%q)\n", data, err, "0123456789")
+	}
+	if fi, err := os.Stat(filepath.Join(userDir, "big.bin")); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("Mode of stored upload (%v) does not match expected (%v)\n", fi, os.FileMode(0644))
+	}
+	if !reflect.DeepEqual(sink.files, []string{"big.bin"}) {
+		t.Errorf("Uploaded files (%v) does not match expected ([big.bin])\n", sink.files)
+	}
+	sum := fileSum{10, "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"}
+	if sink.sums["big.bin"] != sum {
+		t.Errorf("Checksum of upload (%v) does not match expected (%v)\n", sink.sums["big.bin"], sum)
+	}
+	if entries, _ := ioutil.ReadDir(stageDir); len(entries) != 0 {
+		t.Errorf("Staged files (%d) does not match expected (0)\n", len(entries))
+	}
+	if _, err = h.Filelist(sftp.NewRequest("Stat", "/big.bin")); err == nil {
+		t.Errorf("Stat of stored upload did not return an error\n")
+	}
+
+	// Uploads larger than the size limit are refused.
+	w, _ = h.Filewrite(sftpPut("/huge.bin", true))
+	if _, err = w.WriteAt([]byte("0123456789"), 5); err != errFileTooLarge {
+		t.Errorf("Write past size limit (%v) does not match expected (%v)\n", err, errFileTooLarge)
+	}
+	w.(*sftpUpload).TransferError(os.ErrClosed)
+	w.(*sftpUpload).Close()
+
+	// Uploads to directories that do not exist are refused.
+	if _, err = h.Filewrite(sftpPut("/missing/file", true)); err == nil {
+		t.Errorf("Upload to missing directory did not return an error\n")
+	}
+
+	// Names of compression markers and partial uploads are refused.
+	if _, err = h.Filewrite(sftpPut("/.big.bin.gz.scpdrop", true)); err == nil {
+		t.Errorf("Upload of compression marker did not return an error\n")
+	}
+
+	if _, err = h.Filewrite(sftpPut("/.big.bin.part-1", true)); err == nil {
+		t.Errorf("Upload of partial file name did not return an error\n")
+	}
+
+	// Downloads are refused.
+	if _, err = h.Fileread(sftp.NewRequest("Get", "/big.bin")); err == nil {
+		t.Errorf("Download did not return an error\n")
+	}
+}
+
+func TestSftpHandlerDiscardPartial(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSftpTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	userDir := filepath.Join(dir, "user")
+	stageDir := filepath.Join(dir, "resume", stageDirName("testy"))
+	os.Mkdir(userDir, 0750)
+
+	h, err := newSftpHandler(newScpSink(nil, nil, userDir), stageDir, discardPartial)
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create handler: %s\n", err)
+	}
+	defer h.close()
+
+	// With a ResumeTimeout of 0 nothing is kept when the connection drops.
+	w, err := h.Filewrite(sftpPut("/big.bin", true))
+	if err != nil {
+		t.Fatalf("FATAL - Unable to open upload: %s\n", err)
+	}
+	w.WriteAt([]byte("01234"), 0)
+	past := time.Now().Add(-time.Hour)
+	os.Chtimes(h.stagedPath("big.bin"), past, past)
+	if _, err = h.staged("big.bin"); err != nil {
+		t.Errorf("Staged file of open upload was removed (%v)\n", err)
+	}
+	w.(*sftpUpload).TransferError(os.ErrClosed)
+	if err = w.(*sftpUpload).Close(); err != nil {
+		t.Errorf("Close of interrupted upload returned error (%v)\n", err)
+	}
+	if entries, _ := ioutil.ReadDir(stageDir); len(entries) != 0 {
+		t.Errorf("Staged files (%d) does not match expected (0)\n", len(entries))
+	}
+}
+
+func TestStageDirName(t *testing.T) {
+	for _, user := range []string{"testy", "..", "../testy", "te/sty", ""} {
+		name := stageDirName(user)
+		if len(name) != 32 || strings.Trim(name, "0123456789abcdef") != "" {
+			t.Errorf("Staging directory of %q (%q) is not a hex hash\n", user, name)
+		}
+	}
+	if stageDirName("testy") == stageDirName("testy2") {
+		t.Errorf("Different users share a staging directory\n")
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropSftpTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "testy"), 0700)
+	old := filepath.Join(dir, "testy", "old")
+	recent := filepath.Join(dir, "testy", "recent")
+	ioutil.WriteFile(old, []byte("old"), 0600)
+	ioutil.WriteFile(recent, []byte("recent"), 0600)
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	// With a ResumeTimeout of 0 the staged files are uploads in progress.
+	removeExpired(dir, discardPartial)
+	if _, err = os.Stat(old); err != nil {
+		t.Errorf("Partial upload removed without ResumeTimeout (%v)\n", err)
+	}
+
+	removeExpired(dir, time.Hour)
+
+	if _, err = os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Expired partial upload was not removed (%v)\n", err)
+	}
+	if _, err = os.Stat(recent); err != nil {
+		t.Errorf("Recent partial upload was removed (%v)\n", err)
+	}
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// shareCleanInterval is how often expired users and shares are removed.
+const shareCleanInterval = time.Minute
+
+// errors returned when creating a share
+var (
+	errNoShareDir  = errors.New("No ShareDir configured")
+	errShareSource = errors.New("Only regular files can be shared")
+)
+
+// shareInfo describes a file shared with a one-shot download user.
+type shareInfo struct {
+	User    string
+	File    string
+	Source  string
+	Expires time.Time
+}
+
+// shareRequest holds the options of the share command.
+type shareRequest struct {
+	File   string
+	Host   string
+	Expire time.Duration
+	Copy   bool
+}
+
+// createShare places a file in a directory of its own below ShareDir and
+// adds a temporary download only user for it that expires with the share.
+// The file is hard-linked, or copied if that is not possible or req.Copy is
+// set. It returns the share and the generated password of the user.
+func createShare(config Config, req shareRequest) (share shareInfo, password []byte, err error) {
+	if config.ShareDir == "" {
+		return share, nil, errNoShareDir
+	}
+
+	fi, err := os.Stat(req.File)
+	if err != nil {
+		return share, nil, err
+	}
+	if !fi.Mode().IsRegular() || strings.Contains(fi.Name(), "\n") {
+		return share, nil, errShareSource
+	}
+
+	users, err := listUsers(config.PasswdFile)
+	if err != nil {
+		return share, nil, err
+	}
+	username := randUser(config)
+	for i := 0; i < len(users); i++ {
+		if string(users[i].Username) == string(username) {
+			username, i = randUser(config), -1
+		}
+	}
+
+	source, err := filepath.Abs(req.File)
+	if err != nil {
+		return share, nil, err
+	}
+	share = shareInfo{User: string(username), File: fi.Name(), Source: source, Expires: time.Now().Add(req.Expire)}
+
+	dir := filepath.Join(config.ShareDir, share.User)
+	if err = os.Mkdir(dir, 0750); err != nil {
+		return share, nil, fmt.Errorf("Unable to create share directory: %s", err)
+	}
+	if err = placeShareFile(source, filepath.Join(dir, share.File), req.Copy); err != nil {
+		os.RemoveAll(dir)
+		return share, nil, err
+	}
+
+	password = randPass(config)
+	userInfo := UserInfo{Username: username, Password: password, Privileges: []byte("r"),
+		UserDir: []byte(addSepSuffix(dir))}
+	expires := map[string]time.Time{share.User: share.Expires}
+	if err = createUsers([]UserInfo{userInfo}, expires, config.PasswdFile); err != nil {
+		os.RemoveAll(dir)
+		return share, nil, err
+	}
+
+	return share, password, nil
+}
+
+// placeShareFile hard-links source to target, or copies it if copy is set
+// or a link is not possible, for example across filesystems.
+func placeShareFile(source string, target string, copy bool) error {
+	if !copy {
+		if err := os.Link(source, target); err == nil {
+			return nil
+		}
+	}
+
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// shareCommand returns the scp command line downloading a share from host,
+// where the server listens on listen.
+func shareCommand(share shareInfo, host string, listen string) string {
+	cmd := scpClientCommand(listenPort(listen))
+
+	// The file name is quoted twice, for the local shell and for the
+	// command the client sends to the server. Clients compare the quoted
+	// request to the name sent, which -T turns off.
+	if strings.ContainsAny(share.File, shellChars) {
+		cmd += " -T"
+	}
+	remote := share.User + "@" + host + ":" + shellQuote(share.File)
+	return fmt.Sprintf("%s %s .", cmd, shellQuote(remote))
+}
+
+// characters that have to be quoted in a shell
+const shellChars = " \t'\"\\$`*?[]{}()<>|&;#~!"
+
+// shellQuote quotes s for a POSIX shell if needed.
+func shellQuote(s string) string {
+	if !strings.ContainsAny(s, shellChars) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// expireUsers periodically removes expired users and the files they were
+// shared until the server is shut down.
+func (s *Server) expireUsers() {
+	ticker := time.NewTicker(shareCleanInterval)
+	defer ticker.Stop()
+
+	for {
+		config, _ := s.currentConfig()
+		removeExpiredUsers(config.PasswdFile, config.ShareDir, time.Now())
+
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateShare(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropShareTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shareDir := filepath.Join(dir, "shares")
+	os.Mkdir(shareDir, 0750)
+	source := filepath.Join(dir, "report.pdf")
+	ioutil.WriteFile(source, []byte("report"), 0600)
+
+	config := Config{ShareDir: addSepSuffix(shareDir), PasswdFile: filepath.Join(dir, "passwd")}
+
+	for _, copy := range []bool{false, true} {
+		share, password, err := createShare(config, shareRequest{File: source, Expire: time.Hour, Copy: copy})
+		if err != nil {
+			t.Fatalf("FATAL - Unable to create share: %s\n", err)
+		}
+
+		target := filepath.Join(shareDir, share.User, "report.pdf")
+		data, err := ioutil.ReadFile(target)
+		if string(data) != "report" {
+			t.Errorf("Shared file (%q, %v) does not match expected (%q)\n", data, err, "report")
+		}
+		sfi, _ := os.Stat(source)
+		tfi, _ := os.Stat(target)
+		if linked := os.SameFile(sfi, tfi); linked == copy {
+			t.Errorf("Shared file linked (%v) does not match expected (%v)\n", linked, !copy)
+		}
+		if expires, _ := readExpiries(config.PasswdFile); !expires[share.User].Equal(share.Expires.Truncate(time.Second)) {
+			t.Errorf("Share expiry (%v) does not match expected (%v)\n", expires[share.User], share.Expires)
+		}
+
+		users, _ := listUsers(config.PasswdFile)
+		found := false
+		for _, u := range users {
+			if string(u.Username) == share.User {
+				found = true
+				if string(u.Privileges) != "r" || u.Permanent || string(u.UserDir) != addSepSuffix(filepath.Join(shareDir, share.User)) {
+					t.Errorf("Share user (%s %s %v) does not match expected (r <share dir> temporary)\n", u.Privileges, u.UserDir, u.Permanent)
+				}
+			}
+		}
+		if !found || len(password) == 0 {
+			t.Errorf("Share user %s was not added\n", share.User)
+		}
+	}
+
+	if _, _, err = createShare(config, shareRequest{File: dir, Expire: time.Hour}); err != errShareSource {
+		t.Errorf("Sharing a directory (%v) does not match expected (%v)\n", err, errShareSource)
+	}
+	if _, _, err = createShare(Config{}, shareRequest{File: source, Expire: time.Hour}); err != errNoShareDir {
+		t.Errorf("Sharing without ShareDir (%v) does not match expected (%v)\n", err, errNoShareDir)
+	}
+}
+
+func TestRemoveExpiredShares(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropShareTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	shareDir := filepath.Join(dir, "shares")
+	os.Mkdir(shareDir, 0750)
+	source := filepath.Join(dir, "report.pdf")
+	ioutil.WriteFile(source, []byte("report"), 0600)
+
+	config := Config{ShareDir: addSepSuffix(shareDir), PasswdFile: filepath.Join(dir, "passwd")}
+	share, _, err := createShare(config, shareRequest{File: source, Expire: time.Hour})
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create share: %s\n", err)
+	}
+
+	removeExpiredUsers(config.PasswdFile, config.ShareDir, time.Now())
+	if _, err = os.Stat(filepath.Join(shareDir, share.User)); err != nil {
+		t.Errorf("Share removed before it expired (%v)\n", err)
+	}
+
+	// The user of a downloaded share is already removed, its files are
+	// still removed when the share expires.
+	second, password, err := createShare(config, shareRequest{File: source, Expire: time.Hour})
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create share: %s\n", err)
+	}
+	helper := validationHelper{PasswdFile: config.PasswdFile}
+	if _, err = helper.validateUser(&testSSHConn{user: second.User}, password); err != nil {
+		t.Fatalf("FATAL - Unable to log in as share user: %s\n", err)
+	}
+
+	removeExpiredUsers(config.PasswdFile, config.ShareDir, time.Now().Add(2*time.Hour))
+	for _, user := range []string{share.User, second.User} {
+		if _, err = os.Stat(filepath.Join(shareDir, user)); !os.IsNotExist(err) {
+			t.Errorf("Expired share directory of %s was not removed (%v)\n", user, err)
+		}
+	}
+	if users, _ := listUsers(config.PasswdFile); len(users) != 0 {
+		t.Errorf("Users after expiry (%d) does not match expected (0)\n", len(users))
+	}
+	if expires, _ := readExpiries(config.PasswdFile); len(expires) != 0 {
+		t.Errorf("Expiry times after expiry (%v) does not match expected (none)\n", expires)
+	}
+	if _, err = os.Stat(source); err != nil {
+		t.Errorf("Shared source file was removed (%v)\n", err)
+	}
+}
+
+func TestShareCommand(t *testing.T) {
+	type testStruct struct {
+		file   string
+		listen string
+	}
+
+	tests := make(map[testStruct]string)
+	tests[testStruct{"report.pdf", ":2022"}] = "scp -O -P 2022 abc@example.com:report.pdf ."
+	tests[testStruct{"report.pdf", "0.0.0.0:22"}] = "scp -O abc@example.com:report.pdf ."
+	tests[testStruct{"my report.pdf", ":2022"}] = `scp -O -P 2022 -T 'abc@example.com:'\''my report.pdf'\''' .`
+
+	for testIn, expectedOut := range tests {
+		cmd := shareCommand(shareInfo{User: "abc", File: testIn.file}, "example.com", testIn.listen)
+		if cmd != expectedOut {
+			t.Errorf("Command (%s) does not match expected (%s)\n", cmd, expectedOut)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"sync"
+	"time"
+)
+
+// errThrottleClosed is returned by a throttled channel that is closed while
+// it waits.
+var errThrottleClosed = errors.New("Channel closed while throttled")
+
+// throttleChunk is the largest write sent before the rate limit is checked
+// again, so large writes are spread out instead of sent in bursts.
+const throttleChunk = 32 * 1024
+
+// rateLimiter is a token bucket limiting transfers to rate bytes per second.
+// Up to one second worth of data can be sent at once.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+
+	// sessions is the number of sessions sharing a user limiter.
+	sessions int
+}
+
+// newRateLimiter creates a limiter for rate bytes per second.
+func newRateLimiter(rate uint64) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// setRate changes the rate, for example when the config is reloaded.
+func (l *rateLimiter) setRate(rate uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = float64(rate)
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller
+// has to wait before they may be transferred. Tokens taken by others waiting
+// are accounted for, so concurrent transfers share the rate.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait blocks until n bytes may be transferred by all limiters. It returns
+// errThrottleClosed if closed or stop is closed first.
+func wait(limiters []*rateLimiter, n int, closed <-chan struct{}, stop <-chan struct{}) error {
+	var d time.Duration
+	for _, l := range limiters {
+		if w := l.reserve(n); w > d {
+			d = w
+		}
+	}
+	if d == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-closed:
+		return errThrottleClosed
+	case <-stop:
+		return errThrottleClosed
+	}
+}
+
+// rateLimits holds the global limiter and a limiter per user, shared by
+// all sessions of the user.
+type rateLimits struct {
+	mu     sync.Mutex
+	global *rateLimiter
+	users  map[string]*rateLimiter
+}
+
+// acquire returns the limiters for a session of user with the limits of
+// config. release must be called when the session ends.
+func (r *rateLimits) acquire(config Config, user string) []*rateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var limiters []*rateLimiter
+	if config.RateLimit != 0 {
+		if r.global == nil {
+			r.global = newRateLimiter(config.RateLimit)
+		}
+		r.global.setRate(config.RateLimit)
+		limiters = append(limiters, r.global)
+	}
+
+	if config.UserRateLimit != 0 {
+		if r.users == nil {
+			r.users = make(map[string]*rateLimiter)
+		}
+		l, ok := r.users[user]
+		if !ok {
+			l = newRateLimiter(config.UserRateLimit)
+			r.users[user] = l
+		}
+		l.setRate(config.UserRateLimit)
+		l.sessions++
+		limiters = append(limiters, l)
+	}
+
+	return limiters
+}
+
+// release ends a session of user that acquired limiters. The limiter of the
+// user is removed when its last session ends. Only a user limiter that was
+// acquired is released, the limits may have been changed since.
+func (r *rateLimits) release(user string, limiters []*rateLimiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.users[user]
+	if !ok {
+		return
+	}
+	for _, acquired := range limiters {
+		if acquired != l {
+			continue
+		}
+		if l.sessions--; l.sessions == 0 {
+			delete(r.users, user)
+		}
+	}
+}
+
+// throttledChannel is a channel whose data is limited by rate limiters in
+// both directions. Stderr is not limited. Waits end when the channel is
+// closed, for example by a timeout, or when stop is closed.
+type throttledChannel struct {
+	ssh.Channel
+	limiters []*rateLimiter
+	stop     <-chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Read reads from the channel and waits until the data read is allowed.
+func (c *throttledChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if werr := wait(c.limiters, n, c.closed, c.stop); werr != nil && err == nil {
+		err = werr
+	}
+
+	return n, err
+}
+
+// Write waits until p is allowed and writes it to the channel.
+func (c *throttledChannel) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		if err = wait(c.limiters, len(chunk), c.closed, c.stop); err != nil {
+			return n, err
+		}
+
+		m, err := c.Channel.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+
+	return n, nil
+}
+
+// Close closes the channel and ends waits for the rate limit.
+func (c *throttledChannel) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+
+	return c.Channel.Close()
+}
+
+// throttle limits the transfer rate of a session of user to the limits of
+// config. The returned function must be called when the session ends.
+func (s *Server) throttle(channel ssh.Channel, config Config, user string) (ssh.Channel, func()) {
+	if config.RateLimit == 0 && config.UserRateLimit == 0 {
+		return channel, func() {}
+	}
+
+	limiters := s.limits.acquire(config, user)
+	c := &throttledChannel{Channel: channel, limiters: limiters, stop: s.stopped, closed: make(chan struct{})}
+	return c, func() { s.limits.release(user, limiters) }
+}
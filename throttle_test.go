@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := newRateLimiter(1000)
+
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("Wait for burst (%v) does not match expected (0)\n", d)
+	}
+	if d := l.reserve(500); d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Errorf("Wait after burst (%v) is not about 500ms\n", d)
+	}
+	// Bytes reserved by others are waited for as well.
+	if d := l.reserve(500); d < 950*time.Millisecond || d > time.Second {
+		t.Errorf("Wait after reservation (%v) is not about 1s\n", d)
+	}
+
+	l.setRate(1000000)
+	l.last = time.Now().Add(-time.Second)
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("Wait after rate change (%v) does not match expected (0)\n", d)
+	}
+}
+
+func TestRateLimitsAcquire(t *testing.T) {
+	var r rateLimits
+
+	if l := r.acquire(Config{}, "testy"); len(l) != 0 {
+		t.Errorf("Limiters without limits (%d) does not match expected (0)\n", len(l))
+	}
+
+	config := Config{RateLimit: 10 * MEGABYTE, UserRateLimit: MEGABYTE}
+	first := r.acquire(config, "testy")
+	second := r.acquire(config, "testy")
+	other := r.acquire(config, "other")
+	if len(first) != 2 || len(second) != 2 || len(other) != 2 {
+		t.Fatalf("FATAL - Limiters (%d %d %d) does not match expected (2 2 2)\n", len(first), len(second), len(other))
+	}
+	if first[0] != other[0] {
+		t.Errorf("Global limiter is not shared between users\n")
+	}
+	if first[1] != second[1] {
+		t.Errorf("User limiter is not shared between sessions of the user\n")
+	}
+	if first[1] == other[1] {
+		t.Errorf("User limiter is shared between users\n")
+	}
+
+	// A session started before UserRateLimit was set does not release the
+	// user limiter of other sessions.
+	global := r.acquire(Config{RateLimit: 10 * MEGABYTE}, "testy")
+	r.release("testy", global)
+	if l := r.users["testy"]; l == nil || l.sessions != 2 {
+		t.Errorf("User limiter released by a session that did not acquire it\n")
+	}
+
+	r.release("testy", first)
+	if _, ok := r.users["testy"]; !ok {
+		t.Errorf("User limiter removed while a session is active\n")
+	}
+	r.release("testy", second)
+	if _, ok := r.users["testy"]; ok {
+		t.Errorf("User limiter kept after the last session ended\n")
+	}
+}
+
+func TestWaitClosed(t *testing.T) {
+	l := newRateLimiter(1000)
+	l.reserve(1000)
+
+	closed := make(chan struct{})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(closed)
+	}()
+
+	start := time.Now()
+	if err := wait([]*rateLimiter{l}, 10000, closed, nil); err != errThrottleClosed {
+		t.Errorf("Wait error (%v) does not match expected (%v)\n", err, errThrottleClosed)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Wait (%v) was not ended by closing\n", d)
+	}
+}
+
+func TestParseConfigRateLimit(t *testing.T) {
+	tests := make(map[string]uint64)
+	tests["RateLimit 10M"] = 10 * MEGABYTE
+	tests["RateLimit 512K/s"] = 512 * KILOBYTE
+	tests["RateLimit 1GB/s"] = GIGABYTE
+
+	for line, rate := range tests {
+		config, err := parseConfig([]byte(line))
+		if err != nil || config.RateLimit != rate {
+			t.Errorf("Test %q rate (%d, %v) does not match expected (%d)\n", line, config.RateLimit, err, rate)
+		}
+	}
+
+	var rate uint64 = 2 * MEGABYTE
+	config, err := parseConfig([]byte("UserRateLimit 2M"))
+	if err != nil || config.UserRateLimit != rate {
+		t.Errorf("UserRateLimit (%d, %v) does not match expected (%d)\n", config.UserRateLimit, err, rate)
+	}
+
+	if _, err = parseConfig([]byte("RateLimit fast")); err == nil {
+		t.Errorf("Invalid RateLimit did not return an error\n")
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"sync/atomic"
+	"time"
+)
+
+// timeout kinds used in logs and metrics
+const (
+	timeoutHandshake = "handshake"
+	timeoutIdle      = "idle"
+	timeoutSession   = "session"
+)
+
+// countTimeout counts a connection or session ended by a timeout.
+func countTimeout(kind string) {
+	metricTimeouts.Add(fmt.Sprintf("kind=%q", kind), 1)
+}
+
+// watchedChannel is a channel of a session that is ended when no data is
+// transferred for the idle timeout or when it runs longer than the maximum
+// session duration.
+type watchedChannel struct {
+	ssh.Channel
+	last   atomic.Int64
+	cancel context.CancelFunc
+}
+
+// Read reads from the channel and records the activity.
+func (c *watchedChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// Write writes to the channel and records the activity.
+func (c *watchedChannel) Write(p []byte) (int, error) {
+	n, err := c.Channel.Write(p)
+	if n > 0 {
+		c.last.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// watchSession enforces the IdleTimeout and MaxSessionDuration of config on
+// a session. When one is exceeded the channel is closed. The returned
+// function must be called when the session ends.
+func watchSession(channel ssh.Channel, config Config, address string) (ssh.Channel, func()) {
+	if config.IdleTimeout == 0 && config.MaxSessionDuration == 0 {
+		return channel, func() {}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := &watchedChannel{Channel: channel, cancel: cancel}
+	c.last.Store(time.Now().UnixNano())
+	go c.watch(ctx, config.IdleTimeout, config.MaxSessionDuration, address)
+
+	return c, cancel
+}
+
+// watch ends the session when it is idle for idle or has run for max,
+// whichever comes first. A zero duration is not enforced.
+func (c *watchedChannel) watch(ctx context.Context, idle time.Duration, max time.Duration, address string) {
+	started := time.Now()
+
+	for {
+		now := time.Now()
+		kind := ""
+		next := time.Duration(-1)
+
+		if max != 0 {
+			next = started.Add(max).Sub(now)
+			if next <= 0 {
+				kind = timeoutSession
+			}
+		}
+		if idle != 0 && kind == "" {
+			left := time.Unix(0, c.last.Load()).Add(idle).Sub(now)
+			if left <= 0 {
+				kind = timeoutIdle
+			} else if next < 0 || left < next {
+				next = left
+			}
+		}
+
+		if kind != "" {
+			logWarning.Printf("Ending session from %s, %s timeout exceeded\n", address, kind)
+			countTimeout(kind)
+			c.cancel()
+			c.Channel.Close()
+			return
+		}
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeTimeout(t *testing.T) {
+	initLog("-", "none")
+	config, cleanup := testServerConfig(t)
+	defer cleanup()
+
+	config.HandshakeTimeout = 200 * time.Millisecond
+	server := testStartServer(config, t)
+	defer server.Shutdown(context.Background())
+
+	// A client that never sends anything is disconnected.
+	conn, err := net.Dial("tcp", server.Addr().String())
+	if err != nil {
+		t.Fatalf("Unable to connect to server: %s\n", err)
+	}
+	defer conn.Close()
+
+	started := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ioutil.ReadAll(conn)
+	if d := time.Since(started); d > 2*time.Second {
+		t.Errorf("Handshake was not ended after timeout (%s)\n", d)
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	initLog("-", "none")
+	config, cleanup := testServerConfig(t)
+	defer cleanup()
+
+	type testStruct struct {
+		idle time.Duration
+		max  time.Duration
+	}
+
+	tests := make(map[string]testStruct)
+	tests["idle"] = testStruct{200 * time.Millisecond, 0}
+	tests["session"] = testStruct{time.Minute, 300 * time.Millisecond}
+
+	for name, testIn := range tests {
+		config.IdleTimeout, config.MaxSessionDuration = testIn.idle, testIn.max
+		server := testStartServer(config, t)
+
+		client, err := testDial(server)
+		if err != nil {
+			t.Fatalf("Unable to connect to server: %s\n", err)
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			t.Fatalf("Unable to open session: %s\n", err)
+		}
+
+		started := time.Now()
+		done := make(chan error, 1)
+		go func() { done <- session.Run("scp -t file") }()
+
+		select {
+		case <-done:
+			if d := time.Since(started); d < 150*time.Millisecond {
+				t.Errorf("Test %s session ended before the timeout (%s)\n", name, d)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("Test %s session was not ended by the timeout\n", name)
+		}
+
+		// The ended upload does not keep the session alive.
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if err = server.Shutdown(ctx); err != nil {
+			t.Errorf("Test %s shutdown returned (%v), expected (<nil>)\n", name, err)
+		}
+		cancel()
+		client.Close()
+	}
+}
+
+func TestParseTimeouts(t *testing.T) {
+	tests := make(map[string]Config)
+	tests[""] = Config{DrainTimeout: 30 * time.Second, HandshakeTimeout: 30 * time.Second}
+	tests["DrainTimeout 2m\nHandshakeTimeout 10s\n"] = Config{DrainTimeout: 2 * time.Minute, HandshakeTimeout: 10 * time.Second}
+	tests["DrainTimeout none\nHandshakeTimeout none\n"] = Config{DrainTimeout: noTimeout, HandshakeTimeout: noTimeout}
+
+	for in, expected := range tests {
+		config, err := parseConfig([]byte(in))
+		config = addConfigDefaults(config)
+		if err != nil || config.DrainTimeout != expected.DrainTimeout || config.HandshakeTimeout != expected.HandshakeTimeout {
+			t.Errorf("Timeouts (%v, %v, %v) do not match expected (%v, %v)\n", config.DrainTimeout,
+				config.HandshakeTimeout, err, expected.DrainTimeout, expected.HandshakeTimeout)
+		}
+	}
+
+	for _, line := range []string{"DrainTimeout 0", "HandshakeTimeout 0s", "HandshakeTimeout -1s"} {
+		if _, err := parseConfig([]byte(line + "\n")); err == nil {
+			t.Errorf("Config line %q did not fail\n", line)
+		}
+	}
+}
@@ -16,14 +16,21 @@ Copyright 2017 Oscar Carlsson
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/rand"
 	"crypto/sha512"
 	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"math/rand"
+	"math/big"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -39,6 +46,7 @@ type UserInfo struct {
 	UpSize     uint64
 	Permanent  bool
 	Plaintext  bool
+	Cmd        []byte
 }
 
 // PasswdString returns the users password hash string as a byte array.
@@ -79,33 +87,150 @@ func (u UserInfo) ConfigString() (r []byte) {
 		r = append(r, byte('t'))
 	}
 
+	if len(u.Cmd) != 0 {
+		r = append(r, byte(':'))
+		r = append(r, u.Cmd...)
+	}
+
 	return r
 }
 
-// characters used in password and username generation.
-const passwordChars = "ABCDEFGHIJKLMNOPQRSTUVXYZabcdefghijklmnopqrstuvxyz01234567890"
+// Character classes used in password and username generation.
+const (
+	lowerChars  = "abcdefghijklmnopqrstuvwxyz"
+	upperChars  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	digitChars  = "0123456789"
+	symbolChars = "!#%+,-.=?@^_~"
+)
+
+// characters used in password generation by default and in salts.
+const passwordChars = upperChars + lowerChars + digitChars
+
+// Defaults for generated usernames and passwords.
+const (
+	defaultUsernameLength  = 8
+	defaultUsernameChars   = "lower"
+	defaultPasswordLength  = 12
+	defaultPasswordChars   = "upper,lower,digit"
+	defaultPassphraseWords = 6
+)
+
+// Password generation modes.
+const (
+	passwordModeRandom     = "random"
+	passwordModePassphrase = "passphrase"
+)
+
+// charClasses returns the characters of a comma separated list of the
+// character classes lower, upper, digit and symbol.
+func charClasses(classes string) (chars string, err error) {
+	for _, class := range strings.Split(classes, ",") {
+		var c string
+		switch strings.TrimSpace(class) {
+		case "lower":
+			c = lowerChars
+		case "upper":
+			c = upperChars
+		case "digit":
+			c = digitChars
+		case "symbol":
+			c = symbolChars
+		default:
+			return "", fmt.Errorf("Unknown character class %q", class)
+		}
+		if !strings.Contains(chars, c) {
+			chars += c
+		}
+	}
+
+	return chars, nil
+}
+
+// validUsername reports whether name can be used as a username. Usernames
+// name files below UsersDir and KeysDir and fields of the passwd file, so
+// only letters, digits and "._-@" are allowed and the first character must
+// be a letter, digit or underscore.
+func validUsername(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+		case i > 0 && (r == '.' || r == '-' || r == '@'):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// randIndex returns a uniformly distributed random number in [0, n) from
+// crypto/rand.
+func randIndex(n int) int {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		// crypto/rand only fails if the system has no usable entropy source.
+		panic(err)
+	}
+
+	return int(i.Int64())
+}
 
-// randUser creates a random user name.
-func randUser(length int) (username []byte) {
-	for i := 0; i < length; i++ {
-		username = append(username, passwordChars[rand.Int31n(25)+25])
+// randChars creates a random string of length characters from chars.
+func randChars(chars string, length int) []byte {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = chars[randIndex(len(chars))]
 	}
 
-	return
+	return b
 }
 
-// randPass creates a random password.
-func randPass(length int) (password []byte) {
-	for i := 0; i < length; i++ {
-		password = append(password, passwordChars[rand.Int31n(60)])
+// randUser creates a random user name of UsernameLength characters from
+// the classes in UsernameChars.
+func randUser(config Config) []byte {
+	length := config.UsernameLength
+	if length == 0 {
+		length = defaultUsernameLength
+	}
+	chars, err := charClasses(config.UsernameChars)
+	if err != nil {
+		chars, _ = charClasses(defaultUsernameChars)
+	}
+
+	return randChars(chars, length)
+}
+
+// randPass creates a random password of PasswordLength characters from the
+// classes in PasswordChars, or a passphrase of PassphraseWords words if
+// PasswordMode is passphrase.
+func randPass(config Config) []byte {
+	if config.PasswordMode == passwordModePassphrase {
+		words := config.PassphraseWords
+		if words == 0 {
+			words = defaultPassphraseWords
+		}
+		return randPassphrase(words)
+	}
+
+	length := config.PasswordLength
+	if length == 0 {
+		length = defaultPasswordLength
+	}
+	chars, err := charClasses(config.PasswordChars)
+	if err != nil {
+		chars = passwordChars
 	}
 
-	return
+	return randChars(chars, length)
 }
 
 // saltNHash salts and hashes a password with sha512.
 func saltNHash(password []byte) (line []byte) {
-	salt := randPass(10)
+	salt := randChars(passwordChars, 10)
 	tohash := append(salt, password...)
 	hash := sha512.Sum512(tohash)
 	hex := hex.EncodeToString(hash[:])
@@ -117,16 +242,15 @@ func saltNHash(password []byte) (line []byte) {
 	return line
 }
 
-// addUser adds a user to the passwd file.
+// addUser adds a user to the passwd file and returns it with the generated
+// username and password and true if the password was generated.
 // This function may prompt the user for further information.
-func addUser(userInfo UserInfo, passwdFile string) {
-	rand.Seed(time.Now().UnixNano())
-
+func addUser(userInfo UserInfo, config Config) (UserInfo, bool) {
 	var err error
 	randpass := false
 
 	if bytes.Compare(userInfo.Username, []byte("")) == 0 {
-		userInfo.Username = randUser(8)
+		userInfo.Username = randUser(config)
 	}
 
 	if bytes.Compare(userInfo.Password, []byte("")) == 0 {
@@ -142,34 +266,389 @@ func addUser(userInfo UserInfo, passwdFile string) {
 
 		if len(userInfo.Password) == 0 {
 			randpass = true
-			userInfo.Password = randPass(12)
+			userInfo.Password = randPass(config)
 		}
 	}
+	if err = createUser(userInfo, config.PasswdFile); err != nil {
+		logError.Fatalln(err)
+	}
+
+	return userInfo, randpass
+}
+
+// createKeyFile creates an authorizedKeys config.
+// Don't forget to add the actual public key afterwards.
+func createKeyFile(userInfo UserInfo, keysDir string) {
+	filename := keysDir + string(userInfo.Username)
+	var buf []byte
+	buf = append(buf, []byte("type keyhash ")...)
+	buf = append(buf, userInfo.ConfigString()...)
+	if err := appendToFile(filename, buf); err != nil {
+		logError.Fatalln(err)
+	}
+}
+
+// passwdMu serializes reads and writes of the passwd file within the
+// process. The lock file taken by lockPasswd serializes them with other
+// processes, like the user import and share commands.
+var passwdMu sync.Mutex
+
+// lockPasswd locks the passwd file and its expiry times for this and other
+// processes. The returned function releases the lock.
+func lockPasswd(passwdFile string) (unlock func(), err error) {
+	passwdMu.Lock()
+
+	f, err := os.OpenFile(passwdFile+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		passwdMu.Unlock()
+		return nil, fmt.Errorf("Unable to open passwd lock file: %s", err)
+	}
+
+	if err = lockFile(f); err != nil {
+		f.Close()
+		passwdMu.Unlock()
+		return nil, fmt.Errorf("Unable to lock passwd file: %s", err)
+	}
+
+	return func() {
+		f.Close()
+		passwdMu.Unlock()
+	}, nil
+}
+
+// appendPasswd adds lines to the end of the passwd file, creating it if it
+// does not exist. The passwd lock must be held.
+func appendPasswd(passwdFile string, lines []byte) error {
+	file, err := ioutil.ReadFile(passwdFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return replaceFile(passwdFile, append(file, lines...))
+}
+
+// createUser creates the users directory if it does not exist and adds the
+// user to the passwd file. It returns errUserExists if a user with the same
+// name is already in the passwd file.
+func createUser(userInfo UserInfo, passwdFile string) error {
+	unlock, err := lockPasswd(passwdFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := passwdUsers(passwdFile)
+	if err != nil {
+		return err
+	}
+	if existing[string(userInfo.Username)] {
+		return errUserExists
+	}
+
 	if bytes.Compare(userInfo.UserDir, []byte("")) != 0 {
 		if err := os.Mkdir(string(userInfo.UserDir), 0750); err != nil {
 			if os.IsExist(err) {
 				logWarning.Printf("User directory %s already exists\n", userInfo.UserDir)
 			} else {
-				logError.Fatalf("Unable to create user directory: %s\n", err)
+				return fmt.Errorf("Unable to create user directory: %s", err)
 			}
 		}
 	}
 
-	appendToFile(passwdFile, userInfo.PasswdString())
+	// A user with the name of a removed user does not inherit its expiry.
+	if err := updateExpiries(passwdFile, func(e map[string]time.Time) {
+		delete(e, string(userInfo.Username))
+	}); err != nil {
+		return err
+	}
 
-	if randpass {
-		fmt.Printf("User: %s Pass: %s\n", string(userInfo.Username), string(userInfo.Password))
-	} else {
-		logInfo.Printf("User %s added\n", string(userInfo.Username))
+	return appendPasswd(passwdFile, userInfo.PasswdString())
+}
+
+// createUsers creates the directories of users and adds all of them to the
+// passwd file in a single update. Nothing is added if one of the users
+// already exists. expires holds the time users expire by name.
+func createUsers(users []UserInfo, expires map[string]time.Time, passwdFile string) error {
+	unlock, err := lockPasswd(passwdFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	existing, err := passwdUsers(passwdFile)
+	if err != nil {
+		return err
+	}
+
+	var lines []byte
+	for _, userInfo := range users {
+		if existing[string(userInfo.Username)] {
+			return fmt.Errorf("User %s already exists", userInfo.Username)
+		}
+		existing[string(userInfo.Username)] = true
+		lines = append(lines, userInfo.PasswdString()...)
+	}
+
+	for _, userInfo := range users {
+		if len(userInfo.UserDir) == 0 {
+			continue
+		}
+		if err := os.Mkdir(string(userInfo.UserDir), 0750); err != nil {
+			if os.IsExist(err) {
+				logWarning.Printf("User directory %s already exists\n", userInfo.UserDir)
+			} else {
+				return fmt.Errorf("Unable to create user directory: %s", err)
+			}
+		}
+	}
+
+	if err := updateExpiries(passwdFile, func(e map[string]time.Time) {
+		for _, userInfo := range users {
+			delete(e, string(userInfo.Username))
+		}
+		for name, t := range expires {
+			e[name] = t
+		}
+	}); err != nil {
+		return err
 	}
+
+	return appendPasswd(passwdFile, lines)
 }
 
-// createKeyFile creates an authorizedKeys config.
-// Don't forget to add the actual public key afterwards.
-func createKeyFile(userInfo UserInfo, keysDir string) {
-	filename := keysDir + string(userInfo.Username)
-	var buf []byte
-	buf = append(buf, []byte("type keyhash ")...)
-	buf = append(buf, userInfo.ConfigString()...)
-	appendToFile(filename, buf)
+// passwdUsers returns the names of the users in passwdFile. The passwd lock
+// must be held.
+func passwdUsers(passwdFile string) (map[string]bool, error) {
+	existing := make(map[string]bool)
+	file, err := ioutil.ReadFile(passwdFile)
+	if err != nil && !os.IsNotExist(err) {
+		return existing, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		if userInfo, ok := parsePasswdLine(scanner.Text()); ok {
+			existing[string(userInfo.Username)] = true
+		}
+	}
+
+	return existing, nil
+}
+
+// expiryFile returns the file the expiry times of the users in passwdFile
+// are kept in, one "<username> <RFC 3339 time>" line per user.
+func expiryFile(passwdFile string) string {
+	return passwdFile + ".expires"
+}
+
+// readExpiries returns the expiry times of the users in passwdFile by name.
+// The passwd lock must be held.
+func readExpiries(passwdFile string) (map[string]time.Time, error) {
+	expires := make(map[string]time.Time)
+	file, err := ioutil.ReadFile(expiryFile(passwdFile))
+	if err != nil && !os.IsNotExist(err) {
+		return expires, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		s := strings.SplitN(scanner.Text(), " ", 2)
+		if len(s) != 2 {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339, s[1]); err == nil {
+			expires[s[0]] = t
+		}
+	}
+
+	return expires, nil
+}
+
+// userExpired reports whether the user of passwdFile has expired by now.
+// The passwd lock must be held.
+func userExpired(passwdFile string, username string, now time.Time) (bool, error) {
+	expires, err := readExpiries(passwdFile)
+	if err != nil {
+		return false, err
+	}
+
+	t, ok := expires[username]
+	return ok && !now.Before(t), nil
+}
+
+// updateExpiries reads the expiry times of the users in passwdFile, lets
+// update change them and writes them back. The passwd lock must be held.
+func updateExpiries(passwdFile string, update func(map[string]time.Time)) error {
+	expires, err := readExpiries(passwdFile)
+	if err != nil {
+		return err
+	}
+
+	before := len(expires)
+	update(expires)
+	if len(expires) == 0 && before == 0 {
+		return nil
+	}
+
+	var names []string
+	for name := range expires {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var outfile []byte
+	for _, name := range names {
+		outfile = append(outfile, fmt.Sprintf("%s %s\n", name, expires[name].Format(time.RFC3339))...)
+	}
+
+	return replaceFile(expiryFile(passwdFile), outfile)
+}
+
+// removeExpiredUsers removes the users of passwdFile that expired before
+// now. Their directories are kept, except for the directories of shares
+// below shareDir. The expiry time of a user is only removed with the user,
+// so a failed removal is retried on the next run.
+func removeExpiredUsers(passwdFile string, shareDir string, now time.Time) {
+	unlock, err := lockPasswd(passwdFile)
+	if err != nil {
+		logError.Printf("Unable to read user expiry times: %s\n", err)
+		return
+	}
+	expires, err := readExpiries(passwdFile)
+	unlock()
+	if err != nil {
+		logError.Printf("Unable to read user expiry times: %s\n", err)
+		return
+	}
+
+	for name, t := range expires {
+		if now.Before(t) {
+			continue
+		}
+
+		// Shared files are removed before the user, so the expiry time
+		// is kept to retry a failed removal.
+		if shareDir != "" && validUsername(name) {
+			if err := os.RemoveAll(filepath.Join(shareDir, name)); err != nil {
+				logError.Printf("Unable to remove share of expired user %s: %s\n", name, err)
+				continue
+			}
+		}
+
+		found, err := deleteUser(passwdFile, name)
+		if err != nil {
+			logError.Printf("Unable to remove expired user %s: %s\n", name, err)
+			continue
+		}
+		if found {
+			logInfo.Printf("User %s expired\n", name)
+			continue
+		}
+
+		// The user was already removed, for example by logging in once.
+		if err = clearExpiry(passwdFile, name); err != nil {
+			logError.Printf("Unable to remove expiry time of user %s: %s\n", name, err)
+		}
+	}
+}
+
+// clearExpiry removes the expiry time of a user.
+func clearExpiry(passwdFile string, username string) error {
+	unlock, err := lockPasswd(passwdFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return updateExpiries(passwdFile, func(e map[string]time.Time) { delete(e, username) })
+}
+
+// parsePasswdLine parses a line from the passwd file into a UserInfo.
+// The password hash is not included. ok is false for comments and invalid lines.
+func parsePasswdLine(line string) (userInfo UserInfo, ok bool) {
+	s := strings.SplitN(line, ":", 8)
+	if strings.HasPrefix(s[0], "#") || len(s) < 7 {
+		return userInfo, false
+	}
+	if len(s) == 8 {
+		userInfo.Cmd = []byte(s[7])
+	}
+
+	upSize, err := strconv.ParseUint(s[4], 10, 64)
+	if err != nil {
+		return userInfo, false
+	}
+
+	userInfo.Username = []byte(s[0])
+	userInfo.Plaintext = strings.HasPrefix(s[1], "$0$")
+	userInfo.Privileges = []byte(s[2])
+	userInfo.UserDir = []byte(s[3])
+	userInfo.UpSize = upSize
+	userInfo.Recursive = []byte(s[5])
+	userInfo.Permanent = s[6] == "p"
+
+	return userInfo, true
+}
+
+// listUsers returns all users in the passwd file.
+func listUsers(passwdFile string) (users []UserInfo, err error) {
+	unlock, err := lockPasswd(passwdFile)
+	if err != nil {
+		return users, err
+	}
+	defer unlock()
+
+	file, err := ioutil.ReadFile(passwdFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return users, nil
+		}
+		return users, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		if userInfo, ok := parsePasswdLine(scanner.Text()); ok {
+			users = append(users, userInfo)
+		}
+	}
+
+	return users, nil
+}
+
+// deleteUser removes a user from the passwd file. It returns false if the
+// user was not found.
+func deleteUser(passwdFile string, username string) (bool, error) {
+	unlock, err := lockPasswd(passwdFile)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	file, err := ioutil.ReadFile(passwdFile)
+	if err != nil {
+		return false, err
+	}
+
+	found := false
+	var outfile []byte
+	scanner := bufio.NewScanner(bytes.NewReader(file))
+	for scanner.Scan() {
+		if userInfo, ok := parsePasswdLine(scanner.Text()); ok && string(userInfo.Username) == username {
+			found = true
+			continue
+		}
+		outfile = append(outfile, scanner.Bytes()...)
+		outfile = append(outfile, '\n')
+	}
+
+	if !found {
+		return false, nil
+	}
+
+	if err = replaceFile(passwdFile, outfile); err != nil {
+		return true, err
+	}
+
+	return true, updateExpiries(passwdFile, func(e map[string]time.Time) { delete(e, username) })
 }
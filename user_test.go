@@ -2,86 +2,260 @@ package main
 
 import (
 	"bytes"
-	"math/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 )
 
 func TestRandUser(t *testing.T) {
-	rand.Seed(1)
-
-	var testIn []int
-	var expectedOut [][]byte
+	type testStruct struct {
+		config Config
+		chars  string
+	}
 
-	testIn = append(testIn, 10)
-	expectedOut = append(expectedOut, []byte("gmxjgsapga"))
+	var tests []testStruct
+	tests = append(tests, testStruct{Config{}, lowerChars})
+	tests = append(tests, testStruct{Config{UsernameLength: 20, UsernameChars: "upper,digit"}, upperChars + digitChars})
 
-	testIn = append(testIn, 20)
-	expectedOut = append(expectedOut, []byte("tlmodzlumguqdixxmnpp"))
+	for _, test := range tests {
+		config, chars := test.config, test.chars
+		length := config.UsernameLength
+		if length == 0 {
+			length = defaultUsernameLength
+		}
 
-	for i, length := range testIn {
-		user := randUser(length)
-		if bytes.Compare(user, expectedOut[i]) != 0 {
-			t.Errorf("Test%d user (%s) does not match expected (%s)\n", i, string(user), string(expectedOut[i]))
+		user := randUser(config)
+		if len(user) != length || strings.Trim(string(user), chars) != "" {
+			t.Errorf("User (%s) does not match expected (%d characters from %s)\n", user, length, chars)
+		}
+		if other := randUser(config); bytes.Equal(user, other) {
+			t.Errorf("Users (%s, %s) are not random\n", user, other)
 		}
 	}
 }
 
 func TestRandPass(t *testing.T) {
-	rand.Seed(1)
+	type testStruct struct {
+		config Config
+		chars  string
+	}
+
+	var tests []testStruct
+	tests = append(tests, testStruct{Config{}, passwordChars})
+	tests = append(tests, testStruct{Config{PasswordLength: 32, PasswordChars: "lower,symbol"}, lowerChars + symbolChars})
+
+	for _, test := range tests {
+		config, chars := test.config, test.chars
+		length := config.PasswordLength
+		if length == 0 {
+			length = defaultPasswordLength
+		}
 
-	var testIn []int
-	var expectedOut [][]byte
+		password := randPass(config)
+		if len(password) != length || strings.Trim(string(password), chars) != "" {
+			t.Errorf("Password (%s) does not match expected (%d characters from %s)\n", password, length, chars)
+		}
+		if other := randPass(config); bytes.Equal(password, other) {
+			t.Errorf("Passwords (%s, %s) are not random\n", password, other)
+		}
+	}
 
-	testIn = append(testIn, 10)
-	expectedOut = append(expectedOut, []byte("gmxjgsapga"))
+	// The default alphabet has every letter and digit once.
+	if len(passwordChars) != 62 {
+		t.Errorf("Password characters (%d) does not match expected (62)\n", len(passwordChars))
+	}
 
-	testIn = append(testIn, 20)
-	expectedOut = append(expectedOut, []byte("tlmodzlumguqdixxmnpp"))
+	// The four words of the list with dashes are left out.
+	if len(passphraseWords) != 7772 {
+		t.Errorf("Word list length (%d) does not match expected (7772)\n", len(passphraseWords))
+	}
+	words := make(map[string]bool)
+	for _, word := range passphraseWords {
+		if strings.Contains(word, passphraseSeparator) {
+			t.Errorf("Word (%s) contains the separator\n", word)
+		}
+		words[word] = true
+	}
 
-	for i, length := range testIn {
-		user := randUser(length)
-		if bytes.Compare(user, expectedOut[i]) != 0 {
-			t.Errorf("Test%d user (%s) does not match expected (%s)\n", i, string(user), string(expectedOut[i]))
+	for i := 0; i < 100; i++ {
+		passphrase := string(randPass(Config{PasswordMode: passwordModePassphrase, PassphraseWords: 4}))
+		split := strings.Split(passphrase, passphraseSeparator)
+		if len(split) != 4 {
+			t.Errorf("Passphrase (%s) does not match expected (4 words)\n", passphrase)
+		}
+		for _, word := range split {
+			if !words[word] {
+				t.Errorf("Passphrase word (%s) is not in the word list\n", word)
+			}
 		}
 	}
 }
 
-func TestSaltNHash(t *testing.T) {
-	rand.Seed(1)
+func TestCharClasses(t *testing.T) {
+	tests := make(map[string]string)
+	tests["lower"] = lowerChars
+	tests["upper, digit,upper"] = upperChars + digitChars
+	tests["symbol,lower"] = symbolChars + lowerChars
 
-	var hashes [][]byte
-	var passwords [][]byte
-	var expectedOut [][]byte
+	for in, expected := range tests {
+		if chars, err := charClasses(in); chars != expected || err != nil {
+			t.Errorf("Characters of %s (%s, %v) does not match expected (%s)\n", in, chars, err, expected)
+		}
+	}
+	if _, err := charClasses("lower,emoji"); err == nil {
+		t.Errorf("Unknown character class did not fail\n")
+	}
 
-	hashes = append(hashes, randPass(10))
-	passwords = append(passwords, []byte("myPassword123"))
-	expectedOut = append(expectedOut, []byte("$6$"+string(hashes[0])+"$5073f34332071df0bd0a898bc6d4af240d43544d86edc6c114e37e877a574274e81cfd6f9b92bf1d4f3d6c48e1a363361d877ac5ac77d074c3e6c75e73f69073"))
+	config, err := parseConfig([]byte("UsernameLength 10\nUsernameChars lower,digit\nPasswordMode passphrase\nPassphraseWords 8\n"))
+	if err != nil || config.UsernameLength != 10 || config.UsernameChars != "lower,digit" ||
+		config.PasswordMode != passwordModePassphrase || config.PassphraseWords != 8 {
+		t.Errorf("Config (%+v, %v) does not match expected\n", config, err)
+	}
+	for _, line := range []string{"UsernameChars lower,symbol", "PasswordChars none", "PasswordLength 0", "PasswordMode words"} {
+		if _, err := parseConfig([]byte(line + "\n")); err == nil {
+			t.Errorf("Config line %q did not fail\n", line)
+		}
+	}
+}
 
-	rand.Seed(1)
+// verifyHash checks that a password hash is a salted sha512 hash of password.
+func verifyHash(hash []byte, password string, t *testing.T) {
+	s := strings.Split(string(hash), "$")
+	if len(s) != 4 || s[1] != "6" || len(s[2]) != 10 || strings.Trim(s[2], passwordChars) != "" {
+		t.Errorf("Hash (%s) does not match expected ($6$<salt>$<hash>)\n", hash)
+		return
+	}
 
-	for i, password := range passwords {
-		line := saltNHash(password)
+	sum := sha512.Sum512([]byte(s[2] + password))
+	if expected := hex.EncodeToString(sum[:]); s[3] != expected {
+		t.Errorf("Hash (%s) does not match expected (%s)\n", s[3], expected)
+	}
+}
 
-		if bytes.Compare(line, expectedOut[i]) != 0 {
-			t.Errorf("Passwd line (%s) does not match expected (%s)\n", line, expectedOut[i])
-		}
+func TestSaltNHash(t *testing.T) {
+	line := saltNHash([]byte("myPassword123"))
+	verifyHash(line, "myPassword123", t)
 
+	if other := saltNHash([]byte("myPassword123")); bytes.Equal(line, other) {
+		t.Errorf("Hashes (%s, %s) are not salted\n", line, other)
 	}
 }
 
 func TestUserInfoPasswdString(t *testing.T) {
-	rand.Seed(1)
-
 	var testIn []UserInfo
-	var expectedOut [][]byte
+	var expectedOut []string
 
-	testIn = append(testIn, UserInfo{[]byte("user1"), []byte("pass1"), []byte("rw"), []byte("/"), []byte("rw"), 1000, true, false})
-	expectedOut = append(expectedOut, []byte("user1:$6$qcx9BSaUQA$2c6485fead7154189917fc15f659bc8974b96c56a0811a11e8c8aa7f9bc1f21b1a42d171d5b216536759c9695366c56a0cc53d7189fb16392743ef1b42d6a1fe:rw:/:1000:rw:p\n"))
+	testIn = append(testIn, UserInfo{[]byte("user1"), []byte("pass1"), []byte("rw"), []byte("/"), []byte("rw"), 1000, true, false, nil})
+	expectedOut = append(expectedOut, ":rw:/:1000:rw:p\n")
+
+	testIn = append(testIn, UserInfo{[]byte("user2"), []byte("pass2"), []byte("w"), nil, nil, 0, false, true, []byte("stages=scan")})
+	expectedOut = append(expectedOut, ":w::0::t:stages=scan\n")
 
 	for i, input := range testIn {
-		out := input.PasswdString()
-		if bytes.Compare(out, expectedOut[i]) != 0 {
-			t.Errorf("String (%s) does not match expected (%s)\n", out, expectedOut[i])
+		out := string(input.PasswdString())
+		s := strings.SplitN(out, ":", 3)
+		if len(s) != 3 || s[0] != string(input.Username) || ":"+s[2] != expectedOut[i] {
+			t.Errorf("String (%s) does not match expected (%s:<hash>%s)\n", out, input.Username, expectedOut[i])
+			continue
+		}
+		if input.Plaintext {
+			if s[1] != "$0$"+string(input.Password) {
+				t.Errorf("Plain text password (%s) does not match expected ($0$%s)\n", s[1], input.Password)
+			}
+		} else {
+			verifyHash([]byte(s[1]), string(input.Password), t)
+		}
+	}
+}
+
+func TestParsePasswdLine(t *testing.T) {
+	tests := make(map[string]UserInfo)
+	tests["user1:hash:rw:/tmp/user1/:1000:rw:p"] = UserInfo{Username: []byte("user1"), Privileges: []byte("rw"),
+		UserDir: []byte("/tmp/user1/"), UpSize: 1000, Recursive: []byte("rw"), Permanent: true}
+	tests["user2:hash:w:/tmp/user2/:0::t:stages=scan,compress"] = UserInfo{Username: []byte("user2"), Privileges: []byte("w"),
+		UserDir: []byte("/tmp/user2/"), Cmd: []byte("stages=scan,compress")}
+	tests["user3:hash:w:/tmp/:0::t:/usr/bin/convert -a:b"] = UserInfo{Username: []byte("user3"), Privileges: []byte("w"),
+		UserDir: []byte("/tmp/"), Cmd: []byte("/usr/bin/convert -a:b")}
+
+	for line, expected := range tests {
+		userInfo, ok := parsePasswdLine(line)
+		if !ok {
+			t.Errorf("Line %q was not parsed\n", line)
+			continue
 		}
+		verifyUserInfo(0, userInfo, expected, t)
+	}
+
+	if _, ok := parsePasswdLine("user1:hash:rw:/tmp/"); ok {
+		t.Errorf("Short line was parsed\n")
+	}
+}
+
+func TestValidUsername(t *testing.T) {
+	tests := make(map[string]bool)
+	tests["testy"] = true
+	tests["Test_User-1"] = true
+	tests["john.doe@example.com"] = true
+	tests["_svc"] = true
+	tests[""] = false
+	tests["."] = false
+	tests[".."] = false
+	tests[".hidden"] = false
+	tests["-flag"] = false
+	tests["../etc"] = false
+	tests["te sty"] = false
+	tests["te\tsty"] = false
+	tests["te:sty"] = false
+	tests["#testy"] = false
+	tests["tést"] = false
+
+	for name, expected := range tests {
+		if v := validUsername(name); v != expected {
+			t.Errorf("Valid username %q (%v) does not match expected (%v)\n", name, v, expected)
+		}
+	}
+}
+
+func TestCreateUserExists(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropUserTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	passwdFile := filepath.Join(dir, "passwd")
+
+	// Only one of the concurrent creations of the same user succeeds.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- createUser(UserInfo{Username: []byte("testy"), Password: []byte("mctest"), Privileges: []byte("w")}, passwdFile)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		if err == nil {
+			created++
+		} else if err != errUserExists {
+			t.Errorf("Error (%v) does not match expected (%v)\n", err, errUserExists)
+		}
+	}
+	if created != 1 {
+		t.Errorf("User created %d times, expected 1\n", created)
+	}
+	if users, _ := listUsers(passwdFile); len(users) != 1 {
+		t.Errorf("Users in passwd file (%d) does not match expected (1)\n", len(users))
 	}
 }
@@ -16,12 +16,13 @@ Copyright 2017 Oscar Carlsson
 package main
 
 import (
-	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
 	"strconv"
@@ -29,159 +30,6 @@ import (
 	"unicode"
 )
 
-// scpReader is a struct that handles reading from an scp stream.
-type scpReader struct {
-	reader   io.Reader
-	phase    *int
-	dirname  *string
-	filename *string
-	filesize *uint64
-	currsize *uint64
-	maxSize  uint64
-	filechan chan string
-}
-
-// Read keeps track of read states and logs information about the transfer.
-// It is also capable of setting a file size to 0 if it exceeds the allowed size.
-func (r scpReader) Read(p []byte) (n int, err error) {
-	n, err = r.reader.Read(p)
-
-	if n < 30 {
-		logDebug.Printf("Read %d bytes: %q", n, string(p[:n]))
-	} else {
-		logDebug.Printf("Read %d bytes: %q", n, string(p[:30]))
-		logDebug.Printf("Read Last 30: %q", string(p[n-30:n]))
-	}
-
-	if n == 0 || (*r.phase == 0 && n == 1 && p[0] == 0) {
-		return n, err
-	}
-
-	if *r.phase == 0 {
-		switch p[0] {
-		case byte('E'): // Exit directory
-			*r.dirname = path.Dir(*r.dirname)
-		case byte('D'): // Change path
-			nameStart := bytes.Index(p[6:], []byte(" ")) + 7
-			*r.dirname = path.Join(*r.dirname, string(p[nameStart:n-1]))
-		case byte('C'): // Handle file
-			sizeEnd := bytes.Index(p[6:], []byte(" ")) + 6
-			sb := p[6:sizeEnd]
-			size, err := strconv.ParseUint(string(sb), 10, 64)
-			if err != nil {
-				logError.Printf("Unable to convert file size %q : %s\n", sb, err)
-			}
-
-			*r.filename = string(p[sizeEnd+1 : n-1])
-			*r.filesize = size
-
-			if r.maxSize != 0 && size > r.maxSize {
-				logInfo.Printf("Filesize exceeded for %s/%s\n", *r.dirname, *r.filename)
-				newBuf := bytes.Join([][]byte{p[:5], []byte("0"), p[sizeEnd+1 : n]}, []byte(" "))
-
-				logDebug.Printf("newBuf %d: %q\n", len(newBuf), newBuf)
-				copy(p, newBuf)
-				*r.phase = 2
-				logDebug.Println("Switch to phase 2")
-
-				return len(newBuf), err
-			}
-
-			*r.phase = 1
-			logDebug.Println("Switch to phase 1")
-		default:
-			logWarning.Printf("Neither dirname nor filename at phase 0: %q\n", string(p[:10]))
-		}
-	} else {
-		*r.currsize += uint64(n)
-
-		if *r.currsize == *r.filesize+1 {
-			if *r.phase == 1 {
-				logInfo.Printf("Uploaded file %s/%s Size %d\n", *r.dirname, *r.filename, *r.currsize-1)
-				r.filechan <- fmt.Sprintf("%s/%s", *r.dirname, *r.filename)
-			} else if *r.phase == 2 {
-				logInfo.Printf("Suppressed file %s/%s Size %d\n", *r.dirname, *r.filename, *r.currsize-1)
-				p[0] = 0
-				n = 1
-			} else {
-				logError.Fatalf("Unknown phase %d\n", *r.phase)
-			}
-
-			*r.currsize = 0
-			*r.filename = ""
-			*r.phase = 0
-			logDebug.Printf("Switch to phase0")
-		} else if *r.phase == 2 {
-			return 0, err
-		}
-	}
-
-	return n, err
-}
-
-// scpWriter is a struct that handles writing to an scp stream.
-type scpWriter struct {
-	writer   io.Writer
-	phase    *int
-	dirname  *string
-	filename *string
-	filesize *uint64
-	currsize *uint64
-	filechan chan string
-}
-
-// Write keeps track of write states and logs information about the transfer.
-func (w scpWriter) Write(p []byte) (n int, err error) {
-	n, err = w.writer.Write(p)
-
-	if n < 30 {
-		logDebug.Printf("Write: %q", string(p[:n]))
-	} else {
-		logDebug.Printf("Write: %q", string(p[:30]))
-		logDebug.Printf("Write Last 30: %q", string(p[n-30:n]))
-	}
-
-	if n == 0 || (n == 1 && p[0] == 0) {
-		return n, err
-	}
-
-	switch *w.phase {
-	case 0:
-		switch p[0] {
-		case byte('E'): // Exit directory
-			*w.dirname = path.Dir(*w.dirname)
-		case byte('D'): // Change directory
-			nameStart := bytes.Index(p[6:], []byte(" ")) + 7
-			*w.dirname = path.Join(*w.dirname, string(p[nameStart:n-1]))
-		case byte('C'): //Handle file
-			sizeEnd := bytes.Index(p[6:], []byte(" ")) + 6
-			sb := p[6:sizeEnd]
-			size, err := strconv.ParseUint(string(sb), 10, 64)
-			if err != nil {
-				logError.Printf("Unable to convert file size %q : %s\n", sb, err)
-			}
-			*w.filesize = size
-			*w.filename = string(p[sizeEnd+1 : n-1])
-			*w.phase = 1
-			logDebug.Println("Switch to phase 1")
-		default:
-			logWarning.Printf("Neither dirname nor filename at phase 0: %q\n", string(p[:10]))
-		}
-	case 1:
-		*w.currsize += uint64(n)
-		if *w.currsize == *w.filesize+1 {
-			logDebug.Printf("Switch to phase0")
-			logInfo.Printf("Downloaded file %s/%s Size %d\n", *w.dirname, *w.filename, *w.currsize-1)
-			w.filechan <- fmt.Sprintf("%s/%s", *w.dirname, *w.filename)
-			*w.phase = 0
-			*w.currsize = 0
-			*w.filename = ""
-		}
-	}
-
-	return n, err
-}
-
 // parseCmdLine takes a string and splits it into command line options
 func parseCmdLine(cmdline string) (args []string) {
 
@@ -317,15 +165,64 @@ func dirExists(path string) (bool, error) {
 	return false, fmt.Errorf("Path is not a directory")
 }
 
+// fileChecksum returns the size and hex encoded sha256 checksum of a file.
+func fileChecksum(filename string) (size int64, sum string, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if size, err = io.Copy(h, f); err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// replaceFile writes content to a temporary file next to filename and
+// renames it over filename, so readers never see a partially written file.
+// The mode of an existing file is kept.
+func replaceFile(filename string, content []byte) error {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filename)
+}
+
 // appendToFile appends a byte array to a file. It will create the file if it does not exist.
-func appendToFile(filename string, content []byte) {
+func appendToFile(filename string, content []byte) error {
 	fileh, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
-		logError.Fatalf("Error opening file: %s\n", err)
+		return fmt.Errorf("Error opening file: %s", err)
 	}
 	defer fileh.Close()
 
 	if _, err := fileh.Write(content); err != nil {
-		logError.Fatalf("Error appending to file: %s\n", err)
+		return fmt.Errorf("Error appending to file: %s", err)
 	}
+
+	return nil
 }
@@ -1,132 +1,12 @@
 package main
 
 import (
-	//"bufio"
-	//"bytes"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"testing"
 )
 
-/*
-func TestScpReader(t *testing.T) {
-	type testStruct struct {
-		phase         int
-		dirname       string
-		filename      string
-		filesize      uint64
-		currsize      uint64
-		uploadedFiles []string
-	}
-
-	initLog("-", "debug")
-	var reader scpReader
-	reader.phase = new(int)
-	reader.dirname = new(string)
-	reader.filename = new(string)
-	reader.filesize = new(uint64)
-	reader.currsize = new(uint64)
-	reader.filechan = make(chan string)
-
-	tests := make(map[string]testStruct)
-	tests["testbyte thingy"] = testStruct{1, "a", "b", 1, 1, []string{}}
-
-	var uploadedFiles []string
-	go func() {
-		for file := range reader.filechan {
-			uploadedFiles = append(uploadedFiles, file)
-		}
-	}()
-
-	for testIn, expectedOut := range tests {
-		b := bytes.NewBuffer([]byte(testIn))
-		reader.reader = b
-		uploadedFiles = uploadedFiles[:0]
-
-		buf := make([]byte, 1000)
-		_, _ = reader.Read(buf)
-
-		if *reader.phase != expectedOut.phase {
-			t.Errorf("Wrong phase (%d), expected %d\n", *reader.phase, expectedOut.phase)
-		}
-		if *reader.dirname != expectedOut.dirname {
-			t.Errorf("Wrong dirname (%s), expected %s\n", *reader.dirname, expectedOut.dirname)
-		}
-		if *reader.filename != expectedOut.filename {
-			t.Errorf("Wrong filename (%s), expected %s\n", *reader.filename, expectedOut.filename)
-		}
-		if *reader.filesize != expectedOut.filesize {
-			t.Errorf("Wrong filesize (%d), expected %d\n", *reader.filesize, expectedOut.filesize)
-		}
-		if *reader.currsize != expectedOut.currsize {
-			t.Errorf("Wrong currsize (%d), expected %d\n", *reader.currsize, expectedOut.currsize)
-		}
-		if len(uploadedFiles) != len(expectedOut.uploadedFiles) {
-			t.Errorf("Wrong number of uploaded files (%d), expecting %d\n", len(uploadedFiles), len(expectedOut.uploadedFiles))
-		}
-	}
-
-}
-*/
-/*
-func TestScpWriter(t *testing.T) {
-
-	type testStruct struct {
-		phase         int
-		dirname       string
-		filename      string
-		filesize      uint64
-		currsize      uint64
-		uploadedFiles []string
-	}
-
-	initLog("-", "debug")
-	var writer scpWriter
-	var b bytes.Buffer
-	w := bufio.NewWriter(&b)
-	writer.writer = w
-	writer.phase = new(int)
-	writer.dirname = new(string)
-	writer.filename = new(string)
-	writer.filesize = new(uint64)
-	writer.currsize = new(uint64)
-	writer.filechan = make(chan string)
-
-	tests := make(map[string]testStruct)
-	tests["testbyte thingy"] = testStruct{1, "a", "b", 1, 1, []string{}}
-
-	var uploadedFiles []string
-	go func() {
-		for file := range writer.filechan {
-			uploadedFiles = append(uploadedFiles, file)
-		}
-	}()
-
-	for testIn, expectedOut := range tests {
-		uploadedFiles = uploadedFiles[:0]
-
-		_, _ = writer.Write([]byte(testIn))
-		if *writer.phase != expectedOut.phase {
-			t.Errorf("Wrong phase (%d), expected %d\n", *writer.phase, expectedOut.phase)
-		}
-		if *writer.dirname != expectedOut.dirname {
-			t.Errorf("Wrong dirname (%s), expected %s\n", *writer.dirname, expectedOut.dirname)
-		}
-		if *writer.filename != expectedOut.filename {
-			t.Errorf("Wrong filename (%s), expected %s\n", *writer.filename, expectedOut.filename)
-		}
-		if *writer.filesize != expectedOut.filesize {
-			t.Errorf("Wrong filesize (%d), expected %d\n", *writer.filesize, expectedOut.filesize)
-		}
-		if *writer.currsize != expectedOut.currsize {
-			t.Errorf("Wrong currsize (%d), expected %d\n", *writer.currsize, expectedOut.currsize)
-		}
-		if len(uploadedFiles) != len(expectedOut.uploadedFiles) {
-			t.Errorf("Wrong number of uploaded files (%d), expecting %d\n", len(uploadedFiles), len(expectedOut.uploadedFiles))
-		}
-	}
-
-}
-*/
 func TestParseCmdLine(t *testing.T) {
 	tests := make(map[string][]string)
 	tests["@/test/path/filename.sh"] = []string{"/test/path/filename.sh"}
@@ -205,3 +85,37 @@ func TestToBytes(t *testing.T) {
 		}
 	}
 }
+
+func TestReplaceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scpdropReplaceTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "passwd")
+	if err = replaceFile(filename, []byte("one\n")); err != nil {
+		t.Fatalf("Unable to create file: %s\n", err)
+	}
+	if err = os.Chmod(filename, 0600); err != nil {
+		t.Fatalf("FATAL - Unable to change mode: %s\n", err)
+	}
+	if err = replaceFile(filename, []byte("two\n")); err != nil {
+		t.Fatalf("Unable to replace file: %s\n", err)
+	}
+
+	content, _ := ioutil.ReadFile(filename)
+	if string(content) != "two\n" {
+		t.Errorf("Content (%q) does not match expected (%q)\n", content, "two\n")
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Unable to stat replaced file: %s\n", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Mode of replaced file (%v) does not match expected (%v)\n", fi.Mode().Perm(), os.FileMode(0600))
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in directory, expected 1\n", len(files))
+	}
+}
@@ -7,7 +7,10 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 )
@@ -52,6 +55,13 @@ type validationHelper struct {
 // validateUser uses the passwd file to validate incoming autentications
 // and set user configuration values.
 func (h validationHelper) validateUser(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+	unlock, err := lockPasswd(h.PasswdFile)
+	if err != nil {
+		logError.Printf("Unable to validate password: %s\n", err)
+		return nil, fmt.Errorf("Password rejected")
+	}
+	defer unlock()
+
 	file, err := ioutil.ReadFile(h.PasswdFile)
 	if err != nil {
 		logError.Fatalf("Unable to read passwd file: %s\n", err)
@@ -60,9 +70,9 @@ func (h validationHelper) validateUser(c ssh.ConnMetadata, pass []byte) (*ssh.Pe
 	var outfile []byte
 
 	for scanner.Scan() {
-		line := strings.SplitN(scanner.Text(), ":", 7)
+		line := strings.SplitN(scanner.Text(), ":", 8)
 
-		if strings.HasPrefix(line[0], "#") || len(line) != 7 {
+		if strings.HasPrefix(line[0], "#") || len(line) < 7 {
 			outfile = append(outfile, scanner.Bytes()...)
 			outfile = append(outfile, '\n')
 			continue
@@ -74,15 +84,30 @@ func (h validationHelper) validateUser(c ssh.ConnMetadata, pass []byte) (*ssh.Pe
 			continue
 		}
 
+		expired, err := userExpired(h.PasswdFile, c.User(), time.Now())
+		if err != nil {
+			logError.Printf("Unable to read user expiry times: %s\n", err)
+			return nil, fmt.Errorf("Password rejected")
+		}
+		if expired {
+			logWarning.Printf("Login from expired user %q at %q", c.User(), c.RemoteAddr())
+			countAuth("password", false)
+			return nil, fmt.Errorf("Password rejected")
+		}
+
 		if line[6] != "p" {
 			for scanner.Scan() {
 				outfile = append(outfile, scanner.Bytes()...)
 				outfile = append(outfile, '\n')
 			}
-			ioutil.WriteFile(h.PasswdFile, outfile, 0644)
+			if err = replaceFile(h.PasswdFile, outfile); err != nil {
+				logError.Printf("Unable to remove temporary user %s: %s\n", c.User(), err)
+				return nil, fmt.Errorf("Password rejected")
+			}
 		}
 		var perm ssh.Permissions
 		perm.CriticalOptions = make(map[string]string)
+		perm.CriticalOptions["user"] = c.User()
 		perm.CriticalOptions["privs"] = line[2]
 		if line[3] != "" {
 			perm.CriticalOptions["dir"] = addSepSuffix(line[3])
@@ -91,14 +116,19 @@ func (h validationHelper) validateUser(c ssh.ConnMetadata, pass []byte) (*ssh.Pe
 		}
 		perm.CriticalOptions["size"] = line[4]
 		perm.CriticalOptions["recurse"] = line[5]
+		if len(line) == 8 {
+			perm.CriticalOptions["cmd"] = line[7]
+		}
 
 		logDebug.Printf("Login from user %q with password %q", c.User(), string(pass))
 		logInfo.Printf("Login: %s\n", c.User())
+		countAuth("password", true)
 
 		return &perm, nil
 	}
 
 	logWarning.Printf("Invalid password %q from user %q at %q", string(pass), c.User(), c.RemoteAddr())
+	countAuth("password", false)
 	return nil, fmt.Errorf("Password rejected")
 }
 
@@ -114,30 +144,107 @@ func (h validationHelper) validatePubKey(c ssh.ConnMetadata, remoteKey ssh.Publi
 			localKey, comment, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
 			if err != nil {
 				logWarning.Printf("Unable to parse key file: %v\n", err)
+				countKeyProbe()
 				return nil, fmt.Errorf("No valid key file")
 			}
 
 			if len(comment) == 0 {
 				logWarning.Printf("Invalid permissions for keyfile %s\n", "keys/"+c.User())
+				countKeyProbe()
 				return nil, fmt.Errorf("No valid key file")
 			}
 
 			if bytes.Compare(localKey.Marshal(), remoteKey.Marshal()) == 0 {
-
-				privs := strings.SplitN(comment, ":", 4)
+				if h.expired(c.User()) {
+					logWarning.Printf("Login from expired user %q at %q", c.User(), c.RemoteAddr())
+					countAuth("publickey", false)
+					return nil, fmt.Errorf("No valid key file")
+				}
+
+				// privs:dir:size:recurse with an optional type and command.
+				privs := strings.SplitN(comment, ":", 6)
+				if len(privs) < 4 {
+					logWarning.Printf("Invalid permissions for keyfile %s\n", "keys/"+c.User())
+					countKeyProbe()
+					return nil, fmt.Errorf("No valid key file")
+				}
 
 				var perm ssh.Permissions
 				perm.CriticalOptions = make(map[string]string)
+				perm.CriticalOptions["user"] = c.User()
 				perm.CriticalOptions["privs"] = privs[0]
 				perm.CriticalOptions["dir"] = addSepSuffix(privs[1])
 				perm.CriticalOptions["size"] = privs[2]
 				perm.CriticalOptions["recurse"] = privs[3]
+				if len(privs) == 6 {
+					perm.CriticalOptions["cmd"] = privs[5]
+				}
 
-				logInfo.Printf("Login: %s\n", c.User())
+				// Clients may ask if a key is accepted without proving they
+				// hold it, the login is counted when the handshake is done.
+				perm.Extensions = map[string]string{"method": "publickey"}
 				return &perm, nil
 			}
 		}
 	}
 
+	countKeyProbe()
 	return nil, fmt.Errorf("No valid key file")
 }
+
+// expired reports whether a user has expired. Users that can not be checked
+// are treated as expired.
+func (h validationHelper) expired(username string) bool {
+	if h.PasswdFile == "" {
+		return false
+	}
+
+	unlock, err := lockPasswd(h.PasswdFile)
+	if err != nil {
+		logError.Printf("Unable to read user expiry times: %s\n", err)
+		return true
+	}
+	defer unlock()
+
+	expired, err := userExpired(h.PasswdFile, username, time.Now())
+	if err != nil {
+		logError.Printf("Unable to read user expiry times: %s\n", err)
+		return true
+	}
+
+	return expired
+}
+
+// keyUsers calls fn with the permissions of every key in the key files in
+// keysDir, split like in validatePubKey, until fn returns an error.
+func keyUsers(keysDir string, fn func(user string, privs []string) error) error {
+	if keysDir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(keysDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, fi := range files {
+		keyFile, err := ioutil.ReadFile(filepath.Join(keysDir, fi.Name()))
+		if err != nil || fi.IsDir() {
+			continue
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(keyFile))
+		for scanner.Scan() {
+			_, comment, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+			if privs := strings.SplitN(comment, ":", 6); err == nil && len(privs) >= 4 {
+				if err = fn(fi.Name(), privs); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
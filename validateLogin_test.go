@@ -80,6 +80,8 @@ func testBuildPasswdFile(passwdFile string, t *testing.T) {
 	users = append(users, []byte("testuser:$6$mpIfdJs54D$99fb779f928b42e7f4f7f0ba96853ea13ee3c4575ea7e852938cdd45705a658ac59ad76f7848ed3416d6e60fbb93a889f04ccbf3ff517280419963f75483d822:w:/:0::t\n")...)
 	users = append(users, []byte("failuser:$6$FDVvxUdS7n$45070520fa43d9e95b83ade869442b7a5fed21f03af0628004dde3747c527f7002a847afbfa5d678a9099654af6d6212c5dc7c271388d2c46f7c76cdb2b32335:w:/:0::t\n")...)
 
+	users = append(users, []byte("olduser:$6$mpIfdJs54D$99fb779f928b42e7f4f7f0ba96853ea13ee3c4575ea7e852938cdd45705a658ac59ad76f7848ed3416d6e60fbb93a889f04ccbf3ff517280419963f75483d822:w:/:0::p\n")...)
+
 	err := ioutil.WriteFile(passwdFile, users, 0644)
 	if err != nil {
 		t.Fatalf("FATAL - Unable to create temporary password file: %s\n", err)
@@ -112,7 +114,18 @@ func TestValidateUser(t *testing.T) {
 		t.Errorf("Wrong password not validated correctly: %s\n", err)
 	}
 
-	if err := os.Remove(passwdFile); err != nil {
-		t.Logf("Unable to remove temporary file %s\n", passwdFile)
+	// An expired user is rejected even if the server has not removed it yet.
+	c.user = "olduser"
+	if err := ioutil.WriteFile(expiryFile(passwdFile), []byte("olduser 2017-01-14T10:00:00Z\n"), 0644); err != nil {
+		t.Fatalf("FATAL - Unable to create expiry file: %s\n", err)
+	}
+	if _, err := helper.validateUser(&c, correctPassword); err == nil {
+		t.Errorf("Expired user not rejected\n")
+	}
+
+	for _, file := range []string{passwdFile, expiryFile(passwdFile), passwdFile + ".lock"} {
+		if err := os.Remove(file); err != nil {
+			t.Logf("Unable to remove temporary file %s\n", file)
+		}
 	}
 }
@@ -0,0 +1,270 @@
+/*
+Copyright 2017 Oscar Carlsson
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// webhookSpoolInterval is how often spooled notifications are retried.
+const webhookSpoolInterval = 5 * time.Minute
+
+// webhookFile describes an uploaded file in a webhook payload.
+type webhookFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// webhookPayload is the JSON body posted to the webhook after a session.
+type webhookPayload struct {
+	ID         string        `json:"id"`
+	SessionID  uint64        `json:"session_id"`
+	User       string        `json:"user"`
+	RemoteAddr string        `json:"remote_addr"`
+	Started    time.Time     `json:"started"`
+	Finished   time.Time     `json:"finished"`
+	Files      []webhookFile `json:"files"`
+
+	Quarantined []quarantinedFile `json:"quarantined,omitempty"`
+}
+
+// newWebhookPayload creates a payload for a finished session of the server
+// started as boot. Session ids start over when the server is restarted, the
+// id of the payload is unique. Sizes and checksums are those recorded while
+// the files were received, as pipeline stages may have moved or changed the
+// files on disk since.
+func newWebhookPayload(boot string, result sessionResult) webhookPayload {
+	payload := webhookPayload{ID: fmt.Sprintf("%s-%d", boot, result.ID), SessionID: result.ID, User: result.User, RemoteAddr: result.RemoteAddr,
+		Started: result.Started, Finished: result.Finished, Quarantined: result.Quarantined}
+
+	for _, f := range result.Files {
+		wf := webhookFile{Name: strings.TrimPrefix(f, "/")}
+		if sum, ok := result.Sums[f]; ok {
+			wf.Size = sum.Size
+			wf.SHA256 = sum.SHA256
+		}
+
+		payload.Files = append(payload.Files, wf)
+	}
+
+	return payload
+}
+
+// webhook delivers session notifications to an http endpoint.
+type webhook struct {
+	url     string
+	secret  string
+	spool   string
+	retries int
+	backoff time.Duration
+	client  *http.Client
+}
+
+// newWebhook creates a webhook from the config, nil if no webhook is configured.
+func newWebhook(config Config) *webhook {
+	if config.Webhook == "" {
+		return nil
+	}
+
+	return &webhook{
+		url:     config.Webhook,
+		secret:  config.WebhookSecret,
+		spool:   config.WebhookSpool,
+		retries: config.WebhookRetries,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// sign returns the hex encoded HMAC-SHA256 of body using the webhook secret.
+func (h *webhook) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(h.secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver posts body to the webhook once.
+func (h *webhook) deliver(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "scpDrop/"+scpDropVersion)
+	if h.secret != "" {
+		req.Header.Set("X-Scpdrop-Signature", "sha256="+h.sign(body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// deliverWithRetry posts body to the webhook, retrying with exponential
+// backoff until ctx is done.
+func (h *webhook) deliverWithRetry(ctx context.Context, body []byte) (err error) {
+	backoff := h.backoff
+	for i := 0; i <= h.retries; i++ {
+		if i > 0 {
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+
+		if err = h.deliver(ctx, body); err == nil {
+			return nil
+		}
+		logWarning.Printf("Webhook delivery attempt %d failed: %s\n", i+1, err)
+	}
+
+	return err
+}
+
+// notify delivers a payload. Payloads that can not be delivered, or are
+// still being retried when stop is closed, are written to the spool
+// directory, if one is configured, to be retried later.
+func (h *webhook) notify(payload webhookPayload, stop <-chan struct{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logError.Printf("Unable to encode webhook payload: %s\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err = h.deliverWithRetry(ctx, body); err == nil {
+		logInfo.Printf("Webhook delivered for session %d\n", payload.SessionID)
+		return
+	}
+
+	if h.spool == "" {
+		logError.Printf("Webhook for session %d dropped: %s\n", payload.SessionID, err)
+		return
+	}
+
+	name := filepath.Join(h.spool, fmt.Sprintf("%d-%d.json", time.Now().UnixNano(), payload.SessionID))
+	if err = ioutil.WriteFile(name, body, 0600); err != nil {
+		logError.Printf("Unable to spool webhook for session %d: %s\n", payload.SessionID, err)
+		return
+	}
+	logWarning.Printf("Webhook for session %d spooled to %s\n", payload.SessionID, name)
+}
+
+// flushSpool tries to deliver all spooled payloads once, oldest first.
+// Delivered payloads are removed from the spool.
+func (h *webhook) flushSpool() {
+	if h.spool == "" {
+		return
+	}
+
+	names, err := filepath.Glob(filepath.Join(h.spool, "*.json"))
+	if err != nil {
+		logError.Printf("Unable to read webhook spool: %s\n", err)
+		return
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		body, err := ioutil.ReadFile(name)
+		if err != nil {
+			logError.Printf("Unable to read spooled webhook %s: %s\n", name, err)
+			continue
+		}
+
+		if err = h.deliver(context.Background(), body); err != nil {
+			logWarning.Printf("Spooled webhook %s not delivered: %s\n", name, err)
+			return
+		}
+
+		logInfo.Printf("Spooled webhook %s delivered\n", name)
+		if err = os.Remove(name); err != nil {
+			logError.Printf("Unable to remove spooled webhook %s: %s\n", name, err)
+		}
+	}
+}
+
+// sendWebhook delivers the notification of a finished session in the
+// background, so a slow endpoint neither holds the session nor the drain
+// on shutdown. Deliveries still running when the connections are closed at
+// the end of a shutdown are spooled.
+func (s *Server) sendWebhook(hook *webhook, payload webhookPayload) {
+	s.mu.Lock()
+	if s.hooksClosed {
+		s.mu.Unlock()
+		hook.notify(payload, s.stopped)
+		return
+	}
+	s.hooks.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.hooks.Done()
+		hook.notify(payload, s.stopped)
+	}()
+}
+
+// waitWebhooks waits for the background webhook deliveries to finish or ctx
+// to be done. It must only be called once all sessions have ended.
+func (s *Server) waitWebhooks(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.hooks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
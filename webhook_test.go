@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWebhookServer records posted bodies and fails the first failures requests.
+type testWebhookServer struct {
+	mu         sync.Mutex
+	failures   int
+	bodies     [][]byte
+	signatures []string
+}
+
+func (s *testWebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	body, _ := ioutil.ReadAll(r.Body)
+	s.bodies = append(s.bodies, body)
+	s.signatures = append(s.signatures, r.Header.Get("X-Scpdrop-Signature"))
+}
+
+func TestFileChecksum(t *testing.T) {
+	f, err := ioutil.TempFile("", "scpdropChecksumTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary file: %s\n", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("hello\n")
+	f.Close()
+
+	size, sum, err := fileChecksum(f.Name())
+	if err != nil {
+		t.Fatalf("Unable to checksum file: %s\n", err)
+	}
+	if size != 6 {
+		t.Errorf("Size (%d) does not match expected (%d)\n", size, 6)
+	}
+	if expected := "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"; sum != expected {
+		t.Errorf("Checksum (%s) does not match expected (%s)\n", sum, expected)
+	}
+}
+
+func TestWebhookNotify(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropWebhookTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	receiver := &testWebhookServer{failures: 2}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	hook := newWebhook(Config{Webhook: ts.URL, WebhookSecret: "secret", WebhookSpool: dir, WebhookRetries: 2})
+	hook.backoff = time.Millisecond
+
+	payload := newWebhookPayload("boot", sessionResult{ID: 1, User: "testy", RemoteAddr: "192.168.10.1:22",
+		Dir: dir + "/", Files: []string{"/file"}, Sums: map[string]fileSum{"/file": {6, "5891b5b5"}},
+		Started: time.Now(), Finished: time.Now()})
+	hook.notify(payload, nil)
+
+	if len(receiver.bodies) != 1 {
+		t.Fatalf("Webhook delivered %d times, expected 1\n", len(receiver.bodies))
+	}
+
+	var received webhookPayload
+	if err = json.Unmarshal(receiver.bodies[0], &received); err != nil {
+		t.Fatalf("Unable to decode payload: %s\n", err)
+	}
+	if received.User != "testy" || received.ID != "boot-1" || len(received.Files) != 1 || received.Files[0].Name != "file" ||
+		received.Files[0].Size != 6 || received.Files[0].SHA256 != "5891b5b5" {
+		t.Errorf("Unexpected payload %+v\n", received)
+	}
+	if expected := "sha256=" + hook.sign(receiver.bodies[0]); receiver.signatures[0] != expected {
+		t.Errorf("Signature (%s) does not match expected (%s)\n", receiver.signatures[0], expected)
+	}
+
+	// All attempts fail so the payload is spooled.
+	receiver.failures = 3
+	hook.notify(payload, nil)
+
+	spooled, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(spooled) != 1 {
+		t.Fatalf("%d payloads spooled, expected 1\n", len(spooled))
+	}
+
+	hook.flushSpool()
+	if len(receiver.bodies) != 2 {
+		t.Errorf("Spooled webhook delivered %d times, expected 1\n", len(receiver.bodies)-1)
+	}
+	if spooled, _ = filepath.Glob(filepath.Join(dir, "*.json")); len(spooled) != 0 {
+		t.Errorf("%d payloads left in spool after flush\n", len(spooled))
+	}
+}
+
+func TestWebhookNotifyStop(t *testing.T) {
+	initLog("-", "none")
+
+	dir, err := ioutil.TempDir("", "scpdropWebhookTest")
+	if err != nil {
+		t.Fatalf("FATAL - Unable to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	receiver := &testWebhookServer{failures: 1}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	hook := newWebhook(Config{Webhook: ts.URL, WebhookSpool: dir, WebhookRetries: 3})
+	hook.backoff = time.Hour
+
+	// A stopped server spools the payload instead of waiting for the retry.
+	stop := make(chan struct{})
+	time.AfterFunc(10*time.Millisecond, func() { close(stop) })
+
+	start := time.Now()
+	hook.notify(newWebhookPayload("boot", sessionResult{ID: 1, User: "testy"}), stop)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Notify returned after %s, expected it to stop\n", elapsed)
+	}
+
+	spooled, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(spooled) != 1 {
+		t.Errorf("%d payloads spooled, expected 1\n", len(spooled))
+	}
+}